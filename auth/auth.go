@@ -0,0 +1,128 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+type Role string
+
+const (
+	// RoleHost can manage the session in addition to broadcasting its cursor.
+	RoleHost Role = "host"
+	// RolePresenter broadcasts its cursor to other members.
+	RolePresenter Role = "presenter"
+	// RoleViewer only watches cursors of others.
+	RoleViewer Role = "viewer"
+)
+
+func (r Role) Valid() bool {
+	return r == RoleHost || r == RolePresenter || r == RoleViewer
+}
+
+func (r Role) CanBroadcast() bool {
+	return r == RoleHost || r == RolePresenter
+}
+
+var roleRanks = map[Role]int{RoleViewer: 1, RolePresenter: 2, RoleHost: 3}
+
+// Min returns the less privileged of r and other, invalid roles rank lowest.
+func (r Role) Min(other Role) Role {
+	if roleRanks[other] < roleRanks[r] {
+		return other
+	}
+	return r
+}
+
+var ErrInvalidToken = errors.New("invalid token")
+var ErrTokenExpired = errors.New("token expired")
+
+// Claims of a join token, encoded as HS256 JWT.
+type Claims struct {
+	SessionId string `json:"sid"`
+	Role      Role   `json:"role"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+var jwtHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// IssueJoinToken returns token for sessionId signed with secret.
+func IssueJoinToken(secret []byte, sessionId string, role Role, ttl time.Duration) (string, Claims, error) {
+	now := time.Now()
+	claims := Claims{
+		SessionId: sessionId,
+		Role:      role,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(ttl).Unix(),
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", Claims{}, err
+	}
+	unsigned := jwtHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return unsigned + "." + sign(secret, unsigned), claims, nil
+}
+
+// VerifyJoinToken checks signature made with secret and expiry of token issued for sessionId.
+func VerifyJoinToken(secret []byte, token string, sessionId string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != jwtHeader {
+		return Claims{}, ErrInvalidToken
+	}
+	expected := sign(secret, parts[0]+"."+parts[1])
+	if !hmac.Equal([]byte(expected), []byte(parts[2])) {
+		return Claims{}, ErrInvalidToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return Claims{}, ErrInvalidToken
+	}
+	var claims Claims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return Claims{}, ErrInvalidToken
+	}
+	if claims.SessionId != sessionId || !claims.Role.Valid() {
+		return Claims{}, ErrInvalidToken
+	}
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return Claims{}, ErrTokenExpired
+	}
+	return claims, nil
+}
+
+// NewOwnerSecret returns a random secret handed to session creator and its hash to store.
+func NewOwnerSecret() (string, string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(secret)
+	return encoded, HashOwnerSecret(encoded), nil
+}
+
+func HashOwnerSecret(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(hash[:])
+}
+
+func VerifyOwnerSecret(secret string, hash string) bool {
+	if secret == "" || hash == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(HashOwnerSecret(secret)), []byte(hash)) == 1
+}
+
+func sign(secret []byte, unsigned string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(unsigned))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
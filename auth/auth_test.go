@@ -0,0 +1,131 @@
+package auth
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+var secret = []byte("test secret")
+
+func TestJoinTokenRoundTrip(t *testing.T) {
+	for _, role := range []Role{RoleHost, RolePresenter, RoleViewer} {
+		token, issued, err := IssueJoinToken(secret, "session", role, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		claims, err := VerifyJoinToken(secret, token, "session")
+		if err != nil {
+			t.Fatalf("%s: %v", role, err)
+		}
+		if claims != issued || claims.Role != role || claims.SessionId != "session" {
+			t.Errorf("verified %+v, issued %+v", claims, issued)
+		}
+		if claims.ExpiresAt-claims.IssuedAt != int64(time.Hour.Seconds()) {
+			t.Errorf("token lives %ds", claims.ExpiresAt-claims.IssuedAt)
+		}
+	}
+}
+
+// forge signs claims with secret, bypassing checks of IssueJoinToken.
+func forge(t *testing.T, secret []byte, claims any) string {
+	t.Helper()
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unsigned := jwtHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return unsigned + "." + sign(secret, unsigned)
+}
+
+func TestVerifyJoinTokenRejects(t *testing.T) {
+	token, _, err := IssueJoinToken(secret, "session", RoleViewer, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(token, ".")
+	hostPayload := base64.RawURLEncoding.EncodeToString([]byte(`{"sid":"session","role":"host","iat":0,"exp":9999999999}`))
+	noneHeader := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`))
+	expired, _, _ := IssueJoinToken(secret, "session", RoleHost, -time.Second)
+	future := time.Now().Add(time.Hour).Unix()
+
+	tests := []struct {
+		name      string
+		token     string
+		sessionId string
+		err       error
+	}{
+		{"empty", "", "session", ErrInvalidToken},
+		{"not a jwt", "token", "session", ErrInvalidToken},
+		{"other session", token, "other", ErrInvalidToken},
+		{"other secret", forge(t, []byte("other secret"), Claims{SessionId: "session", Role: RoleHost, ExpiresAt: future}), "session", ErrInvalidToken},
+		{"raised role", parts[0] + "." + hostPayload + "." + parts[2], "session", ErrInvalidToken},
+		{"missing signature", parts[0] + "." + parts[1] + ".", "session", ErrInvalidToken},
+		{"alg none", noneHeader + "." + parts[1] + ".", "session", ErrInvalidToken},
+		{"extra part", token + ".x", "session", ErrInvalidToken},
+		{"unknown role", forge(t, secret, Claims{SessionId: "session", Role: "admin", ExpiresAt: future}), "session", ErrInvalidToken},
+		{"malformed claims", forge(t, secret, "claims"), "session", ErrInvalidToken},
+		{"expired", expired, "session", ErrTokenExpired},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := VerifyJoinToken(secret, test.token, test.sessionId); !errors.Is(err, test.err) {
+				t.Errorf("expected %v, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestOwnerSecret(t *testing.T) {
+	ownerSecret, hash, err := NewOwnerSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !VerifyOwnerSecret(ownerSecret, hash) {
+		t.Error("owner secret doesn't match its hash")
+	}
+	other, _, _ := NewOwnerSecret()
+	if other == ownerSecret {
+		t.Error("owner secrets repeat")
+	}
+	for _, candidate := range []string{other, "", hash} {
+		if VerifyOwnerSecret(candidate, hash) {
+			t.Errorf("%q was accepted", candidate)
+		}
+	}
+	if VerifyOwnerSecret(ownerSecret, "") {
+		t.Error("secret was accepted for session without hash")
+	}
+}
+
+func TestRoleCanBroadcast(t *testing.T) {
+	for role, canBroadcast := range map[Role]bool{RoleHost: true, RolePresenter: true, RoleViewer: false} {
+		if !role.Valid() {
+			t.Errorf("%s isn't valid", role)
+		}
+		if role.CanBroadcast() != canBroadcast {
+			t.Errorf("%s.CanBroadcast() = %v", role, role.CanBroadcast())
+		}
+	}
+	if Role("admin").Valid() {
+		t.Error("unknown role is valid")
+	}
+}
+
+func TestRoleMin(t *testing.T) {
+	tests := []struct{ a, b, min Role }{
+		{RoleHost, RoleViewer, RoleViewer},
+		{RoleViewer, RoleHost, RoleViewer},
+		{RolePresenter, RoleHost, RolePresenter},
+		{RoleHost, RoleHost, RoleHost},
+		{RoleHost, "admin", "admin"},
+	}
+	for _, test := range tests {
+		if min := test.a.Min(test.b); min != test.min {
+			t.Errorf("%s.Min(%s) = %s, expected %s", test.a, test.b, min, test.min)
+		}
+	}
+}
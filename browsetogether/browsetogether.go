@@ -0,0 +1,184 @@
+// Package browsetogether runs Browse Together inside other applications. Handler
+// serves the sessions API and cursors socket, mount its App into a Fiber app, serve
+// its HTTPHandler with net/http or serve it on its own.
+//
+//	cursors, err := browsetogether.New(cfg, browsetogether.WithPathPrefix("/cursors"))
+//	if err != nil {
+//		return err
+//	}
+//	go cursors.Run(ctx)
+//	mux.Handle("/cursors/", cursors.HTTPHandler())
+package browsetogether
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+	"github.com/redis/go-redis/v9"
+
+	"github.com/dwilkolek/browse-together-api/clients"
+	"github.com/dwilkolek/browse-together-api/config"
+	"github.com/dwilkolek/browse-together-api/db"
+	"github.com/dwilkolek/browse-together-api/dto"
+	"github.com/dwilkolek/browse-together-api/internal/server"
+	"github.com/dwilkolek/browse-together-api/queue"
+	"github.com/dwilkolek/browse-together-api/streaming"
+)
+
+// Member identifies connection of a member passed to hooks.
+type Member = server.Member
+
+type options struct {
+	prefix  string
+	store   db.Db
+	queues  queue.Factory
+	options server.Options
+}
+
+type Option func(*options)
+
+// WithPathPrefix serves all routes under prefix, e.g. /cursors/api/v1/sessions.
+func WithPathPrefix(prefix string) Option {
+	return func(o *options) {
+		o.prefix = prefix
+	}
+}
+
+// WithAuth calls hook before API and socket handlers, returned error rejects the request
+// and *fiber.Error sets its status. Join tokens and owner secrets are still required.
+func WithAuth(hook func(r *http.Request) error) Option {
+	return func(o *options) {
+		o.options.Auth = hook
+	}
+}
+
+// WithStore keeps sessions in store instead of the one selected by cfg.Storage.
+func WithStore(store db.Db) Option {
+	return func(o *options) {
+		o.store = store
+	}
+}
+
+// WithQueue creates queues of sessions with queues instead of the ones selected by cfg.Queue.
+func WithQueue(queues queue.Factory) Option {
+	return func(o *options) {
+		o.queues = queues
+	}
+}
+
+// OnJoin calls hook once member was greeted. Hooks run on goroutine of the member
+// connection and must not block.
+func OnJoin(hook func(member Member)) Option {
+	return func(o *options) {
+		o.options.Hooks.Join = hook
+	}
+}
+
+// OnLeave calls hook once member is disconnected.
+func OnLeave(hook func(member Member)) Option {
+	return func(o *options) {
+		o.options.Hooks.Leave = hook
+	}
+}
+
+// OnPosition calls hook for every position accepted from a member.
+func OnPosition(hook func(member Member, position dto.PositionStateDTO)) Option {
+	return func(o *options) {
+		o.options.Hooks.Position = hook
+	}
+}
+
+// Handler is an instance of Browse Together, instances sharing neither store nor
+// queues are isolated from each other.
+type Handler struct {
+	app      *fiber.App
+	server   *server.FiberServer
+	sessions *streaming.Registry
+	store    db.Db
+	cfg      config.Config
+	prefix   string
+}
+
+// New returns handler configured by cfg, e.g. from config.Load or config.Default.
+// cfg.AuthSecret is required so join tokens work across instances and restarts, the rest
+// of cfg must pass config.Validate.
+func New(cfg config.Config, opts ...Option) (*Handler, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if len(cfg.AuthSecret) == 0 {
+		return nil, errors.New("browsetogether: AuthSecret is required")
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("browsetogether: %w", err)
+	}
+
+	var redisClient *redis.Client
+	if (o.store == nil && cfg.Storage == config.Redis) || (o.queues == nil && cfg.Queue == config.Redis) {
+		var err error
+		if redisClient, err = clients.NewRedisClient(cfg.RedisURL); err != nil {
+			return nil, err
+		}
+	}
+	store := o.store
+	if store == nil {
+		var err error
+		if store, err = db.Open(cfg, redisClient); err != nil {
+			return nil, err
+		}
+	}
+	queues := o.queues
+	if queues == nil {
+		var err error
+		if queues, err = queue.NewFactory(cfg, redisClient); err != nil {
+			return nil, err
+		}
+	}
+
+	sessions := streaming.NewRegistry(cfg, queues)
+	srv := server.New(cfg, store, sessions, o.options)
+	app := srv.App
+	if o.prefix != "" {
+		app = fiber.New(fiber.Config{DisableStartupMessage: true})
+		app.Mount(o.prefix, srv.App)
+	}
+	return &Handler{app: app, server: srv, sessions: sessions, store: store, cfg: cfg, prefix: o.prefix}, nil
+}
+
+// App serves the API under path prefix, mount it with app.Mount("/", h.App()) or Listen on it.
+func (h *Handler) App() *fiber.App {
+	return h.app
+}
+
+// HTTPHandler serves the API under path prefix to net/http servers, so it works with
+// standard middlewares, HTTP/2 proxies and httptest. Cursors socket is upgraded by
+// net/http, the rest goes through App.
+func (h *Handler) HTTPHandler() http.Handler {
+	api := adaptor.FiberApp(h.app)
+	socket := http.StripPrefix(h.prefix, h.server.SocketHandler())
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, h.prefix+"/ws/") {
+			socket.ServeHTTP(w, r)
+			return
+		}
+		api.ServeHTTP(w, r)
+	})
+}
+
+// Run closes expired and idle sessions until ctx is done.
+func (h *Handler) Run(ctx context.Context) {
+	h.sessions.RunJanitor(ctx, h.store, h.cfg.Session.JanitorInterval)
+}
+
+// Shutdown rejects new requests, asks connected members to reconnect elsewhere and
+// persists sessions, giving up when ctx is done. It doesn't stop the app it's mounted in.
+func (h *Handler) Shutdown(ctx context.Context) error {
+	h.server.Drain(ctx)
+	return ctx.Err()
+}
@@ -0,0 +1,245 @@
+// Package client talks to Browse Together server: it wraps the session REST API
+// and keeps a connection to the cursors socket of a session.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dwilkolek/browse-together-api/dto"
+)
+
+type Client struct {
+	baseUrl    string
+	httpClient *http.Client
+	minBackoff time.Duration
+	maxBackoff time.Duration
+}
+
+type Option func(c *Client)
+
+// WithHTTPClient replaces http.DefaultClient used for REST calls.
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// WithReconnectBackoff bounds delay between reconnect attempts of cursors socket,
+// it doubles after every failed attempt starting from min.
+func WithReconnectBackoff(min time.Duration, max time.Duration) Option {
+	return func(c *Client) {
+		c.minBackoff = min
+		c.maxBackoff = max
+	}
+}
+
+// New creates client of server at baseUrl, e.g. https://browse-together.fly.dev.
+func New(baseUrl string, options ...Option) *Client {
+	c := &Client{
+		baseUrl:    strings.TrimSuffix(baseUrl, "/"),
+		httpClient: http.DefaultClient,
+		minBackoff: 500 * time.Millisecond,
+		maxBackoff: 30 * time.Second,
+	}
+	for _, option := range options {
+		option(c)
+	}
+	return c
+}
+
+// ProblemError is returned when server rejects a call.
+type ProblemError struct {
+	dto.ProblemDTO
+}
+
+func (e *ProblemError) Error() string {
+	if e.Detail != "" {
+		return fmt.Sprintf("%d %s: %s", e.Status, e.Title, e.Detail)
+	}
+	return fmt.Sprintf("%d %s", e.Status, e.Title)
+}
+
+type CreateSessionRequest struct {
+	Name               string          `json:"name"`
+	BaseLocation       string          `json:"baseLocation"`
+	Creator            string          `json:"creator,omitempty"`
+	TickRate           int             `json:"tickRate,omitempty"`
+	MaxLifetimeSeconds int             `json:"maxLifetimeSeconds,omitempty"`
+	IdleTimeoutSeconds int             `json:"idleTimeoutSeconds,omitempty"`
+	Tags               []string        `json:"tags,omitempty"`
+	MaxMembers         int             `json:"maxMembers,omitempty"`
+	Attributes         json.RawMessage `json:"attributes,omitempty"`
+}
+
+// UpdateSessionRequest changes only fields that are not nil.
+type UpdateSessionRequest struct {
+	Name         *string `json:"name,omitempty"`
+	BaseLocation *string `json:"baseLocation,omitempty"`
+	Creator      *string `json:"creator,omitempty"`
+}
+
+type ListOptions struct {
+	Creator            string
+	BaseLocationPrefix string
+	// Ascending lists oldest sessions first.
+	Ascending bool
+	Limit     int
+	// Cursor of the page, empty for the first one.
+	Cursor string
+}
+
+func (c *Client) CreateSession(ctx context.Context, request CreateSessionRequest) (dto.CreatedSessionDTO, error) {
+	var session dto.CreatedSessionDTO
+	_, err := c.do(ctx, http.MethodPost, "/api/v1/sessions", "", nil, request, &session)
+	return session, err
+}
+
+// ListSessions returns a page of sessions and cursor of the next page, empty on the last one.
+func (c *Client) ListSessions(ctx context.Context, options ListOptions) ([]dto.SessionDTO, string, error) {
+	query := url.Values{}
+	if options.Creator != "" {
+		query.Set("creator", options.Creator)
+	}
+	if options.BaseLocationPrefix != "" {
+		query.Set("baseLocationPrefix", options.BaseLocationPrefix)
+	}
+	if options.Ascending {
+		query.Set("sort", "createdAt")
+	}
+	if options.Limit > 0 {
+		query.Set("limit", strconv.Itoa(options.Limit))
+	}
+	if options.Cursor != "" {
+		query.Set("cursor", options.Cursor)
+	}
+	path := "/api/v1/sessions"
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+
+	var sessions []dto.SessionDTO
+	header, err := c.do(ctx, http.MethodGet, path, "", nil, nil, &sessions)
+	if err != nil {
+		return nil, "", err
+	}
+	return sessions, nextCursor(header.Get("Link")), nil
+}
+
+func (c *Client) GetSession(ctx context.Context, sessionId string) (dto.SessionDTO, error) {
+	var session dto.SessionDTO
+	_, err := c.do(ctx, http.MethodGet, "/api/v1/sessions/"+url.PathEscape(sessionId), "", nil, nil, &session)
+	return session, err
+}
+
+// UpdateSession applies request if session is still at version, 0 updates unconditionally.
+// credential is owner secret or host token.
+func (c *Client) UpdateSession(ctx context.Context, sessionId string, credential string, version int64, request UpdateSessionRequest) (dto.SessionDTO, error) {
+	header := http.Header{}
+	if version != 0 {
+		header.Set("If-Match", fmt.Sprintf(`"%d"`, version))
+	}
+	var session dto.SessionDTO
+	_, err := c.do(ctx, http.MethodPatch, "/api/v1/sessions/"+url.PathEscape(sessionId), credential, header, request, &session)
+	return session, err
+}
+
+// CloseSession disconnects all members and removes session, credential is owner secret or host token.
+func (c *Client) CloseSession(ctx context.Context, sessionId string, credential string) error {
+	_, err := c.do(ctx, http.MethodDelete, "/api/v1/sessions/"+url.PathEscape(sessionId), credential, nil, nil, nil)
+	return err
+}
+
+// IssueJoinToken issues token for role, ttl 0 uses server default.
+func (c *Client) IssueJoinToken(ctx context.Context, sessionId string, ownerSecret string, role string, ttl time.Duration) (dto.JoinTokenDTO, error) {
+	request := map[string]any{"role": role}
+	if ttl > 0 {
+		request["ttlSeconds"] = int64(ttl.Seconds())
+	}
+	var token dto.JoinTokenDTO
+	_, err := c.do(ctx, http.MethodPost, "/api/v1/sessions/"+url.PathEscape(sessionId)+"/tokens", ownerSecret, nil, request, &token)
+	return token, err
+}
+
+func (c *Client) GetMembers(ctx context.Context, sessionId string, joinToken string) ([]dto.MemberDTO, error) {
+	var members []dto.MemberDTO
+	_, err := c.do(ctx, http.MethodGet, "/api/v1/sessions/"+url.PathEscape(sessionId)+"/members", joinToken, nil, nil, &members)
+	return members, err
+}
+
+// SetMemberRole changes role of member, credential is owner secret or host token.
+func (c *Client) SetMemberRole(ctx context.Context, sessionId string, credential string, memberId int64, role string) error {
+	path := fmt.Sprintf("/api/v1/sessions/%s/members/%d", url.PathEscape(sessionId), memberId)
+	_, err := c.do(ctx, http.MethodPatch, path, credential, nil, map[string]string{"role": role}, nil)
+	return err
+}
+
+// KickMember disconnects member, credential is owner secret or host token.
+func (c *Client) KickMember(ctx context.Context, sessionId string, credential string, memberId int64) error {
+	path := fmt.Sprintf("/api/v1/sessions/%s/members/%d", url.PathEscape(sessionId), memberId)
+	_, err := c.do(ctx, http.MethodDelete, path, credential, nil, nil, nil)
+	return err
+}
+
+// do sends request with optional JSON body and bearer token, decoding JSON response into out.
+func (c *Client) do(ctx context.Context, method string, path string, token string, header http.Header, body any, out any) (http.Header, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseUrl+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		problem := &ProblemError{dto.ProblemDTO{Status: resp.StatusCode, Title: http.StatusText(resp.StatusCode)}}
+		_ = json.NewDecoder(resp.Body).Decode(&problem.ProblemDTO)
+		return resp.Header, problem
+	}
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return resp.Header, err
+		}
+	}
+	return resp.Header, nil
+}
+
+// nextCursor extracts cursor from Link: <...?cursor=...>; rel="next".
+func nextCursor(link string) string {
+	target, params, ok := strings.Cut(link, ";")
+	if !ok || !strings.Contains(params, `rel="next"`) {
+		return ""
+	}
+	next, err := url.Parse(strings.Trim(strings.TrimSpace(target), "<>"))
+	if err != nil {
+		return ""
+	}
+	return next.Query().Get("cursor")
+}
@@ -0,0 +1,418 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fasthttp/websocket"
+
+	"github.com/dwilkolek/browse-together-api/dto"
+	"github.com/dwilkolek/browse-together-api/protocol"
+)
+
+const (
+	handshakeTimeout = 10 * time.Second
+	writeTimeout     = 10 * time.Second
+)
+
+// ErrDisconnected is returned when sending while Conn is reconnecting.
+var ErrDisconnected = errors.New("client: disconnected")
+
+// CloseError ends Conn when server closed it for good, e.g. session was closed
+// or member was kicked. Reason is one of dto.Close* values.
+type CloseError struct {
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return "client: connection closed, " + e.Reason
+}
+
+// errReconnect is returned by read when server asked to reconnect right away.
+var errReconnect = errors.New("client: server asked to reconnect")
+
+// errSlowConsumer is returned by read when server evicted member for falling behind,
+// Conn reconnects with backoff as if connection dropped.
+var errSlowConsumer = errors.New("client: evicted for reading too slowly")
+
+// Conn is a member connected to cursors socket of a session. It reconnects with
+// backoff when connection drops, keeping member id with the rejoin token from
+// hello, and publishes positions of visible members on Snapshots.
+type Conn struct {
+	client    *Client
+	sessionId string
+	joinToken string
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu          sync.Mutex
+	ws          *websocket.Conn
+	hello       dto.HelloDTO
+	rejoinToken string
+	identifier  string
+	err         error
+	// writeMu serializes writes, websocket.Conn supports one concurrent writer.
+	writeMu sync.Mutex
+
+	// positions are only touched by run goroutine.
+	positions map[int64]dto.PositionStateDTO
+	snapshots chan []dto.PositionStateDTO
+}
+
+// Connect joins session with joinToken. It returns once server greeted the member,
+// the connection lasts until ctx is done, Close is called or server closes it for good.
+func (c *Client) Connect(ctx context.Context, sessionId string, joinToken string) (*Conn, error) {
+	connCtx, cancel := context.WithCancel(ctx)
+	conn := &Conn{
+		client:    c,
+		sessionId: sessionId,
+		joinToken: joinToken,
+		ctx:       connCtx,
+		cancel:    cancel,
+		done:      make(chan struct{}),
+		positions: make(map[int64]dto.PositionStateDTO),
+		snapshots: make(chan []dto.PositionStateDTO, 1),
+	}
+	ws, err := conn.dial()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	go conn.run(ws)
+	return conn, nil
+}
+
+// Snapshots delivers positions of visible members sorted by member id after every
+// snapshot or delta. Slow readers only get the latest one. Closed when Conn ends.
+func (c *Conn) Snapshots() <-chan []dto.PositionStateDTO {
+	return c.snapshots
+}
+
+// MemberId stays the same across reconnects.
+func (c *Conn) MemberId() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hello.MemberId
+}
+
+// Role may change when host changes it and member reconnects.
+func (c *Conn) Role() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hello.Role
+}
+
+// Members are the other members connected when server greeted the member last time.
+func (c *Conn) Members() []dto.MemberDTO {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hello.Members
+}
+
+// Identify changes identifier shown to others, it's sent again after reconnecting.
+func (c *Conn) Identify(identifier string) error {
+	c.mu.Lock()
+	c.identifier = identifier
+	c.mu.Unlock()
+	err := c.send(dto.MessageIdentify, dto.IdentifyCmdDTO{Identifier: identifier})
+	if errors.Is(err, ErrDisconnected) {
+		return nil
+	}
+	return err
+}
+
+// Move updates cursor of the member, it's rejected by server for viewers.
+func (c *Conn) Move(position dto.UpdatePositionCmdDTO) error {
+	return c.send(dto.MessagePosition, position)
+}
+
+// Close disconnects and waits until Conn ends.
+func (c *Conn) Close() error {
+	c.cancel()
+	c.mu.Lock()
+	if c.ws != nil {
+		c.writeMu.Lock()
+		_ = c.ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(writeTimeout))
+		c.writeMu.Unlock()
+		_ = c.ws.Close()
+	}
+	c.mu.Unlock()
+	<-c.done
+	return nil
+}
+
+// Done is closed when Conn ends.
+func (c *Conn) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err explains why Conn ended, nil if it was closed by client.
+func (c *Conn) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+func (c *Conn) send(messageType string, payload any) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	frame, err := json.Marshal(dto.EnvelopeDTO{Type: messageType, V: dto.ProtocolVersion, Payload: data})
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	ws := c.ws
+	c.mu.Unlock()
+	if ws == nil {
+		return ErrDisconnected
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_ = ws.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if err := ws.WriteMessage(websocket.TextMessage, frame); err != nil {
+		return ErrDisconnected
+	}
+	return nil
+}
+
+// run reads from ws and reconnects until Conn ends.
+func (c *Conn) run(ws *websocket.Conn) {
+	defer close(c.done)
+	defer close(c.snapshots)
+
+	backoff := c.client.minBackoff
+	for {
+		err := c.read(ws)
+		c.mu.Lock()
+		c.ws = nil
+		c.mu.Unlock()
+		_ = ws.Close()
+
+		var closeErr *CloseError
+		if errors.As(err, &closeErr) {
+			c.finish(err)
+			return
+		}
+		if !errors.Is(err, errReconnect) && !c.wait(backoff) {
+			c.finish(nil)
+			return
+		}
+
+		for {
+			if c.ctx.Err() != nil {
+				c.finish(nil)
+				return
+			}
+			ws, err = c.dial()
+			if err == nil {
+				backoff = c.client.minBackoff
+				break
+			}
+			var problem *ProblemError
+			if errors.As(err, &problem) || errors.As(err, &closeErr) {
+				c.finish(err)
+				return
+			}
+			backoff = min(backoff*2, c.client.maxBackoff)
+			if !c.wait(backoff) {
+				c.finish(nil)
+				return
+			}
+		}
+	}
+}
+
+// wait sleeps for backoff with jitter, false when Conn was closed meanwhile.
+func (c *Conn) wait(backoff time.Duration) bool {
+	jitter := time.Duration(rand.Int63n(int64(backoff)/2 + 1))
+	timer := time.NewTimer(backoff/2 + jitter)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-c.ctx.Done():
+		return false
+	}
+}
+
+func (c *Conn) finish(err error) {
+	c.mu.Lock()
+	c.err = err
+	c.mu.Unlock()
+}
+
+// dial connects and waits for hello. Rejections of the handshake and close
+// messages sent instead of hello are returned as ProblemError and CloseError.
+func (c *Conn) dial() (*websocket.Conn, error) {
+	c.mu.Lock()
+	rejoinToken := c.rejoinToken
+	identifier := c.identifier
+	c.mu.Unlock()
+
+	socketUrl, err := url.Parse(c.client.baseUrl)
+	if err != nil {
+		return nil, err
+	}
+	socketUrl.Scheme = strings.Replace(socketUrl.Scheme, "http", "ws", 1)
+	socketUrl.Path += "/ws/" + url.PathEscape(c.sessionId) + "/cursors"
+	query := url.Values{"token": {c.joinToken}}
+	if rejoinToken != "" {
+		query.Set("rejoinToken", rejoinToken)
+	}
+	socketUrl.RawQuery = query.Encode()
+
+	dialer := websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: handshakeTimeout,
+		Subprotocols:     []string{protocol.SubprotocolJSON},
+	}
+	ws, resp, err := dialer.DialContext(c.ctx, socketUrl.String(), nil)
+	if err != nil {
+		if resp != nil && resp.StatusCode >= 400 && resp.StatusCode < 500 {
+			problem := &ProblemError{dto.ProblemDTO{Status: resp.StatusCode, Title: http.StatusText(resp.StatusCode)}}
+			_ = json.NewDecoder(resp.Body).Decode(&problem.ProblemDTO)
+			return nil, problem
+		}
+		return nil, err
+	}
+	if ws.Subprotocol() != protocol.SubprotocolJSON {
+		_ = ws.Close()
+		return nil, fmt.Errorf("client: server doesn't speak %s", protocol.SubprotocolJSON)
+	}
+
+	_ = ws.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	envelope, err := readEnvelope(ws)
+	if err != nil {
+		_ = ws.Close()
+		return nil, err
+	}
+	_ = ws.SetReadDeadline(time.Time{})
+	switch envelope.Type {
+	case dto.MessageHello:
+	case dto.MessageClose:
+		_ = ws.Close()
+		closeMsg := decodeClose(envelope.Payload)
+		if closeMsg.Reason == dto.CloseReconnect {
+			return nil, errReconnect
+		}
+		return nil, &CloseError{Reason: closeMsg.Reason}
+	default:
+		_ = ws.Close()
+		return nil, fmt.Errorf("client: expected %s, got %s", dto.MessageHello, envelope.Type)
+	}
+	var hello dto.HelloDTO
+	if err := json.Unmarshal(envelope.Payload, &hello); err != nil {
+		_ = ws.Close()
+		return nil, err
+	}
+
+	c.mu.Lock()
+	if c.ctx.Err() != nil {
+		c.mu.Unlock()
+		_ = ws.Close()
+		return nil, c.ctx.Err()
+	}
+	c.ws = ws
+	c.hello = hello
+	c.rejoinToken = hello.RejoinToken
+	c.mu.Unlock()
+
+	if identifier != "" {
+		_ = c.send(dto.MessageIdentify, dto.IdentifyCmdDTO{Identifier: identifier})
+	}
+	return ws, nil
+}
+
+// read handles messages until connection drops or server closes it.
+func (c *Conn) read(ws *websocket.Conn) error {
+	for {
+		envelope, err := readEnvelope(ws)
+		if err != nil {
+			return err
+		}
+		switch envelope.Type {
+		case dto.MessageSnapshot:
+			var states []dto.PositionStateDTO
+			if err := json.Unmarshal(envelope.Payload, &states); err != nil {
+				return err
+			}
+			clear(c.positions)
+			for _, state := range states {
+				c.positions[state.MemberId] = state
+			}
+			c.publish()
+		case dto.MessageDelta:
+			var delta dto.PositionDeltaDTO
+			if err := json.Unmarshal(envelope.Payload, &delta); err != nil {
+				return err
+			}
+			for _, state := range append(delta.Added, delta.Moved...) {
+				c.positions[state.MemberId] = state
+			}
+			for _, memberId := range delta.Removed {
+				delete(c.positions, memberId)
+			}
+			c.publish()
+		case dto.MessageClose:
+			closeMsg := decodeClose(envelope.Payload)
+			if closeMsg.Reason == dto.CloseSlowConsumer {
+				return errSlowConsumer
+			}
+			if closeMsg.Reason != dto.CloseReconnect {
+				return &CloseError{Reason: closeMsg.Reason}
+			}
+			if closeMsg.RejoinToken != "" {
+				c.mu.Lock()
+				c.rejoinToken = closeMsg.RejoinToken
+				c.mu.Unlock()
+			}
+			return errReconnect
+		}
+	}
+}
+
+// publish replaces snapshot not yet received by reader.
+func (c *Conn) publish() {
+	states := make([]dto.PositionStateDTO, 0, len(c.positions))
+	for _, state := range c.positions {
+		states = append(states, state)
+	}
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].MemberId < states[j].MemberId
+	})
+	select {
+	case <-c.snapshots:
+	default:
+	}
+	c.snapshots <- states
+}
+
+func readEnvelope(ws *websocket.Conn) (dto.EnvelopeDTO, error) {
+	var envelope dto.EnvelopeDTO
+	_, data, err := ws.ReadMessage()
+	if err != nil {
+		return envelope, err
+	}
+	err = json.Unmarshal(data, &envelope)
+	return envelope, err
+}
+
+func decodeClose(payload json.RawMessage) dto.CloseDTO {
+	var closeMsg dto.CloseDTO
+	_ = json.Unmarshal(payload, &closeMsg)
+	return closeMsg
+}
@@ -0,0 +1,276 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+
+	"github.com/dwilkolek/browse-together-api/config"
+	"github.com/dwilkolek/browse-together-api/db"
+	"github.com/dwilkolek/browse-together-api/dto"
+	"github.com/dwilkolek/browse-together-api/internal/server"
+	"github.com/dwilkolek/browse-together-api/queue"
+	"github.com/dwilkolek/browse-together-api/streaming"
+)
+
+// testInstance is a server instance, instances of a test share the store like they would share Redis.
+type testInstance struct {
+	*server.FiberServer
+	handler http.Handler
+	joined  chan server.Member
+}
+
+func newTestInstance(t *testing.T, store db.Db) *testInstance {
+	t.Helper()
+	cfg := config.Default()
+	cfg.AuthSecret = []byte("test secret")
+	queues, err := queue.NewFactory(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	instance := &testInstance{joined: make(chan server.Member, 16)}
+	instance.FiberServer = server.New(cfg, store, streaming.NewRegistry(cfg, queues), server.Options{Hooks: server.Hooks{
+		Join: func(member server.Member) { instance.joined <- member },
+	}})
+	api := adaptor.FiberApp(instance.App)
+	socket := instance.SocketHandler()
+	instance.handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/ws/") {
+			socket.ServeHTTP(w, r)
+			return
+		}
+		api.ServeHTTP(w, r)
+	})
+	return instance
+}
+
+// expectJoin returns the next member greeted by instance.
+func (i *testInstance) expectJoin(t *testing.T) server.Member {
+	t.Helper()
+	select {
+	case member := <-i.joined:
+		return member
+	case <-time.After(5 * time.Second):
+		t.Fatal("nobody joined")
+		return server.Member{}
+	}
+}
+
+// testServer routes requests to the current instance and can drop connections it upgraded.
+type testServer struct {
+	*httptest.Server
+	instance atomic.Pointer[testInstance]
+	// unavailable makes the server answer 503 while set.
+	unavailable atomic.Bool
+	mu          sync.Mutex
+	hijacked    []net.Conn
+	attempts    []time.Time
+}
+
+func newTestServer(t *testing.T, instance *testInstance) *testServer {
+	t.Helper()
+	s := &testServer{}
+	s.instance.Store(instance)
+	s.Server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/ws/") {
+			s.mu.Lock()
+			s.attempts = append(s.attempts, time.Now())
+			s.mu.Unlock()
+		}
+		if s.unavailable.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		s.instance.Load().handler.ServeHTTP(w, r)
+	}))
+	s.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateHijacked {
+			s.mu.Lock()
+			s.hijacked = append(s.hijacked, conn)
+			s.mu.Unlock()
+		}
+	}
+	s.Start()
+	t.Cleanup(s.Close)
+	return s
+}
+
+// dropConnections closes sockets as if network failed.
+func (s *testServer) dropConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.hijacked {
+		_ = conn.Close()
+	}
+	s.hijacked = nil
+}
+
+func (s *testServer) socketAttempts() []time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]time.Time(nil), s.attempts...)
+}
+
+func createSession(t *testing.T, c *Client) dto.CreatedSessionDTO {
+	t.Helper()
+	session, err := c.CreateSession(context.Background(), CreateSessionRequest{Name: "test", BaseLocation: "https://example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return session
+}
+
+func connect(t *testing.T, c *Client, session dto.CreatedSessionDTO) *Conn {
+	t.Helper()
+	conn, err := c.Connect(context.Background(), session.Id, session.JoinToken.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func newTestStore(t *testing.T) db.Db {
+	t.Helper()
+	store, err := db.Open(config.Default(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestConnectRejoinsWithTokenFromHello(t *testing.T) {
+	instance := newTestInstance(t, newTestStore(t))
+	srv := newTestServer(t, instance)
+	c := New(srv.URL, WithReconnectBackoff(10*time.Millisecond, 50*time.Millisecond))
+	session := createSession(t, c)
+
+	conn := connect(t, c, session)
+	joined := instance.expectJoin(t)
+	if conn.MemberId() < 1 || conn.MemberId() != joined.MemberId {
+		t.Fatalf("hello greeted member %d, server joined %d", conn.MemberId(), joined.MemberId)
+	}
+	if conn.Role() != string(joined.Role) {
+		t.Errorf("role %s, server joined %s", conn.Role(), joined.Role)
+	}
+	other := connect(t, c, session)
+	instance.expectJoin(t)
+	if other.MemberId() == conn.MemberId() {
+		t.Fatal("second connection got the same member id")
+	}
+
+	srv.dropConnections()
+	for i := 0; i < 2; i++ {
+		if rejoined := instance.expectJoin(t); rejoined.MemberId != conn.MemberId() && rejoined.MemberId != other.MemberId() {
+			t.Errorf("member %d joined after connections dropped, expected members to rejoin", rejoined.MemberId)
+		}
+	}
+	if conn.Err() != nil {
+		t.Errorf("connection ended with %v", conn.Err())
+	}
+}
+
+func TestConnectBacksOffWhileServerIsDown(t *testing.T) {
+	instance := newTestInstance(t, newTestStore(t))
+	srv := newTestServer(t, instance)
+	minBackoff, maxBackoff := 20*time.Millisecond, 80*time.Millisecond
+	c := New(srv.URL, WithReconnectBackoff(minBackoff, maxBackoff))
+	session := createSession(t, c)
+	conn := connect(t, c, session)
+	instance.expectJoin(t)
+
+	srv.unavailable.Store(true)
+	srv.dropConnections()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(srv.socketAttempts()) < 5 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	srv.unavailable.Store(false)
+	if rejoined := instance.expectJoin(t); rejoined.MemberId != conn.MemberId() {
+		t.Errorf("member %d joined once server was back, expected %d", rejoined.MemberId, conn.MemberId())
+	}
+
+	// attempts[0] is the first connection, every retry waits at least half of its backoff
+	attempts := srv.socketAttempts()
+	if len(attempts) < 5 {
+		t.Fatalf("%d attempts", len(attempts))
+	}
+	backoff := minBackoff
+	for i := 2; i < len(attempts); i++ {
+		if gap := attempts[i].Sub(attempts[i-1]); gap < backoff/2 {
+			t.Errorf("attempt %d came %s after the previous one, backoff is %s", i, gap, backoff)
+		}
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+func TestConnectMovesToAnotherInstanceWhenAskedToReconnect(t *testing.T) {
+	store := newTestStore(t)
+	draining := newTestInstance(t, store)
+	srv := newTestServer(t, draining)
+	// backoff longer than the test, reconnect must not wait for it
+	c := New(srv.URL, WithReconnectBackoff(time.Minute, time.Minute))
+	session := createSession(t, c)
+	conn := connect(t, c, session)
+	draining.expectJoin(t)
+
+	next := newTestInstance(t, store)
+	srv.instance.Store(next)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	draining.Drain(ctx)
+
+	if rejoined := next.expectJoin(t); rejoined.MemberId != conn.MemberId() {
+		t.Errorf("member %d joined next instance, expected %d", rejoined.MemberId, conn.MemberId())
+	}
+	if conn.Err() != nil {
+		t.Errorf("connection ended with %v", conn.Err())
+	}
+}
+
+func TestConnectionEndsWithCloseError(t *testing.T) {
+	instance := newTestInstance(t, newTestStore(t))
+	srv := newTestServer(t, instance)
+	c := New(srv.URL, WithReconnectBackoff(10*time.Millisecond, 50*time.Millisecond))
+
+	t.Run("session closed", func(t *testing.T) {
+		session := createSession(t, c)
+		conn := connect(t, c, session)
+		instance.expectJoin(t)
+		if err := c.CloseSession(context.Background(), session.Id, session.OwnerSecret); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-conn.Done():
+		case <-time.After(5 * time.Second):
+			t.Fatal("connection didn't end")
+		}
+		var closeErr *CloseError
+		if !errors.As(conn.Err(), &closeErr) || closeErr.Reason != dto.CloseSessionClosed {
+			t.Errorf("connection ended with %v", conn.Err())
+		}
+	})
+
+	t.Run("session full", func(t *testing.T) {
+		session, err := c.CreateSession(context.Background(), CreateSessionRequest{Name: "full", BaseLocation: "https://example.com", MaxMembers: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		connect(t, c, session)
+		instance.expectJoin(t)
+		_, err = c.Connect(context.Background(), session.Id, session.JoinToken.Token)
+		var closeErr *CloseError
+		if !errors.As(err, &closeErr) || closeErr.Reason != dto.CloseSessionFull {
+			t.Errorf("connecting to full session failed with %v", err)
+		}
+	})
+}
@@ -1,34 +1,20 @@
 package clients
 
 import (
-	"fmt"
-	"os"
-	"sync"
+	"log/slog"
 
 	"github.com/redis/go-redis/v9"
-)
-
-var redisClient *redis.Client
-var redisLock sync.Mutex = sync.Mutex{}
 
-func CreateRedisClient() *redis.Client {
-	if redisClient == nil {
-		redisLock.Lock()
-		defer redisLock.Unlock()
-		if redisClient == nil {
-			addr := os.Getenv("REDIS_URL")
-			if addr == "" {
-				addr = "redis://default:@localhost:6379/0"
-
-			}
-			opt, err := redis.ParseURL(addr)
-			fmt.Printf("%v\n", opt)
-			if err != nil {
-				panic(err)
-			}
+	"github.com/dwilkolek/browse-together-api/config"
+)
 
-			redisClient = redis.NewClient(opt)
-		}
+// NewRedisClient returns client for redisUrl, shared by store and queues of the instance.
+// It fails only when redisUrl is invalid, connection problems surface on use.
+func NewRedisClient(redisUrl string) (*redis.Client, error) {
+	opt, err := config.ParseRedisURL(redisUrl)
+	if err != nil {
+		return nil, err
 	}
-	return redisClient
+	slog.Info("Connecting to redis", "addr", opt.Addr, "db", opt.DB, "tls", opt.TLSConfig != nil)
+	return redis.NewClient(opt), nil
 }
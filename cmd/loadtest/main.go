@@ -0,0 +1,309 @@
+// Loadtest creates sessions with simulated members moving cursors against a running
+// server and reports broadcast latency, frames the server dropped and server memory.
+//
+//	go run ./cmd/loadtest -url http://localhost:8080 -sessions 10 -members 20 -rate 10 -duration 30s
+//
+// Server memory and dropped frames are read from /metrics, counters of all sessions
+// of the instance are reported, not only those of the loadtest.
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dwilkolek/browse-together-api/client"
+	"github.com/dwilkolek/browse-together-api/dto"
+)
+
+type options struct {
+	url      string
+	sessions int
+	members  int
+	movers   int
+	rate     float64
+	tickRate int
+	duration time.Duration
+}
+
+// selectors are few and repeat, like on a real page, so binary clients intern them once.
+var selectors = []string{"#header", "#nav", "#main", "#article", "#aside", "#footer"}
+
+type member struct {
+	conn    *client.Conn
+	moving  bool
+	sent    int64
+	results results
+}
+
+// results are collected by every member from the positions of others.
+type results struct {
+	latencies []time.Duration
+	received  int64
+}
+
+// moveKey identifies a move by its member and random x coordinate.
+type moveKey struct {
+	memberId int64
+	x        float64
+}
+
+// moves records when every move was sent, so receivers can measure latency.
+type moves struct {
+	mu     sync.Mutex
+	sentAt map[moveKey]time.Time
+}
+
+func (m *moves) record(key moveKey) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sentAt[key] = time.Now()
+}
+
+func (m *moves) lookup(key moveKey) (time.Time, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sentAt, ok := m.sentAt[key]
+	return sentAt, ok
+}
+
+func main() {
+	var opts options
+	flag.StringVar(&opts.url, "url", "http://localhost:8080", "server URL")
+	flag.IntVar(&opts.sessions, "sessions", 10, "number of sessions")
+	flag.IntVar(&opts.members, "members", 10, "members per session")
+	flag.IntVar(&opts.movers, "movers", -1, "members per session moving cursors, all by default")
+	flag.Float64Var(&opts.rate, "rate", 10, "moves per second of every moving member")
+	flag.IntVar(&opts.tickRate, "tick-rate", 0, "tick rate of sessions, server default when 0")
+	flag.DurationVar(&opts.duration, "duration", 30*time.Second, "how long members move")
+	flag.Parse()
+	if opts.movers < 0 || opts.movers > opts.members {
+		opts.movers = opts.members
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	c := client.New(opts.url)
+
+	before, metricsErr := serverMetrics(ctx, opts.url)
+	if metricsErr != nil {
+		log.Printf("Server metrics unavailable: %s", metricsErr)
+	}
+
+	log.Printf("Creating %d sessions with %d members", opts.sessions, opts.members)
+	var sessions []dto.CreatedSessionDTO
+	var members []*member
+	defer func() {
+		for _, m := range members {
+			_ = m.conn.Close()
+		}
+		for _, session := range sessions {
+			_ = c.CloseSession(context.Background(), session.Id, session.OwnerSecret)
+		}
+	}()
+	for i := 0; i < opts.sessions; i++ {
+		session, err := c.CreateSession(ctx, client.CreateSessionRequest{
+			Name:         fmt.Sprintf("loadtest-%d", i),
+			BaseLocation: "https://loadtest.invalid",
+			Creator:      "loadtest",
+			TickRate:     opts.tickRate,
+		})
+		if err != nil {
+			log.Fatalf("Creating session failed: %s", err)
+		}
+		sessions = append(sessions, session)
+		for j := 0; j < opts.members; j++ {
+			conn, err := c.Connect(ctx, session.Id, session.JoinToken.Token)
+			if err != nil {
+				log.Fatalf("Connecting member failed: %s", err)
+			}
+			_ = conn.Identify(fmt.Sprintf("loadtest-%d-%d", i, j))
+			members = append(members, &member{conn: conn, moving: j < opts.movers})
+		}
+	}
+
+	log.Printf("Moving %d cursors at %.1f/s for %s", opts.sessions*opts.movers, opts.rate, opts.duration)
+	runCtx, cancel := context.WithTimeout(ctx, opts.duration)
+	defer cancel()
+	sent := &moves{sentAt: make(map[moveKey]time.Time)}
+	var disconnected atomic.Int64
+	var wg sync.WaitGroup
+	for _, m := range members {
+		wg.Add(1)
+		go func(m *member) {
+			defer wg.Done()
+			m.receive(runCtx, sent, &disconnected)
+		}(m)
+		if m.moving {
+			wg.Add(1)
+			go func(m *member) {
+				defer wg.Done()
+				m.move(runCtx, opts.rate, sent)
+			}(m)
+		}
+	}
+
+	peak := before
+	ticker := time.NewTicker(time.Second)
+	for done := false; !done; {
+		select {
+		case <-ticker.C:
+			if current, err := serverMetrics(runCtx, opts.url); err == nil {
+				peak.HeapAlloc = max(peak.HeapAlloc, current.HeapAlloc)
+				peak.Resident = max(peak.Resident, current.Resident)
+			}
+		case <-runCtx.Done():
+			done = true
+		}
+	}
+	ticker.Stop()
+	wg.Wait()
+	after, afterErr := serverMetrics(ctx, opts.url)
+	if metricsErr == nil && afterErr != nil {
+		metricsErr = afterErr
+	}
+
+	var total results
+	var moveCount int64
+	for _, m := range members {
+		total.latencies = append(total.latencies, m.results.latencies...)
+		total.received += m.results.received
+		moveCount += m.sent
+	}
+	sort.Slice(total.latencies, func(i, j int) bool {
+		return total.latencies[i] < total.latencies[j]
+	})
+
+	fmt.Printf("sessions:            %d\n", opts.sessions)
+	fmt.Printf("members:             %d (%d moving)\n", opts.sessions*opts.members, opts.sessions*opts.movers)
+	fmt.Printf("moves sent:          %d\n", moveCount)
+	fmt.Printf("updates received:    %d\n", total.received)
+	fmt.Printf("disconnected:        %d\n", disconnected.Load())
+	fmt.Printf("latency p50:         %s\n", percentile(total.latencies, 0.50))
+	fmt.Printf("latency p90:         %s\n", percentile(total.latencies, 0.90))
+	fmt.Printf("latency p99:         %s\n", percentile(total.latencies, 0.99))
+	fmt.Printf("latency max:         %s\n", percentile(total.latencies, 1))
+	if metricsErr == nil {
+		fmt.Printf("frames dropped:      %.0f (server)\n", after.FramesDropped-before.FramesDropped)
+		fmt.Printf("members evicted:     %.0f (server)\n", after.Unresponsive-before.Unresponsive)
+		fmt.Printf("server heap before:  %s\n", megabytes(before.HeapAlloc))
+		fmt.Printf("server heap peak:    %s\n", megabytes(peak.HeapAlloc))
+		fmt.Printf("server memory peak:  %s (resident)\n", megabytes(peak.Resident))
+	}
+}
+
+// move sends positions with random coordinates and records when each was sent.
+func (m *member) move(ctx context.Context, rate float64, sent *moves) {
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / rate))
+	defer ticker.Stop()
+	memberId := m.conn.MemberId()
+	for {
+		select {
+		case <-ticker.C:
+			position := dto.UpdatePositionCmdDTO{
+				X:        rand.Float64(),
+				Y:        rand.Float64(),
+				Selector: selectors[rand.Intn(len(selectors))],
+				Location: "https://loadtest.invalid",
+			}
+			sent.record(moveKey{memberId, position.X})
+			if m.conn.Move(position) == nil {
+				m.sent++
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// receive measures latency of positions of others that changed since the previous snapshot.
+// Moves faster than session tick rate are merged by server, only the latest one arrives.
+func (m *member) receive(ctx context.Context, sent *moves, disconnected *atomic.Int64) {
+	lastX := make(map[int64]float64)
+	self := m.conn.MemberId()
+	for {
+		select {
+		case positions, ok := <-m.conn.Snapshots():
+			if !ok {
+				disconnected.Add(1)
+				return
+			}
+			now := time.Now()
+			for _, position := range positions {
+				if x, seen := lastX[position.MemberId]; position.MemberId == self || (seen && x == position.X) {
+					continue
+				}
+				lastX[position.MemberId] = position.X
+				if sentAt, ok := sent.lookup(moveKey{position.MemberId, position.X}); ok {
+					m.results.received++
+					m.results.latencies = append(m.results.latencies, now.Sub(sentAt))
+				}
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// serverStats are samples of /metrics, counters include sessions that aren't part of the loadtest.
+type serverStats struct {
+	HeapAlloc     float64
+	Resident      float64
+	FramesDropped float64
+	Unresponsive  float64
+}
+
+func serverMetrics(ctx context.Context, url string) (serverStats, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(url, "/")+"/metrics", nil)
+	if err != nil {
+		return serverStats{}, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return serverStats{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return serverStats{}, fmt.Errorf("%s", resp.Status)
+	}
+	var stats serverStats
+	samples := map[string]*float64{
+		"go_memstats_heap_alloc_bytes":               &stats.HeapAlloc,
+		"process_resident_memory_bytes":              &stats.Resident,
+		"browse_together_frames_dropped_total":       &stats.FramesDropped,
+		"browse_together_unresponsive_members_total": &stats.Unresponsive,
+	}
+	// text exposition format, samples without labels are "name value"
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		name, value, ok := strings.Cut(scanner.Text(), " ")
+		if sample, wanted := samples[name]; ok && wanted {
+			*sample, _ = strconv.ParseFloat(value, 64)
+		}
+	}
+	return stats, scanner.Err()
+}
+
+func percentile(latencies []time.Duration, p float64) time.Duration {
+	if len(latencies) == 0 {
+		return 0
+	}
+	i := int(p * float64(len(latencies)-1))
+	return latencies[i].Round(10 * time.Microsecond)
+}
+
+func megabytes(bytes float64) string {
+	return fmt.Sprintf("%.1f MiB", bytes/(1<<20))
+}
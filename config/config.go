@@ -1,12 +1,397 @@
+// Package config loads settings of the server once at startup. Every setting is read,
+// in increasing precedence, from its default, a YAML or TOML file, environment
+// variable and command line flag, e.g. broadcast_tick_rate, BROADCAST_TICK_RATE
+// and -broadcast-tick-rate.
 package config
 
-import "os"
+import (
+	"crypto/rand"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
-var DEBUG = false
+	"github.com/BurntSushi/toml"
+	"github.com/redis/go-redis/v9"
+	"gopkg.in/yaml.v3"
 
-func init() {
-	debug := os.Getenv("DEBUG")
-	if debug == "1" {
-		DEBUG = true
+	"github.com/dwilkolek/browse-together-api/logging"
+)
+
+// Values of STORAGE and QUEUE.
+const (
+	InMemory = "IN_MEMORY"
+	Redis    = "REDIS"
+)
+
+const MaxTickRate = 1000
+
+type Config struct {
+	Port int
+	Env  string
+	// Debug serves /debug/vars and logs at debug level unless LogLevel is set.
+	Debug     bool
+	LogLevel  slog.Level
+	LogFormat string
+
+	// Storage and Queue select InMemory or Redis implementation of session store and event queue.
+	Storage  string
+	Queue    string
+	RedisURL string
+	// RedisPingTimeout bounds each dependency check of /readyz.
+	RedisPingTimeout time.Duration
+
+	// OtelTracesExporter is none or otlp, OTLP exporter reads standard OTEL_EXPORTER_OTLP_* variables.
+	OtelTracesExporter string
+
+	// AuthSecret signs join tokens. It must be shared by all instances, a random one
+	// is generated when missing so tokens don't survive restarts.
+	AuthSecret       []byte
+	RandomAuthSecret bool
+	JoinTokenTTL     time.Duration
+
+	// ShutdownTimeout bounds draining sessions on SIGTERM.
+	ShutdownTimeout time.Duration
+
+	Broadcast Broadcast
+	Session   Session
+}
+
+type Broadcast struct {
+	// TickRate is the default number of broadcasts per second for a session,
+	// sessions can override it at creation time.
+	TickRate int
+	// Adaptive slows down the broadcast loop of sessions where nobody moves,
+	// up to IdleInterval between ticks.
+	Adaptive     bool
+	IdleInterval time.Duration
+}
+
+type Session struct {
+	// MaxLifetime is the default and the upper bound of session lifetime,
+	// IdleTimeout the default time a session without connected members is kept.
+	MaxLifetime time.Duration
+	IdleTimeout time.Duration
+	// JanitorInterval is how often janitor looks for expired and idle sessions.
+	JanitorInterval time.Duration
+}
+
+// Default returns configuration used when nothing is set.
+func Default() Config {
+	return Config{
+		Port:               8080,
+		Env:                "prod",
+		LogLevel:           slog.LevelInfo,
+		LogFormat:          "text",
+		Storage:            InMemory,
+		Queue:              InMemory,
+		RedisURL:           "redis://default:@localhost:6379/0",
+		RedisPingTimeout:   2 * time.Second,
+		OtelTracesExporter: "none",
+		JoinTokenTTL:       24 * time.Hour,
+		ShutdownTimeout:    10 * time.Second,
+		Broadcast: Broadcast{
+			TickRate:     60,
+			Adaptive:     true,
+			IdleInterval: 250 * time.Millisecond,
+		},
+		Session: Session{
+			MaxLifetime:     8 * time.Hour,
+			IdleTimeout:     30 * time.Minute,
+			JanitorInterval: time.Minute,
+		},
+	}
+}
+
+// UsesRedis reports whether store or queue needs a Redis connection.
+func (c Config) UsesRedis() bool {
+	return c.Storage == Redis || c.Queue == Redis
+}
+
+// setting is read from env variable name, file key and flag derived from name.
+type setting struct {
+	name    string
+	usage   string
+	boolean bool
+	set     func(c *Config, value string) error
+}
+
+// settings are applied in order within each source, so LOG_LEVEL overrides level set by DEBUG.
+var settings = []setting{
+	{name: "PORT", usage: "port to listen on", set: func(c *Config, value string) error {
+		return parseInt(value, 1, 65535, &c.Port)
+	}},
+	{name: "ENV", usage: "name of the environment, only logged", set: func(c *Config, value string) error {
+		c.Env = value
+		return nil
+	}},
+	{name: "DEBUG", usage: "serve /debug/vars and log at debug level", boolean: true, set: func(c *Config, value string) error {
+		if err := parseBool(value, &c.Debug); err != nil {
+			return err
+		}
+		if c.Debug {
+			c.LogLevel = slog.LevelDebug
+		}
+		return nil
+	}},
+	{name: "LOG_LEVEL", usage: "debug, info, warn or error", set: func(c *Config, value string) error {
+		level, err := logging.ParseLevel(value)
+		if err != nil {
+			return fmt.Errorf("%q must be debug, info, warn or error", value)
+		}
+		c.LogLevel = level
+		return nil
+	}},
+	{name: "LOG_FORMAT", usage: "text or json", set: func(c *Config, value string) error {
+		return oneOf(value, &c.LogFormat, "text", "json")
+	}},
+	{name: "STORAGE", usage: "session store, IN_MEMORY or REDIS", set: func(c *Config, value string) error {
+		return oneOf(value, &c.Storage, InMemory, Redis)
+	}},
+	{name: "QUEUE", usage: "event queue, IN_MEMORY or REDIS", set: func(c *Config, value string) error {
+		return oneOf(value, &c.Queue, InMemory, Redis)
+	}},
+	{name: "REDIS_URL", usage: "redis connection URL", set: func(c *Config, value string) error {
+		c.RedisURL = value
+		return nil
+	}},
+	{name: "REDIS_PING_TIMEOUT", usage: "timeout of each /readyz check", set: func(c *Config, value string) error {
+		return parseDuration(value, &c.RedisPingTimeout)
+	}},
+	{name: "OTEL_TRACES_EXPORTER", usage: "none or otlp", set: func(c *Config, value string) error {
+		return oneOf(value, &c.OtelTracesExporter, "none", "otlp")
+	}},
+	{name: "AUTH_SECRET", usage: "secret signing join tokens, shared by all instances", set: func(c *Config, value string) error {
+		c.AuthSecret = []byte(value)
+		return nil
+	}},
+	{name: "JOIN_TOKEN_TTL", usage: "default lifetime of join tokens", set: func(c *Config, value string) error {
+		return parseDuration(value, &c.JoinTokenTTL)
+	}},
+	{name: "SHUTDOWN_TIMEOUT", usage: "time to drain sessions on SIGTERM", set: func(c *Config, value string) error {
+		return parseDuration(value, &c.ShutdownTimeout)
+	}},
+	{name: "BROADCAST_TICK_RATE", usage: "default broadcasts per second of a session", set: func(c *Config, value string) error {
+		return parseInt(value, 1, MaxTickRate, &c.Broadcast.TickRate)
+	}},
+	{name: "BROADCAST_ADAPTIVE", usage: "slow down broadcasts of sessions where nobody moves", boolean: true, set: func(c *Config, value string) error {
+		return parseBool(value, &c.Broadcast.Adaptive)
+	}},
+	{name: "BROADCAST_IDLE_INTERVAL", usage: "longest interval between adaptive broadcasts", set: func(c *Config, value string) error {
+		return parseDuration(value, &c.Broadcast.IdleInterval)
+	}},
+	{name: "SESSION_MAX_LIFETIME", usage: "default and maximal session lifetime", set: func(c *Config, value string) error {
+		return parseDuration(value, &c.Session.MaxLifetime)
+	}},
+	{name: "SESSION_IDLE_TIMEOUT", usage: "default time a session without members is kept", set: func(c *Config, value string) error {
+		return parseDuration(value, &c.Session.IdleTimeout)
+	}},
+	{name: "SESSION_JANITOR_INTERVAL", usage: "how often expired and idle sessions are closed", set: func(c *Config, value string) error {
+		return parseDuration(value, &c.Session.JanitorInterval)
+	}},
+}
+
+func (s setting) fileKey() string {
+	return strings.ToLower(s.name)
+}
+
+func (s setting) flagName() string {
+	return strings.ReplaceAll(strings.ToLower(s.name), "_", "-")
+}
+
+// flagValue records value of a flag, flags are applied after file and environment.
+type flagValue struct {
+	setting setting
+	values  *[]assignment
+}
+
+type assignment struct {
+	setting setting
+	value   string
+}
+
+func (f flagValue) String() string   { return "" }
+func (f flagValue) IsBoolFlag() bool { return f.setting.boolean }
+func (f flagValue) Set(value string) error {
+	*f.values = append(*f.values, assignment{f.setting, value})
+	return nil
+}
+
+// Load reads configuration from defaults, file passed with -config or CONFIG_FILE,
+// environment and args, and validates it. All problems are reported at once.
+func Load(args []string) (Config, error) {
+	flags := flag.NewFlagSet("browse-together", flag.ContinueOnError)
+	configFile := flags.String("config", os.Getenv("CONFIG_FILE"), "YAML or TOML configuration file")
+	var flagValues []assignment
+	for _, s := range settings {
+		flags.Var(flagValue{s, &flagValues}, s.flagName(), s.usage)
+	}
+	if err := flags.Parse(args); err != nil {
+		return Config{}, err
+	}
+
+	cfg := Default()
+	var errs []error
+	if *configFile != "" {
+		errs = append(errs, cfg.applyFile(*configFile)...)
+	}
+	for _, s := range settings {
+		if value := os.Getenv(s.name); value != "" {
+			if err := s.set(&cfg, value); err != nil {
+				errs = append(errs, fmt.Errorf("env %s: %w", s.name, err))
+			}
+		}
+	}
+	for _, flagValue := range flagValues {
+		if err := flagValue.setting.set(&cfg, flagValue.value); err != nil {
+			errs = append(errs, fmt.Errorf("flag -%s: %w", flagValue.setting.flagName(), err))
+		}
+	}
+	if err := cfg.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := errors.Join(errs...); err != nil {
+		return Config{}, err
+	}
+
+	if len(cfg.AuthSecret) == 0 {
+		cfg.RandomAuthSecret = true
+		cfg.AuthSecret = make([]byte, 32)
+		if _, err := rand.Read(cfg.AuthSecret); err != nil {
+			return Config{}, err
+		}
+	}
+	return cfg, nil
+}
+
+// applyFile sets values of keys in YAML or TOML file, format is told by extension.
+func (c *Config) applyFile(path string) []error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return []error{fmt.Errorf("config file: %w", err)}
+	}
+	values := map[string]any{}
+	switch ext := filepath.Ext(path); ext {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &values)
+	case ".toml":
+		err = toml.Unmarshal(data, &values)
+	default:
+		err = fmt.Errorf("unsupported format %s, use .yaml, .yml or .toml", ext)
+	}
+	if err != nil {
+		return []error{fmt.Errorf("config file %s: %w", path, err)}
+	}
+
+	var errs []error
+	for _, s := range settings {
+		value, ok := values[s.fileKey()]
+		if !ok {
+			continue
+		}
+		delete(values, s.fileKey())
+		switch value.(type) {
+		case string, bool, int, int64, float64:
+		default:
+			errs = append(errs, fmt.Errorf("config file %s: %s must be a scalar", path, s.fileKey()))
+			continue
+		}
+		if err := s.set(c, fmt.Sprint(value)); err != nil {
+			errs = append(errs, fmt.Errorf("config file %s: %s: %w", path, s.fileKey(), err))
+		}
+	}
+	for key := range values {
+		errs = append(errs, fmt.Errorf("config file %s: unknown key %s", path, key))
+	}
+	return errs
+}
+
+// Validate checks settings depending on each other and values that Load checks when
+// set but embedders may set directly, e.g. a zero JanitorInterval. All problems are reported at once.
+func (c Config) Validate() error {
+	var errs []error
+	if c.Broadcast.TickRate < 1 || c.Broadcast.TickRate > MaxTickRate {
+		errs = append(errs, fmt.Errorf("BROADCAST_TICK_RATE %d must be between 1 and %d", c.Broadcast.TickRate, MaxTickRate))
+	}
+	durations := []struct {
+		name  string
+		value time.Duration
+	}{
+		{"REDIS_PING_TIMEOUT", c.RedisPingTimeout},
+		{"JOIN_TOKEN_TTL", c.JoinTokenTTL},
+		{"SHUTDOWN_TIMEOUT", c.ShutdownTimeout},
+		{"BROADCAST_IDLE_INTERVAL", c.Broadcast.IdleInterval},
+		{"SESSION_MAX_LIFETIME", c.Session.MaxLifetime},
+		{"SESSION_IDLE_TIMEOUT", c.Session.IdleTimeout},
+		{"SESSION_JANITOR_INTERVAL", c.Session.JanitorInterval},
+	}
+	for _, duration := range durations {
+		if duration.value <= 0 {
+			errs = append(errs, fmt.Errorf("%s %s must be a positive duration", duration.name, duration.value))
+		}
+	}
+	if c.UsesRedis() {
+		if _, err := ParseRedisURL(c.RedisURL); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ParseRedisURL returns options of redis client, errors leave out credentials of redisUrl.
+func ParseRedisURL(redisUrl string) (*redis.Options, error) {
+	opt, err := redis.ParseURL(redisUrl)
+	if err != nil {
+		// url.Error repeats the URL, credentials included
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return nil, fmt.Errorf("invalid REDIS_URL: %w", err)
+	}
+	return opt, nil
+}
+
+func parseInt(value string, min int, max int, target *int) error {
+	parsed, err := strconv.Atoi(value)
+	if err != nil || parsed < min || parsed > max {
+		return fmt.Errorf("%q must be a number between %d and %d", value, min, max)
+	}
+	*target = parsed
+	return nil
+}
+
+// parseBool accepts 1 and 0 used by earlier versions besides true and false.
+func parseBool(value string, target *bool) error {
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		return fmt.Errorf("%q must be true or false", value)
+	}
+	*target = parsed
+	return nil
+}
+
+func parseDuration(value string, target *time.Duration) error {
+	parsed, err := time.ParseDuration(value)
+	if err != nil || parsed <= 0 {
+		return fmt.Errorf("%q must be a positive duration, e.g. 30s", value)
+	}
+	*target = parsed
+	return nil
+}
+
+func oneOf(value string, target *string, allowed ...string) error {
+	for _, candidate := range allowed {
+		if value == candidate {
+			*target = value
+			return nil
+		}
 	}
+	return fmt.Errorf("%q must be one of %s", value, strings.Join(allowed, ", "))
 }
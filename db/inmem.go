@@ -1,34 +1,46 @@
 package db
 
 import (
-	"errors"
 	"github.com/google/uuid"
 	"slices"
 	"sync"
+	"time"
 )
 
 type InMemoryStore struct {
 	sessions     []Session
-	rejoinTokens map[string]int64
+	rejoinTokens map[string]rejoinToken
 	lock         sync.Mutex
 }
 
-func (s *InMemoryStore) StoreRejoinToken(memberId int64) string {
+type rejoinToken struct {
+	sessionId string
+	memberId  int64
+	expiresAt time.Time
+}
+
+func (s *InMemoryStore) StoreRejoinToken(sessionId string, memberId int64) string {
 	s.lockMe()
 	defer s.releaseMe()
+	now := time.Now()
+	// every connection issues a token, expired ones are dropped as new are stored
+	for token, issued := range s.rejoinTokens {
+		if now.After(issued.expiresAt) {
+			delete(s.rejoinTokens, token)
+		}
+	}
 	token := uuid.New().String()
-	s.rejoinTokens[token] = memberId
+	s.rejoinTokens[token] = rejoinToken{sessionId: sessionId, memberId: memberId, expiresAt: now.Add(rejoinTokenTTL)}
 	return token
 }
-func (s *InMemoryStore) GetMemberIdForRejoinToken(token string) (int64, error) {
+func (s *InMemoryStore) GetMemberIdForRejoinToken(sessionId string, token string) (int64, error) {
 	s.lockMe()
 	defer s.releaseMe()
-	memberId, ok := s.rejoinTokens[token]
-	if ok {
-		return memberId, nil
-	} else {
-		return 0, errors.New("no such token")
+	issued, ok := s.rejoinTokens[token]
+	if !ok || issued.sessionId != sessionId || time.Now().After(issued.expiresAt) {
+		return 0, ErrUnknownRejoinToken
 	}
+	return issued.memberId, nil
 }
 func (s *InMemoryStore) StoreSession(session Session) error {
 	s.lockMe()
@@ -40,7 +52,27 @@ func (s *InMemoryStore) StoreSession(session Session) error {
 func (s *InMemoryStore) GetSessions() []Session {
 	s.lockMe()
 	defer s.releaseMe()
-	return s.sessions
+	return slices.Clone(s.sessions)
+}
+
+func (s *InMemoryStore) ListSessions(query SessionQuery) (SessionPage, error) {
+	cursor, err := parseCursor(query.Cursor)
+	if err != nil {
+		return SessionPage{}, err
+	}
+	s.lockMe()
+	defer s.releaseMe()
+	sessions := make([]Session, 0)
+	for _, session := range s.sessions {
+		if query.matches(session) && cursor.after(session, query.Descending) {
+			sessions = append(sessions, session)
+		}
+	}
+	slices.SortFunc(sessions, compareSessions)
+	if query.Descending {
+		slices.Reverse(sessions)
+	}
+	return page(sessions, query.Limit), nil
 }
 
 func (s *InMemoryStore) GetSession(id string) (Session, error) {
@@ -52,19 +84,47 @@ func (s *InMemoryStore) GetSession(id string) (Session, error) {
 		}
 	}
 
-	return Session{}, errors.New("session not found")
+	return Session{}, ErrNotFound
+}
+
+func (s *InMemoryStore) UpdateSession(id string, expectedVersion int64, update func(session *Session)) (Session, error) {
+	s.lockMe()
+	defer s.releaseMe()
+	i := slices.IndexFunc(s.sessions, func(s Session) bool {
+		return s.Id == id
+	})
+	if i < 0 {
+		return Session{}, ErrNotFound
+	}
+	session := s.sessions[i]
+	if expectedVersion != 0 && session.Version != expectedVersion {
+		return session, ErrVersionConflict
+	}
+	update(&session)
+	session.Version++
+	session.UpdatedAt = time.Now().Unix()
+	s.sessions[i] = session
+	return session, nil
 }
 
 func (s *InMemoryStore) DeleteSession(id string) error {
 	s.lockMe()
 	defer s.releaseMe()
+	count := len(s.sessions)
 	s.sessions = slices.DeleteFunc(s.sessions, func(s Session) bool {
 		return s.Id == id
 	})
-
+	if len(s.sessions) == count {
+		return ErrNotFound
+	}
 	return nil
 }
 
+// ClaimJanitor always succeeds, in-memory store isn't shared with other instances.
+func (s *InMemoryStore) ClaimJanitor(time.Duration) bool {
+	return true
+}
+
 func (s *InMemoryStore) lockMe() {
 	s.lock.Lock()
 }
@@ -0,0 +1,50 @@
+package db
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/dwilkolek/browse-together-api/config"
+)
+
+func newInMemoryStore(t *testing.T) *InMemoryStore {
+	t.Helper()
+	store, err := Open(config.Default(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store.(*InMemoryStore)
+}
+
+func TestRejoinTokenIsBoundToSession(t *testing.T) {
+	store := newInMemoryStore(t)
+	token := store.StoreRejoinToken("a", 7)
+
+	memberId, err := store.GetMemberIdForRejoinToken("a", token)
+	if err != nil || memberId != 7 {
+		t.Fatalf("member %d, err %v, expected member 7", memberId, err)
+	}
+	if _, err := store.GetMemberIdForRejoinToken("b", token); !errors.Is(err, ErrUnknownRejoinToken) {
+		t.Errorf("token of other session: err %v", err)
+	}
+	if _, err := store.GetMemberIdForRejoinToken("a", "unknown"); !errors.Is(err, ErrUnknownRejoinToken) {
+		t.Errorf("unknown token: err %v", err)
+	}
+}
+
+func TestRejoinTokenExpires(t *testing.T) {
+	store := newInMemoryStore(t)
+	expired := store.StoreRejoinToken("a", 1)
+	issued := store.rejoinTokens[expired]
+	issued.expiresAt = time.Now().Add(-time.Second)
+	store.rejoinTokens[expired] = issued
+
+	if _, err := store.GetMemberIdForRejoinToken("a", expired); !errors.Is(err, ErrUnknownRejoinToken) {
+		t.Errorf("expired token: err %v", err)
+	}
+	store.StoreRejoinToken("a", 2)
+	if _, ok := store.rejoinTokens[expired]; ok {
+		t.Error("expired token wasn't purged")
+	}
+}
@@ -0,0 +1,90 @@
+package db
+
+import (
+	"cmp"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// SessionQuery selects a page of sessions ordered by creation time, ties are broken by id.
+type SessionQuery struct {
+	Creator            string
+	BaseLocationPrefix string
+	Descending         bool
+	// Cursor is NextCursor of the previous page, empty for the first page.
+	Cursor string
+	Limit  int
+}
+
+type SessionPage struct {
+	Sessions []Session
+	// NextCursor is empty on the last page.
+	NextCursor string
+}
+
+func (q SessionQuery) matches(session Session) bool {
+	return (q.Creator == "" || session.Creator == q.Creator) &&
+		strings.HasPrefix(session.BaseLocation, q.BaseLocationPrefix)
+}
+
+// sessionCursor is position of the last session of a page.
+type sessionCursor struct {
+	createdAt int64
+	id        string
+}
+
+func cursorOf(session Session) string {
+	raw := fmt.Sprintf("%d:%s", session.CreatedAt, session.Id)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func parseCursor(cursor string) (*sessionCursor, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	createdAt, id, ok := strings.Cut(string(raw), ":")
+	if !ok {
+		return nil, ErrInvalidCursor
+	}
+	value, err := strconv.ParseInt(createdAt, 10, 64)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	return &sessionCursor{createdAt: value, id: id}, nil
+}
+
+// after reports whether session comes after cursor in query order.
+func (c *sessionCursor) after(session Session, descending bool) bool {
+	if c == nil {
+		return true
+	}
+	if descending {
+		return session.CreatedAt < c.createdAt || (session.CreatedAt == c.createdAt && session.Id < c.id)
+	}
+	return session.CreatedAt > c.createdAt || (session.CreatedAt == c.createdAt && session.Id > c.id)
+}
+
+func compareSessions(a, b Session) int {
+	if c := cmp.Compare(a.CreatedAt, b.CreatedAt); c != 0 {
+		return c
+	}
+	return strings.Compare(a.Id, b.Id)
+}
+
+// page cuts limit sessions off sorted candidates, one extra candidate tells there is a next page.
+func page(sessions []Session, limit int) SessionPage {
+	if len(sessions) <= limit {
+		return SessionPage{Sessions: sessions}
+	}
+	sessions = sessions[:limit]
+	return SessionPage{Sessions: sessions, NextCursor: cursorOf(sessions[limit-1])}
+}
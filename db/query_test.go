@@ -0,0 +1,132 @@
+package db
+
+import (
+	"encoding/base64"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// storeSessions stores sessions in given order.
+func storeSessions(t *testing.T, store Db, sessions ...Session) {
+	t.Helper()
+	for _, session := range sessions {
+		if err := store.StoreSession(session); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// listAll follows cursors until the last page and returns ids of every page.
+func listAll(t *testing.T, store Db, query SessionQuery) [][]string {
+	t.Helper()
+	var pages [][]string
+	for {
+		page, err := store.ListSessions(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, session := range page.Sessions {
+			ids = append(ids, session.Id)
+		}
+		pages = append(pages, ids)
+		if page.NextCursor == "" {
+			return pages
+		}
+		if len(pages) > 10 {
+			t.Fatal("pagination doesn't end")
+		}
+		query.Cursor = page.NextCursor
+	}
+}
+
+func TestListSessionsPaginates(t *testing.T) {
+	store := newInMemoryStore(t)
+	// b and c were created in the same second, order is decided by id
+	storeSessions(t, store,
+		Session{Id: "d", CreatedAt: 3},
+		Session{Id: "c", CreatedAt: 2},
+		Session{Id: "a", CreatedAt: 1},
+		Session{Id: "b", CreatedAt: 2},
+		Session{Id: "e", CreatedAt: 4},
+	)
+
+	tests := []struct {
+		name  string
+		query SessionQuery
+		pages [][]string
+	}{
+		{"ascending", SessionQuery{Limit: 2}, [][]string{{"a", "b"}, {"c", "d"}, {"e"}}},
+		{"descending", SessionQuery{Limit: 2, Descending: true}, [][]string{{"e", "d"}, {"c", "b"}, {"a"}}},
+		{"cursor between ties", SessionQuery{Limit: 3}, [][]string{{"a", "b", "c"}, {"d", "e"}}},
+		{"exact last page", SessionQuery{Limit: 5}, [][]string{{"a", "b", "c", "d", "e"}}},
+		{"larger than result", SessionQuery{Limit: 10, Descending: true}, [][]string{{"e", "d", "c", "b", "a"}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if pages := listAll(t, store, test.query); !reflect.DeepEqual(pages, test.pages) {
+				t.Errorf("pages %v, expected %v", pages, test.pages)
+			}
+		})
+	}
+}
+
+func TestListSessionsFilters(t *testing.T) {
+	store := newInMemoryStore(t)
+	storeSessions(t, store,
+		Session{Id: "a", CreatedAt: 1, Creator: "alice", BaseLocation: "https://example.com/docs"},
+		Session{Id: "b", CreatedAt: 2, Creator: "bob", BaseLocation: "https://example.com/docs/intro"},
+		Session{Id: "c", CreatedAt: 3, Creator: "alice", BaseLocation: "https://example.org"},
+		Session{Id: "d", CreatedAt: 4, Creator: "alice", BaseLocation: "https://example.com/blog"},
+	)
+
+	tests := []struct {
+		name  string
+		query SessionQuery
+		pages [][]string
+	}{
+		{"creator", SessionQuery{Limit: 2, Creator: "alice"}, [][]string{{"a", "c"}, {"d"}}},
+		{"prefix", SessionQuery{Limit: 10, BaseLocationPrefix: "https://example.com/docs"}, [][]string{{"a", "b"}}},
+		{"creator and prefix", SessionQuery{Limit: 1, Creator: "alice", BaseLocationPrefix: "https://example.com"}, [][]string{{"a"}, {"d"}}},
+		{"nothing matches", SessionQuery{Limit: 10, Creator: "carol"}, [][]string{nil}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if pages := listAll(t, store, test.query); !reflect.DeepEqual(pages, test.pages) {
+				t.Errorf("pages %v, expected %v", pages, test.pages)
+			}
+		})
+	}
+}
+
+func TestListSessionsSkipsDeletedCursorSession(t *testing.T) {
+	store := newInMemoryStore(t)
+	storeSessions(t, store, Session{Id: "a", CreatedAt: 1}, Session{Id: "b", CreatedAt: 2}, Session{Id: "c", CreatedAt: 3})
+	first, err := store.ListSessions(SessionQuery{Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.DeleteSession("b"); err != nil {
+		t.Fatal(err)
+	}
+	next, err := store.ListSessions(SessionQuery{Limit: 2, Cursor: first.NextCursor})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(next.Sessions) != 1 || next.Sessions[0].Id != "c" || next.NextCursor != "" {
+		t.Errorf("page %+v, expected only c", next)
+	}
+}
+
+func TestListSessionsRejectsInvalidCursor(t *testing.T) {
+	store := newInMemoryStore(t)
+	encode := func(raw string) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(raw))
+	}
+	for _, cursor := range []string{"not base64!", encode("no separator"), encode("soon:a"), encode(":a")} {
+		if _, err := store.ListSessions(SessionQuery{Limit: 1, Cursor: cursor}); !errors.Is(err, ErrInvalidCursor) {
+			t.Errorf("cursor %q: err %v, expected ErrInvalidCursor", cursor, err)
+		}
+	}
+}
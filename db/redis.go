@@ -3,36 +3,108 @@ package db
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"github.com/google/uuid"
-	"log"
+	"log/slog"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 
-	"github.com/dwilkolek/browse-together-api/clients"
+	"github.com/dwilkolek/browse-together-api/internal/rediskeys"
+	"github.com/dwilkolek/browse-together-api/logging"
 	"github.com/redis/go-redis/v9"
 )
 
 const sessionPrefix = "session-"
 const lockPrefix = "lock-"
 const rejoinPrefix = "rejoin-"
+const janitorKey = "janitor"
+
+// sessionsIndex and creatorIndexPrefix keys are sorted sets of session ids scored
+// by creation time. Entries of sessions dropped by TTL are removed while listing.
+const sessionsIndex = "index-sessions"
+const creatorIndexPrefix = "index-creator-"
+
+// baseLocationIndex is a sorted set of base location and session id pairs with equal
+// scores, sessions with a base location prefix are ranged lexicographically.
+const baseLocationIndex = "index-base-location"
+
+// defaultSessionTTL applies to sessions without expiry.
+const defaultSessionTTL = 8 * time.Hour
 
 type RedisStore struct {
 	*redis.Client
 }
 
-func CreateRedisStore() RedisStore {
-	return RedisStore{
-		clients.CreateRedisClient(),
+func CreateRedisStore(client *redis.Client) RedisStore {
+	store := RedisStore{client}
+	store.reindex()
+	return store
+}
+
+// Ping checks connection, it hides Ping of the embedded client.
+func (s *RedisStore) Ping(ctx context.Context) error {
+	return s.Client.Ping(ctx).Err()
+}
+
+// reindex adds sessions stored before sessionsIndex or baseLocationIndex existed to indexes.
+func (s *RedisStore) reindex() {
+	if exists, err := s.Exists(context.Background(), sessionsIndex, baseLocationIndex).Result(); err != nil || exists == 2 {
+		return
+	}
+	var cursor uint64
+	for {
+		keys, next, err := s.Scan(context.Background(), cursor, sessionPrefix+"*", 0).Result()
+		if err != nil {
+			slog.Error("Failed to scan sessions", logging.Err(err))
+			return
+		}
+		for _, key := range keys {
+			if session, err := s.GetSession(key[len(sessionPrefix):]); err == nil {
+				s.index(s.Client, session)
+			}
+		}
+		if next == 0 {
+			return
+		}
+		cursor = next
+	}
+}
+
+func (s *RedisStore) index(c redis.Cmdable, session Session) {
+	member := redis.Z{Score: float64(session.CreatedAt), Member: session.Id}
+	c.ZAdd(context.Background(), sessionsIndex, member)
+	if session.Creator != "" {
+		c.ZAdd(context.Background(), creatorIndexPrefix+session.Creator, member)
 	}
+	c.ZAdd(context.Background(), baseLocationIndex, redis.Z{Member: baseLocationEntry(session.BaseLocation, session.Id)})
 }
 
-func (s *RedisStore) StoreRejoinToken(memberId int64) string {
+func (s *RedisStore) unindex(c redis.Cmdable, session Session) {
+	c.ZRem(context.Background(), sessionsIndex, session.Id)
+	if session.Creator != "" {
+		c.ZRem(context.Background(), creatorIndexPrefix+session.Creator, session.Id)
+	}
+	c.ZRem(context.Background(), baseLocationIndex, baseLocationEntry(session.BaseLocation, session.Id))
+}
+
+// baseLocationEntry sorts by base location, the id after a zero byte keeps entries unique.
+func baseLocationEntry(baseLocation string, id string) string {
+	return baseLocation + "\x00" + id
+}
+
+// Rejoin tokens are keyed by session too, so they can't be presented in another session.
+func (s *RedisStore) StoreRejoinToken(sessionId string, memberId int64) string {
 	token := uuid.New().String()
-	s.Client.Set(context.Background(), rejoinPrefix+token, memberId, time.Hour).Result()
+	s.Client.Set(context.Background(), rejoinPrefix+sessionId+"-"+token, memberId, rejoinTokenTTL).Result()
 	return token
 }
-func (s *RedisStore) GetMemberIdForRejoinToken(token string) (int64, error) {
-	result, err := s.Client.Get(context.Background(), rejoinPrefix+token).Result()
+func (s *RedisStore) GetMemberIdForRejoinToken(sessionId string, token string) (int64, error) {
+	result, err := s.Client.Get(context.Background(), rejoinPrefix+sessionId+"-"+token).Result()
+	if errors.Is(err, redis.Nil) {
+		return 0, ErrUnknownRejoinToken
+	}
 	if err != nil {
 		return 0, err
 	}
@@ -48,51 +120,173 @@ func (s *RedisStore) StoreSession(session Session) error {
 	defer s.releaseSession(session.Id)
 	jsonStr, _ := json.Marshal(session)
 
-	if _, err := s.Set(context.Background(), sessionPrefix+session.Id, jsonStr, 8*time.Hour).Result(); err != nil {
-		log.Printf("Failed storing session: %s\n", err)
+	if _, err := s.Set(context.Background(), sessionPrefix+session.Id, jsonStr, sessionTTL(session)).Result(); err != nil {
+		slog.Error("Failed storing session", logging.SessionIdKey, session.Id, logging.Err(err))
 		return err
 	}
+	s.index(s.Client, session)
 
-	log.Printf("Stored in redis %s\n", session.Id)
+	slog.Debug("Stored session in redis", logging.SessionIdKey, session.Id)
 	return nil
 }
 
+// sessionTTL lets redis drop the session once it expires, janitor is still
+// needed to close it for connected members.
+func sessionTTL(session Session) time.Duration {
+	if session.ExpiresAt == 0 {
+		return defaultSessionTTL
+	}
+	return max(time.Until(time.Unix(session.ExpiresAt, 0)), time.Second)
+}
+
 func (s *RedisStore) GetSessions() []Session {
-	var keys []string
-	var cursor uint64
+	var sessions []Session
+	query := SessionQuery{Limit: listBatchSize}
 	for {
-
-		var err error
-		keys, cursor, err = s.Client.Scan(context.Background(), cursor, sessionPrefix+"*", 0).Result()
+		page, err := s.ListSessions(query)
 		if err != nil {
-			panic(err)
+			slog.Error("Failed to list sessions", logging.Err(err))
+			return sessions
 		}
-
-		for _, key := range keys {
-			keys = append(keys, key[len(sessionPrefix):])
+		sessions = append(sessions, page.Sessions...)
+		if page.NextCursor == "" {
+			return sessions
 		}
+		query.Cursor = page.NextCursor
+	}
+}
+
+const listBatchSize = 500
+
+func (s *RedisStore) ListSessions(query SessionQuery) (SessionPage, error) {
+	cursor, err := parseCursor(query.Cursor)
+	if err != nil {
+		return SessionPage{}, err
+	}
+	if query.BaseLocationPrefix != "" {
+		return s.listByBaseLocation(query, cursor)
+	}
+	key := sessionsIndex
+	if query.Creator != "" {
+		key = creatorIndexPrefix + query.Creator
+	}
+	args := redis.ZRangeArgs{Key: key, Start: "-inf", Stop: "+inf", ByScore: true, Rev: query.Descending, Count: int64(query.Limit + 1)}
+	if cursor != nil && query.Descending {
+		args.Stop = strconv.FormatInt(cursor.createdAt, 10)
+	} else if cursor != nil {
+		args.Start = strconv.FormatInt(cursor.createdAt, 10)
+	}
 
-		if cursor == 0 { // no more keys
+	sessions := make([]Session, 0, query.Limit+1)
+	var stale []string
+	for len(sessions) <= query.Limit {
+		ids, err := s.ZRangeArgs(context.Background(), args).Result()
+		if err != nil {
+			return SessionPage{}, err
+		}
+		if len(ids) == 0 {
 			break
 		}
+		args.Offset += int64(len(ids))
+
+		found, missing, err := s.getSessions(ids)
+		if err != nil {
+			return SessionPage{}, err
+		}
+		stale = append(stale, missing...)
+		for _, session := range found {
+			if query.matches(session) && cursor.after(session, query.Descending) && len(sessions) <= query.Limit {
+				sessions = append(sessions, session)
+			}
+		}
+	}
+	// removed only now, so offsets stay valid while listing
+	for _, id := range stale {
+		s.ZRem(context.Background(), sessionsIndex, id)
+		s.ZRem(context.Background(), key, id)
 	}
+	return page(sessions, query.Limit), nil
+}
 
-	var sessions = make([]Session, 0)
+// listByBaseLocation ranges baseLocationIndex over the prefix, only matching sessions are
+// read and they are sorted by creation time here.
+func (s *RedisStore) listByBaseLocation(query SessionQuery, cursor *sessionCursor) (SessionPage, error) {
+	entries, err := s.ZRangeArgs(context.Background(), redis.ZRangeArgs{
+		Key:   baseLocationIndex,
+		Start: "[" + query.BaseLocationPrefix,
+		// 0xff never occurs in utf-8, so it sorts after every base location with the prefix
+		Stop:  "(" + query.BaseLocationPrefix + "\xff",
+		ByLex: true,
+	}).Result()
+	if err != nil {
+		return SessionPage{}, err
+	}
+	ids := make([]string, len(entries))
+	entryOf := make(map[string]string, len(entries))
+	for i, entry := range entries {
+		ids[i] = entry[strings.LastIndexByte(entry, 0)+1:]
+		entryOf[ids[i]] = entry
+	}
 
-	for _, sessionId := range keys {
-		if session, err := s.GetSession(sessionId); err == nil {
-			sessions = append(sessions, session)
+	var sessions []Session
+	for start := 0; start < len(ids); start += listBatchSize {
+		found, stale, err := s.getSessions(ids[start:min(start+listBatchSize, len(ids))])
+		if err != nil {
+			return SessionPage{}, err
 		}
+		for _, session := range found {
+			if query.matches(session) && cursor.after(session, query.Descending) {
+				sessions = append(sessions, session)
+			}
+		}
+		for _, id := range stale {
+			s.ZRem(context.Background(), sessionsIndex, id)
+			s.ZRem(context.Background(), baseLocationIndex, entryOf[id])
+		}
+	}
+	slices.SortFunc(sessions, compareSessions)
+	if query.Descending {
+		slices.Reverse(sessions)
 	}
+	return page(sessions[:min(len(sessions), query.Limit+1)], query.Limit), nil
+}
 
-	return sessions
+// getSessions reads sessions with given ids, ids of sessions that are gone, e.g. dropped
+// by TTL, are returned as stale.
+func (s *RedisStore) getSessions(ids []string) ([]Session, []string, error) {
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = sessionPrefix + id
+	}
+	values, err := s.MGet(context.Background(), keys...).Result()
+	if err != nil {
+		return nil, nil, err
+	}
+	sessions := make([]Session, 0, len(values))
+	var stale []string
+	for i, value := range values {
+		raw, ok := value.(string)
+		if !ok {
+			stale = append(stale, ids[i])
+			continue
+		}
+		var session Session
+		if err := json.Unmarshal([]byte(raw), &session); err != nil {
+			continue
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, stale, nil
 }
 
 func (s *RedisStore) GetSession(id string) (Session, error) {
 	var session Session
 	value, err := s.Get(context.Background(), sessionPrefix+id).Result()
+	if errors.Is(err, redis.Nil) {
+		return session, ErrNotFound
+	}
 	if err != nil {
-		log.Printf("No such session %s: %s\n", id, err)
+		slog.Error("Failed to get session", logging.SessionIdKey, id, logging.Err(err))
 		return session, err
 	}
 	err = json.Unmarshal([]byte(value), &session)
@@ -103,19 +297,60 @@ func (s *RedisStore) GetSession(id string) (Session, error) {
 	return session, nil
 }
 
+func (s *RedisStore) UpdateSession(id string, expectedVersion int64, update func(session *Session)) (Session, error) {
+	s.lockSession(id)
+	defer s.releaseSession(id)
+	session, err := s.GetSession(id)
+	if err != nil {
+		return session, err
+	}
+	if expectedVersion != 0 && session.Version != expectedVersion {
+		return session, ErrVersionConflict
+	}
+	previous := session
+	update(&session)
+	session.Version++
+	session.UpdatedAt = time.Now().Unix()
+	jsonStr, _ := json.Marshal(session)
+	if _, err := s.Set(context.Background(), sessionPrefix+session.Id, jsonStr, sessionTTL(session)).Result(); err != nil {
+		slog.Error("Failed updating session", logging.SessionIdKey, session.Id, logging.Err(err))
+		return session, err
+	}
+	if previous.Creator != session.Creator || previous.BaseLocation != session.BaseLocation {
+		s.unindex(s.Client, previous)
+		s.index(s.Client, session)
+	}
+	return session, nil
+}
+
 func (s *RedisStore) DeleteSession(id string) error {
 	s.lockSession(id)
 	defer s.releaseSession(id)
-	if _, err := s.Del(context.TODO(), sessionPrefix+id).Result(); err != nil {
-		log.Printf("Failed to remove session %s\n", id)
+	session, err := s.GetSession(id)
+	if err != nil {
+		return err
+	}
+	s.unindex(s.Client, session)
+	// snapshot and roster are kept by Redis queues, the keys are missing with QUEUE=IN_MEMORY
+	keys := append([]string{sessionPrefix + id}, rediskeys.Session(id)...)
+	if _, err := s.Del(context.TODO(), keys...).Result(); err != nil {
+		slog.Error("Failed to remove session", logging.SessionIdKey, id, logging.Err(err))
 		return err
 	}
 
 	return nil
 }
 
+func (s *RedisStore) ClaimJanitor(ttl time.Duration) bool {
+	claimed, err := s.SetNX(context.Background(), janitorKey, time.Now().UnixMilli(), ttl).Result()
+	if err != nil {
+		slog.Error("Failed to claim janitor", logging.Err(err))
+	}
+	return claimed
+}
+
 func (s *RedisStore) lockSession(id string) {
-	log.Printf("Locking %s\n", id)
+	slog.Debug("Locking session", logging.SessionIdKey, id)
 	for {
 		res, _ := s.SetNX(context.Background(), lockPrefix+id, true, time.Minute).Result()
 		if res {
@@ -126,6 +361,6 @@ func (s *RedisStore) lockSession(id string) {
 }
 
 func (s *RedisStore) releaseSession(id string) {
-	log.Printf("Releasing lock: %s\n", id)
+	slog.Debug("Releasing session lock", logging.SessionIdKey, id)
 	s.Del(context.Background(), lockPrefix+id)
 }
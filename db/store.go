@@ -1,17 +1,43 @@
 package db
 
 import (
-	"os"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/dwilkolek/browse-together-api/config"
 )
 
+var ErrNotFound = errors.New("session not found")
+var ErrVersionConflict = errors.New("session was modified concurrently")
+
+// ErrUnknownRejoinToken is returned for rejoin tokens that expired or were issued in another session.
+var ErrUnknownRejoinToken = errors.New("unknown rejoin token")
+
+// rejoinTokenTTL is how long member can reconnect with its rejoin token.
+const rejoinTokenTTL = time.Hour
+
 type Db interface {
 	StoreSession(session Session) error
 	GetSessions() []Session
+	ListSessions(query SessionQuery) (SessionPage, error)
 	GetSession(id string) (Session, error)
+	// DeleteSession returns ErrNotFound if there was no such session.
 	DeleteSession(id string) error
-	StoreRejoinToken(memberId int64) string
-	GetMemberIdForRejoinToken(token string) (int64, error)
+	// UpdateSession applies update to stored session if its version is still expectedVersion,
+	// 0 skips the check. It returns the stored session with incremented version.
+	UpdateSession(id string, expectedVersion int64, update func(session *Session)) (Session, error)
+	// StoreRejoinToken issues token that lets member reconnect to the session with the same id.
+	StoreRejoinToken(sessionId string, memberId int64) string
+	// GetMemberIdForRejoinToken returns ErrUnknownRejoinToken unless token was issued in the session.
+	GetMemberIdForRejoinToken(sessionId string, token string) (int64, error)
+	// ClaimJanitor reports whether this instance runs janitor, only one instance sharing
+	// the store gets the claim until ttl passes.
+	ClaimJanitor(ttl time.Duration) bool
 }
 
 type Session struct {
@@ -19,38 +45,34 @@ type Session struct {
 	Name         string `json:"name"`
 	Creator      string `json:"creator"`
 	BaseLocation string `json:"baseLocation"`
+	TickRate     int    `json:"tickRate,omitempty"`
+	// OwnerSecretHash authorizes destructive operations, the secret itself is only known to creator.
+	OwnerSecretHash string `json:"ownerSecretHash,omitempty"`
+	// CreatedAt and ExpiresAt are unix seconds, sessions stored before they were introduced have zeros.
+	CreatedAt          int64    `json:"createdAt,omitempty"`
+	ExpiresAt          int64    `json:"expiresAt,omitempty"`
+	IdleTimeoutSeconds int      `json:"idleTimeoutSeconds,omitempty"`
+	Version            int64    `json:"version,omitempty"`
+	UpdatedAt          int64    `json:"updatedAt,omitempty"`
+	Tags               []string `json:"tags,omitempty"`
+	// MaxMembers limits members connected at once, 0 means unlimited.
+	MaxMembers int `json:"maxMembers,omitempty"`
+	// Attributes is an arbitrary JSON object provided by creator.
+	Attributes json.RawMessage `json:"attributes,omitempty"`
 }
 
-var lock sync.Mutex
-var db Db
-
-func GetDb() Db {
-	if db == nil {
-		lock.Lock()
-		defer lock.Unlock()
-		if db == nil {
-			mode := os.Getenv("STORAGE")
-			if mode == "" {
-				mode = "IN_MEMORY"
-			}
-
-			if mode == "IN_MEMORY" {
-				db = &InMemoryStore{
-					sessions:     []Session{},
-					lock:         sync.Mutex{},
-					rejoinTokens: make(map[string]int64),
-				}
-			}
-
-			if mode == "REDIS" {
-				store := CreateRedisStore()
-				db = &store
-			}
-			if db == nil {
-				panic("No storage configured")
-			}
-
-		}
+// Open creates store selected by cfg.Storage, redisClient is only used by Redis store.
+func Open(cfg config.Config, redisClient *redis.Client) (Db, error) {
+	switch cfg.Storage {
+	case config.InMemory:
+		return &InMemoryStore{
+			sessions:     []Session{},
+			lock:         sync.Mutex{},
+			rejoinTokens: make(map[string]rejoinToken),
+		}, nil
+	case config.Redis:
+		store := CreateRedisStore(redisClient)
+		return &store, nil
 	}
-	return db
+	return nil, fmt.Errorf("unknown STORAGE %s", cfg.Storage)
 }
@@ -1,11 +1,61 @@
 package dto
 
+import "encoding/json"
+
 type SessionDTO struct {
 	Id                string `json:"id"`
 	JoinUrl           string `json:"joinUrl"`
 	Name              string `json:"name"`
 	BaseUrl           string `json:"baseUrl"`
 	CreatorIdentifier string `json:"creatorIdentifier"`
+	TickRate          int    `json:"tickRate"`
+	// ExpiresAt is unix seconds, 0 for sessions without expiry.
+	ExpiresAt          int64 `json:"expiresAt"`
+	IdleTimeoutSeconds int   `json:"idleTimeoutSeconds"`
+	// Version changes with every update, it's also sent as ETag.
+	Version int64 `json:"version"`
+	// MemberCount is the number of currently connected members.
+	MemberCount int `json:"memberCount"`
+	// CreatedAt and UpdatedAt are unix seconds.
+	CreatedAt  int64           `json:"createdAt"`
+	UpdatedAt  int64           `json:"updatedAt"`
+	Tags       []string        `json:"tags"`
+	MaxMembers int             `json:"maxMembers,omitempty"`
+	Attributes json.RawMessage `json:"attributes,omitempty"`
+}
+
+// CreatedSessionDTO is returned only to session creator, it's the only time owner secret is revealed.
+type CreatedSessionDTO struct {
+	SessionDTO
+	OwnerSecret string       `json:"ownerSecret"`
+	HostToken   JoinTokenDTO `json:"hostToken"`
+	JoinToken   JoinTokenDTO `json:"joinToken"`
+}
+
+// ProblemDTO describes failed REST call, see RFC 7807.
+type ProblemDTO struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+	// InvalidParams lists every invalid field of rejected request body or query.
+	InvalidParams []InvalidParamDTO `json:"invalidParams,omitempty"`
+}
+
+type InvalidParamDTO struct {
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+}
+
+type JoinSessionDTO struct {
+	JoinUrl string `json:"joinUrl"`
+}
+
+type JoinTokenDTO struct {
+	Token     string `json:"token"`
+	Role      string `json:"role"`
+	ExpiresAt int64  `json:"expiresAt"`
 }
 
 type UpdatePositionCmdDTO struct {
@@ -24,3 +74,115 @@ type PositionStateDTO struct {
 	Location        string  `json:"location"`
 	UpdatedAt       int64   `json:"updatedAt"`
 }
+
+type PositionDeltaDTO struct {
+	Added   []PositionStateDTO `json:"added"`
+	Moved   []PositionStateDTO `json:"moved"`
+	Removed []int64            `json:"removed"`
+}
+
+const (
+	MemberConnected    = "connected"
+	MemberDisconnected = "disconnected"
+)
+
+type MemberDTO struct {
+	MemberId        int64  `json:"memberId"`
+	GivenIdentifier string `json:"givenIdentifier"`
+	Role            string `json:"role"`
+	JoinedAt        int64  `json:"joinedAt"`
+	LastActivityAt  int64  `json:"lastActivityAt"`
+	State           string `json:"state"`
+}
+
+const (
+	PresenceJoined  = "joined"
+	PresenceLeft    = "left"
+	PresenceRenamed = "renamed"
+)
+
+type PresenceEventDTO struct {
+	Type   string    `json:"type"`
+	Member MemberDTO `json:"member"`
+}
+
+// ProtocolVersion of the message envelope, clients send it in every message.
+const ProtocolVersion = 1
+
+const (
+	MessageHello    = "hello"
+	MessageIdentify = "identify"
+	MessagePosition = "position"
+	MessageSnapshot = "snapshot"
+	MessageDelta    = "delta"
+	MessagePresence = "presence"
+	MessageError    = "error"
+	MessageClose    = "close"
+	// MessageSessionUpdated carries dto.SessionDTO after session was changed.
+	MessageSessionUpdated = "session-updated"
+)
+
+// EnvelopeDTO wraps every message of the JSON WebSocket protocol.
+type EnvelopeDTO struct {
+	Type    string          `json:"type"`
+	V       int             `json:"v"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+type HelloDTO struct {
+	MemberId    int64  `json:"memberId"`
+	RejoinToken string `json:"rejoinToken"`
+	Role        string `json:"role"`
+	// Members lists other members connected when member joined, later changes come as presence events.
+	Members []MemberDTO `json:"members"`
+}
+
+type IdentifyCmdDTO struct {
+	Identifier string `json:"identifier"`
+}
+
+const (
+	ErrorMalformedMessage   = "malformed_message"
+	ErrorUnsupportedVersion = "unsupported_version"
+	ErrorUnknownType        = "unknown_type"
+	ErrorInvalidPayload     = "invalid_payload"
+	ErrorForbidden          = "forbidden"
+)
+
+type ErrorDTO struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+const (
+	CloseSessionClosed = "session_closed"
+	CloseKicked        = "kicked"
+	CloseSlowConsumer  = "slow_consumer"
+	// CloseReconnect asks client to reconnect, possibly to another instance, with given rejoin token.
+	CloseReconnect = "reconnect"
+	// CloseSessionFull is sent instead of hello when session reached its capacity.
+	CloseSessionFull = "session_full"
+)
+
+// CloseDTO is the last message before server closes the connection.
+type CloseDTO struct {
+	Reason      string `json:"reason"`
+	RejoinToken string `json:"rejoinToken,omitempty"`
+}
+
+const (
+	HealthOk          = "ok"
+	HealthUnavailable = "unavailable"
+)
+
+// HealthDTO is returned by /livez and /readyz, Checks lists dependencies by name.
+type HealthDTO struct {
+	Status string                    `json:"status"`
+	Checks map[string]HealthCheckDTO `json:"checks"`
+}
+
+type HealthCheckDTO struct {
+	Status     string `json:"status"`
+	Error      string `json:"error,omitempty"`
+	DurationMs int64  `json:"durationMs"`
+}
@@ -0,0 +1,94 @@
+package apidoc
+
+// Channel describes a WebSocket endpoint.
+type Channel struct {
+	// Path in Fiber syntax, e.g. /ws/:sessionId/cursors, path params are strings.
+	Path        string
+	Description string
+	Query       []Param
+	// Receive lists messages sent by server, Send messages sent by clients.
+	Receive []Message
+	Send    []Message
+}
+
+type Message struct {
+	Name    string
+	Summary string
+	// Payload is a schema built with Schemas of the document.
+	Payload map[string]any
+}
+
+type AsyncAPI struct {
+	Info     Info
+	Schemas  *Schemas
+	Channels []Channel
+}
+
+// Documents reports whether WebSocket route registered in Fiber is described.
+func (d AsyncAPI) Documents(path string) bool {
+	for _, channel := range d.Channels {
+		if normalizePath(channel.Path) == normalizePath(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// Document renders AsyncAPI 2.6 document.
+func (d AsyncAPI) Document() map[string]any {
+	channels := make(map[string]any)
+	messages := make(map[string]any)
+	for _, channel := range d.Channels {
+		parameters := make(map[string]any)
+		for _, match := range pathParam.FindAllStringSubmatch(channel.Path, -1) {
+			parameters[match[1]] = map[string]any{"schema": map[string]any{"type": "string"}}
+		}
+		query := map[string]any{"type": "object", "properties": map[string]any{}}
+		for _, param := range channel.Query {
+			schema := d.Schemas.Of(param.Schema)
+			schema["description"] = param.Description
+			query["properties"].(map[string]any)[param.Name] = schema
+		}
+
+		rendered := map[string]any{
+			"description": channel.Description,
+			"parameters":  parameters,
+			"bindings":    map[string]any{"ws": map[string]any{"query": query}},
+		}
+		if len(channel.Receive) > 0 {
+			rendered["subscribe"] = map[string]any{"message": map[string]any{"oneOf": messageRefs(messages, channel.Receive)}}
+		}
+		if len(channel.Send) > 0 {
+			rendered["publish"] = map[string]any{"message": map[string]any{"oneOf": messageRefs(messages, channel.Send)}}
+		}
+		channels[pathParam.ReplaceAllString(channel.Path, "{$1}")] = rendered
+	}
+
+	return map[string]any{
+		"asyncapi": "2.6.0",
+		"info": map[string]any{
+			"title":       d.Info.Title,
+			"version":     d.Info.Version,
+			"description": d.Info.Description,
+		},
+		"defaultContentType": "application/json",
+		"channels":           channels,
+		"components": map[string]any{
+			"messages": messages,
+			"schemas":  d.Schemas.Components(),
+		},
+	}
+}
+
+func messageRefs(messages map[string]any, list []Message) []any {
+	refs := make([]any, len(list))
+	for i, message := range list {
+		messages[message.Name] = map[string]any{
+			"name":    message.Name,
+			"summary": message.Summary,
+			"payload": message.Payload,
+		}
+		refs[i] = map[string]any{"$ref": "#/components/messages/" + message.Name}
+	}
+	return refs
+}
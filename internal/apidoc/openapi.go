@@ -0,0 +1,191 @@
+package apidoc
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type Info struct {
+	Title       string
+	Version     string
+	Description string
+}
+
+// Operation describes one REST endpoint. Go values given as Body, Param.Schema and
+// Response.Body are only used for their types.
+type Operation struct {
+	Method string
+	// Path in Fiber syntax, e.g. /api/v1/sessions/:id, path params are strings.
+	Path    string
+	Summary string
+	// Security lists alternative security schemes, any of them authorizes the call.
+	Security     []string
+	Query        []Param
+	Headers      []Param
+	Body         any
+	BodyRequired []string
+	Responses    []Response
+}
+
+type Param struct {
+	Name        string
+	Description string
+	Schema      any
+}
+
+type Response struct {
+	Status      int
+	Description string
+	Body        any
+	Headers     []string
+}
+
+type OpenAPI struct {
+	Info    Info
+	Schemas *Schemas
+	// SecuritySchemes maps names used in Operation.Security to descriptions, all are bearer tokens.
+	SecuritySchemes map[string]string
+	// Problem is the body of every error response.
+	Problem    any
+	Operations []Operation
+}
+
+var pathParam = regexp.MustCompile(`:(\w+)`)
+
+// Documents reports whether route registered in Fiber is described.
+func (d OpenAPI) Documents(method string, path string) bool {
+	for _, op := range d.Operations {
+		if op.Method == method && normalizePath(op.Path) == normalizePath(path) {
+			return true
+		}
+	}
+	return false
+}
+
+func normalizePath(path string) string {
+	if len(path) > 1 {
+		return strings.TrimSuffix(path, "/")
+	}
+	return path
+}
+
+// Document renders OpenAPI 3.0 document.
+func (d OpenAPI) Document() map[string]any {
+	schemas := d.Schemas
+	problem := map[string]any{
+		"description": "Problem details, see RFC 7807",
+		"content": map[string]any{
+			"application/problem+json": map[string]any{"schema": schemas.Of(d.Problem)},
+		},
+	}
+
+	paths := make(map[string]any)
+	for _, op := range d.Operations {
+		path := pathParam.ReplaceAllString(normalizePath(op.Path), "{$1}")
+		item, ok := paths[path].(map[string]any)
+		if !ok {
+			item = make(map[string]any)
+			paths[path] = item
+		}
+		item[strings.ToLower(op.Method)] = d.operation(schemas, op, problem)
+	}
+
+	securitySchemes := make(map[string]any)
+	for name, description := range d.SecuritySchemes {
+		securitySchemes[name] = map[string]any{"type": "http", "scheme": "bearer", "description": description}
+	}
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":       d.Info.Title,
+			"version":     d.Info.Version,
+			"description": d.Info.Description,
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas":         schemas.Components(),
+			"securitySchemes": securitySchemes,
+		},
+	}
+}
+
+func (d OpenAPI) operation(schemas *Schemas, op Operation, problem map[string]any) map[string]any {
+	var parameters []any
+	for _, match := range pathParam.FindAllStringSubmatch(op.Path, -1) {
+		parameters = append(parameters, map[string]any{
+			"name": match[1], "in": "path", "required": true, "schema": map[string]any{"type": "string"},
+		})
+	}
+	for _, param := range op.Query {
+		parameters = append(parameters, parameter(schemas, param, "query"))
+	}
+	for _, param := range op.Headers {
+		parameters = append(parameters, parameter(schemas, param, "header"))
+	}
+
+	responses := map[string]any{"default": problem}
+	for _, response := range op.Responses {
+		rendered := map[string]any{"description": response.Description}
+		if response.Body != nil {
+			rendered["content"] = map[string]any{
+				"application/json": map[string]any{"schema": schemas.Of(response.Body)},
+			}
+		}
+		if len(response.Headers) > 0 {
+			headers := make(map[string]any)
+			for _, header := range response.Headers {
+				headers[header] = map[string]any{"schema": map[string]any{"type": "string"}}
+			}
+			rendered["headers"] = headers
+		}
+		responses[strconv.Itoa(response.Status)] = rendered
+	}
+
+	rendered := map[string]any{
+		"summary":     op.Summary,
+		"operationId": operationId(op),
+		"responses":   responses,
+	}
+	if len(parameters) > 0 {
+		rendered["parameters"] = parameters
+	}
+	if op.Body != nil {
+		rendered["requestBody"] = map[string]any{
+			"content": map[string]any{
+				"application/json": map[string]any{"schema": schemas.OfRequest(op.Body, op.BodyRequired...)},
+			},
+		}
+	}
+	if len(op.Security) > 0 {
+		var security []any
+		for _, scheme := range op.Security {
+			security = append(security, map[string]any{scheme: []string{}})
+		}
+		rendered["security"] = security
+	}
+	return rendered
+}
+
+func parameter(schemas *Schemas, param Param, in string) map[string]any {
+	return map[string]any{
+		"name":        param.Name,
+		"in":          in,
+		"description": param.Description,
+		"schema":      schemas.Of(param.Schema),
+	}
+}
+
+// operationId is derived from method and path, e.g. patchSessionsIdMembersMemberId.
+func operationId(op Operation) string {
+	id := strings.ToLower(op.Method)
+	for _, segment := range strings.Split(op.Path, "/") {
+		segment = strings.TrimPrefix(segment, ":")
+		if segment == "" || segment == "api" || segment == "v1" {
+			continue
+		}
+		id += strings.ToUpper(segment[:1]) + segment[1:]
+	}
+	return id
+}
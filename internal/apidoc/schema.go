@@ -0,0 +1,136 @@
+// Package apidoc builds OpenAPI and AsyncAPI documents whose schemas are derived
+// from Go types, so documented payloads can't drift from what handlers send.
+package apidoc
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+)
+
+var rawMessageType = reflect.TypeOf(json.RawMessage{})
+
+// Schemas derives JSON schemas from json tags of Go types. Named structs become
+// components referenced with $ref, fields without omitempty are required.
+type Schemas struct {
+	refPrefix  string
+	components map[string]any
+	enums      map[reflect.Type][]string
+}
+
+func NewSchemas(refPrefix string) *Schemas {
+	return &Schemas{
+		refPrefix:  refPrefix,
+		components: make(map[string]any),
+		enums:      make(map[reflect.Type][]string),
+	}
+}
+
+// Enum restricts values of type of v, e.g. a named string type.
+func (s *Schemas) Enum(v any, values ...string) {
+	s.enums[reflect.TypeOf(v)] = values
+}
+
+// Of returns schema of v's type.
+func (s *Schemas) Of(v any) map[string]any {
+	return s.schema(reflect.TypeOf(v))
+}
+
+// OfRequest returns schema of a request body type, only fields listed in required
+// are required regardless of omitempty, handlers fall back to defaults for others.
+func (s *Schemas) OfRequest(v any, required ...string) map[string]any {
+	t := reflect.TypeOf(v)
+	if _, ok := s.components[t.Name()]; !ok {
+		schema := s.object(t)
+		delete(schema, "required")
+		if len(required) > 0 {
+			schema["required"] = required
+		}
+		s.components[t.Name()] = schema
+	}
+	return s.ref(t.Name())
+}
+
+// Components returns all named schemas referenced so far.
+func (s *Schemas) Components() map[string]any {
+	return s.components
+}
+
+func (s *Schemas) ref(name string) map[string]any {
+	return map[string]any{"$ref": s.refPrefix + name}
+}
+
+func (s *Schemas) schema(t reflect.Type) map[string]any {
+	if values, ok := s.enums[t]; ok {
+		return map[string]any{"type": "string", "enum": values}
+	}
+	if t == rawMessageType {
+		// any JSON value
+		return map[string]any{}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		return s.schema(t.Elem())
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int64, reflect.Uint64:
+		return map[string]any{"type": "integer", "format": "int64"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string", "format": "byte"}
+		}
+		return map[string]any{"type": "array", "items": s.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": s.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return s.object(t)
+		}
+		if _, ok := s.components[t.Name()]; !ok {
+			// placeholder stops recursion of self referencing types
+			s.components[t.Name()] = map[string]any{}
+			s.components[t.Name()] = s.object(t)
+		}
+		return s.ref(t.Name())
+	}
+	return map[string]any{}
+}
+
+func (s *Schemas) object(t reflect.Type) map[string]any {
+	properties := make(map[string]any)
+	var required []string
+	s.addFields(t, properties, &required)
+	schema := map[string]any{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+func (s *Schemas) addFields(t reflect.Type, properties map[string]any, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, options, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if field.Anonymous && name == "" {
+			s.addFields(field.Type, properties, required)
+			continue
+		}
+		if !field.IsExported() || name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = s.schema(field.Type)
+		if !strings.Contains(options, "omitempty") && field.Type.Kind() != reflect.Pointer {
+			*required = append(*required, name)
+		}
+	}
+}
@@ -0,0 +1,26 @@
+// Package rediskeys names keys Redis queues keep for a session, the store deletes
+// them together with the session without depending on queues.
+package rediskeys
+
+const (
+	SnapshotPrefix     = "snapshot-"
+	MemberIdPrefix     = "memberId-"
+	RolesPrefix        = "roles-"
+	MembersPrefix      = "members-"
+	ActivityPrefix     = "activity-"
+	LastActivityPrefix = "lastActivity-"
+	InstancesPrefix    = "instances-"
+)
+
+// Session returns keys Redis queues keep for the session, to be deleted with it.
+func Session(sessionId string) []string {
+	return []string{
+		SnapshotPrefix + sessionId,
+		MemberIdPrefix + sessionId,
+		RolesPrefix + sessionId,
+		MembersPrefix + sessionId,
+		ActivityPrefix + sessionId,
+		LastActivityPrefix + sessionId,
+		InstancesPrefix + sessionId,
+	}
+}
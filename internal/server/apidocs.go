@@ -0,0 +1,199 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/dwilkolek/browse-together-api/auth"
+	"github.com/dwilkolek/browse-together-api/dto"
+	"github.com/dwilkolek/browse-together-api/internal/apidoc"
+)
+
+const openApiPath = "/api/v1/openapi.json"
+const asyncApiPath = "/api/v1/asyncapi.json"
+
+var apiInfo = apidoc.Info{
+	Title:   "Browse Together",
+	Version: "1",
+	Description: "Sessions share cursors of their members. Create a session with the REST API " +
+		"and connect members to its cursors socket.",
+}
+
+var (
+	ownerOrHost = []string{"ownerSecret", "hostToken"}
+	anyMember   = []string{"joinToken"}
+)
+
+func newSchemas(refPrefix string) *apidoc.Schemas {
+	schemas := apidoc.NewSchemas(refPrefix)
+	schemas.Enum(auth.Role(""), string(auth.RoleHost), string(auth.RolePresenter), string(auth.RoleViewer))
+	return schemas
+}
+
+// openApi describes every route registered under /api, apidocs_test.go makes sure of that.
+func openApi() apidoc.OpenAPI {
+	return apidoc.OpenAPI{
+		Info:    apiInfo,
+		Schemas: newSchemas("#/components/schemas/"),
+		SecuritySchemes: map[string]string{
+			"ownerSecret": "Owner secret returned when session was created",
+			"hostToken":   "Join token with host role",
+			"joinToken":   "Join token of any role, also accepted as token query param",
+		},
+		Problem: dto.ProblemDTO{},
+		Operations: []apidoc.Operation{
+			{
+				Method:       fiber.MethodPost,
+				Path:         "/api/v1/sessions",
+				Summary:      "Create session, the only response revealing owner secret",
+				Body:         CreateSessionV1Cmd{},
+				BodyRequired: []string{"name", "baseLocation"},
+				Responses:    []apidoc.Response{{Status: fiber.StatusOK, Description: "Created session", Body: dto.CreatedSessionDTO{}}},
+			},
+			{
+				Method:  fiber.MethodGet,
+				Path:    "/api/v1/sessions",
+				Summary: "List sessions",
+				Query: []apidoc.Param{
+					{Name: "creator", Description: "Only sessions of given creator", Schema: ""},
+					{Name: "baseLocationPrefix", Description: "Only sessions whose base location starts with prefix", Schema: ""},
+					{Name: "sort", Description: "-createdAt (default) or createdAt", Schema: ""},
+					{Name: "limit", Description: fmt.Sprintf("Page size, %d by default, at most %d", defaultPageSize, maxPageSize), Schema: 0},
+					{Name: "cursor", Description: "Cursor of the next page from Link header", Schema: ""},
+				},
+				Responses: []apidoc.Response{{Status: fiber.StatusOK, Description: "Page of sessions", Body: []dto.SessionDTO{}, Headers: []string{fiber.HeaderLink}}},
+			},
+			{
+				Method:    fiber.MethodGet,
+				Path:      "/api/v1/sessions/:id",
+				Summary:   "Get session",
+				Responses: []apidoc.Response{{Status: fiber.StatusOK, Description: "Session", Body: dto.SessionDTO{}, Headers: []string{fiber.HeaderETag}}},
+			},
+			{
+				Method:    fiber.MethodPatch,
+				Path:      "/api/v1/sessions/:id",
+				Summary:   "Update session, members get session-updated message",
+				Security:  ownerOrHost,
+				Headers:   []apidoc.Param{{Name: fiber.HeaderIfMatch, Description: "ETag of the session the update is based on", Schema: ""}},
+				Body:      UpdateSessionV1Cmd{},
+				Responses: []apidoc.Response{{Status: fiber.StatusOK, Description: "Updated session", Body: dto.SessionDTO{}, Headers: []string{fiber.HeaderETag}}},
+			},
+			{
+				Method:    fiber.MethodDelete,
+				Path:      "/api/v1/sessions/:id",
+				Summary:   "Close session",
+				Security:  ownerOrHost,
+				Responses: []apidoc.Response{{Status: fiber.StatusNoContent, Description: "Session closed"}},
+			},
+			{
+				Method:    fiber.MethodPost,
+				Path:      "/api/v1/sessions/:id/tokens",
+				Summary:   "Issue join token",
+				Security:  []string{"ownerSecret"},
+				Body:      CreateJoinTokenV1Cmd{},
+				Responses: []apidoc.Response{{Status: fiber.StatusOK, Description: "Join token", Body: dto.JoinTokenDTO{}}},
+			},
+			{
+				Method:    fiber.MethodGet,
+				Path:      "/api/v1/sessions/:id/members",
+				Summary:   "List members",
+				Security:  anyMember,
+				Responses: []apidoc.Response{{Status: fiber.StatusOK, Description: "Members", Body: []dto.MemberDTO{}}},
+			},
+			{
+				Method:       fiber.MethodPatch,
+				Path:         "/api/v1/sessions/:id/members/:memberId",
+				Summary:      "Change role of member",
+				Security:     ownerOrHost,
+				Body:         UpdateMemberV1Cmd{},
+				BodyRequired: []string{"role"},
+				Responses:    []apidoc.Response{{Status: fiber.StatusNoContent, Description: "Role changed"}},
+			},
+			{
+				Method:    fiber.MethodDelete,
+				Path:      "/api/v1/sessions/:id/members/:memberId",
+				Summary:   "Kick member",
+				Security:  ownerOrHost,
+				Responses: []apidoc.Response{{Status: fiber.StatusNoContent, Description: "Member disconnected"}},
+			},
+			{
+				Method:    fiber.MethodPost,
+				Path:      "/api/v1/sessions/:id/join",
+				Summary:   "Get URL of cursors socket",
+				Security:  anyMember,
+				Responses: []apidoc.Response{{Status: fiber.StatusOK, Description: "Socket URL", Body: dto.JoinSessionDTO{}}},
+			},
+			{
+				Method:    fiber.MethodGet,
+				Path:      openApiPath,
+				Summary:   "This document",
+				Responses: []apidoc.Response{{Status: fiber.StatusOK, Description: "OpenAPI document"}},
+			},
+			{
+				Method:    fiber.MethodGet,
+				Path:      asyncApiPath,
+				Summary:   "AsyncAPI document of cursors socket",
+				Responses: []apidoc.Response{{Status: fiber.StatusOK, Description: "AsyncAPI document"}},
+			},
+		},
+	}
+}
+
+// asyncApi describes the JSON subprotocol of cursors socket.
+func asyncApi() apidoc.AsyncAPI {
+	schemas := newSchemas("#/components/schemas/")
+	message := func(messageType string, summary string, payload any) apidoc.Message {
+		return apidoc.Message{Name: messageType, Summary: summary, Payload: envelope(schemas, messageType, payload)}
+	}
+	return apidoc.AsyncAPI{
+		Info:    apiInfo,
+		Schemas: schemas,
+		Channels: []apidoc.Channel{{
+			Path: "/ws/:sessionId/cursors",
+			Description: "Cursors of session members. Messages below are sent with browse-together.v1.json subprotocol, " +
+				"browse-together.v1.binary carries the same messages in binary frames described in protocol/binary.go.",
+			Query: []apidoc.Param{
+				{Name: "token", Description: "Join token", Schema: ""},
+				{Name: "rejoinToken", Description: "Rejoin token from hello or close message, keeps member id", Schema: ""},
+			},
+			Receive: []apidoc.Message{
+				message(dto.MessageHello, "First message after connecting", dto.HelloDTO{}),
+				message(dto.MessageSnapshot, "Positions of all visible members", []dto.PositionStateDTO{}),
+				message(dto.MessageDelta, "Changes since previous snapshot or delta", dto.PositionDeltaDTO{}),
+				message(dto.MessagePresence, "Member joined, left or was renamed", dto.PresenceEventDTO{}),
+				message(dto.MessageSessionUpdated, "Session was updated", dto.SessionDTO{}),
+				message(dto.MessageError, "Message of client was rejected", dto.ErrorDTO{}),
+				message(dto.MessageClose, "Last message before server closes connection", dto.CloseDTO{}),
+			},
+			Send: []apidoc.Message{
+				message(dto.MessageIdentify, "Change identifier shown to others", dto.IdentifyCmdDTO{}),
+				message(dto.MessagePosition, "Move cursor, rejected for viewers", dto.UpdatePositionCmdDTO{}),
+			},
+		}},
+	}
+}
+
+// envelope is schema of dto.EnvelopeDTO carrying payload of messageType.
+func envelope(schemas *apidoc.Schemas, messageType string, payload any) map[string]any {
+	return map[string]any{
+		"type":     "object",
+		"required": []string{"type", "v", "payload"},
+		"properties": map[string]any{
+			"type":    map[string]any{"type": "string", "enum": []string{messageType}},
+			"v":       map[string]any{"type": "integer", "enum": []int{dto.ProtocolVersion}},
+			"payload": schemas.Of(payload),
+		},
+	}
+}
+
+// registerApiDocs serves API documents, apidocs_test.go checks they match registered routes.
+func (s *FiberServer) registerApiDocs() {
+	openApiDoc, asyncApiDoc := openApi().Document(), asyncApi().Document()
+	s.App.Get(openApiPath, func(c *fiber.Ctx) error {
+		return c.JSON(openApiDoc)
+	})
+	s.App.Get(asyncApiPath, func(c *fiber.Ctx) error {
+		return c.JSON(asyncApiDoc)
+	})
+}
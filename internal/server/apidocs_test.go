@@ -0,0 +1,62 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// TestApiDocsMatchRoutes fails when a route under /api or /ws is added or removed
+// without changing apidocs.go.
+func TestApiDocsMatchRoutes(t *testing.T) {
+	s := newTestServer(t)
+	openApiDoc, asyncApiDoc := openApi(), asyncApi()
+
+	registered := make(map[string]bool)
+	for _, route := range s.App.GetRoutes(true) {
+		if route.Method == fiber.MethodHead {
+			continue
+		}
+		path := strings.TrimSuffix(route.Path, "/")
+		registered[route.Method+" "+path] = true
+		if strings.HasPrefix(path, "/api/") && !openApiDoc.Documents(route.Method, path) {
+			t.Errorf("%s %s is missing in OpenAPI document", route.Method, path)
+		}
+		if strings.HasPrefix(path, "/ws/") && !asyncApiDoc.Documents(path) {
+			t.Errorf("%s is missing in AsyncAPI document", path)
+		}
+	}
+	for _, op := range openApiDoc.Operations {
+		if !registered[op.Method+" "+op.Path] {
+			t.Errorf("%s %s is documented but not registered", op.Method, op.Path)
+		}
+	}
+	for _, channel := range asyncApiDoc.Channels {
+		if !registered[fiber.MethodGet+" "+channel.Path] {
+			t.Errorf("%s is documented but not registered", channel.Path)
+		}
+	}
+}
+
+func TestApiDocsAreServed(t *testing.T) {
+	s := newTestServer(t)
+	for _, path := range []string{openApiPath, asyncApiPath} {
+		resp, err := s.App.Test(httptest.NewRequest(fiber.MethodGet, path, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != fiber.StatusOK {
+			t.Fatalf("GET %s: status %d", path, resp.StatusCode)
+		}
+		var doc map[string]any
+		if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		if doc["info"] == nil {
+			t.Errorf("GET %s: info is missing", path)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/dwilkolek/browse-together-api/auth"
+	"github.com/dwilkolek/browse-together-api/dto"
+)
+
+const claimsLocal = "claims"
+
+// requireOwner allows only requests carrying the owner secret of session :id.
+func (s *FiberServer) requireOwner(c *fiber.Ctx) error {
+	session, err := s.getSession(c.Params("id"))
+	if err != nil {
+		return err
+	}
+	if !auth.VerifyOwnerSecret(bearerToken(c), session.OwnerSecretHash) {
+		return fiber.NewError(fiber.StatusUnauthorized, "owner secret required")
+	}
+	return c.Next()
+}
+
+// requireHost allows requests carrying the owner secret or a host join token of session :id.
+func (s *FiberServer) requireHost(c *fiber.Ctx) error {
+	session, err := s.getSession(c.Params("id"))
+	if err != nil {
+		return err
+	}
+	token := bearerToken(c)
+	if auth.VerifyOwnerSecret(token, session.OwnerSecretHash) {
+		return c.Next()
+	}
+	if claims, err := auth.VerifyJoinToken(s.cfg.AuthSecret, token, session.Id); err == nil && claims.Role == auth.RoleHost {
+		return c.Next()
+	}
+	return fiber.NewError(fiber.StatusUnauthorized, "owner secret or host token required")
+}
+
+// requireJoinToken verifies join token for the session in path and stores its claims in locals.
+// Browsers can't set headers on WebSocket, so token is also accepted as query param.
+func (s *FiberServer) requireJoinToken(c *fiber.Ctx) error {
+	sessionId := c.Params("sessionId", c.Params("id"))
+	token := c.Query("token")
+	if token == "" {
+		token = bearerToken(c)
+	}
+	claims, err := auth.VerifyJoinToken(s.cfg.AuthSecret, token, sessionId)
+	if err != nil {
+		return fiber.NewError(fiber.StatusUnauthorized, err.Error())
+	}
+	c.Locals(claimsLocal, claims)
+	return c.Next()
+}
+
+func (s *FiberServer) createJoinTokenHandler(c *fiber.Ctx) error {
+	var cmd CreateJoinTokenV1Cmd
+	if err := parseBody(c, &cmd); err != nil {
+		return err
+	}
+	if cmd.Role == "" {
+		cmd.Role = auth.RolePresenter
+	}
+	if !cmd.Role.Valid() {
+		return fiber.NewError(fiber.StatusBadRequest, "unknown role")
+	}
+	ttl := s.cfg.JoinTokenTTL
+	if cmd.TtlSeconds < 0 {
+		return fiber.NewError(fiber.StatusBadRequest, "ttlSeconds must be positive")
+	}
+	if cmd.TtlSeconds > 0 {
+		ttl = time.Duration(cmd.TtlSeconds) * time.Second
+	}
+
+	token, err := s.issueJoinToken(c.Params("id"), cmd.Role, ttl)
+	if err != nil {
+		return err
+	}
+	return c.JSON(token)
+}
+
+func (s *FiberServer) issueJoinToken(sessionId string, role auth.Role, ttl time.Duration) (dto.JoinTokenDTO, error) {
+	token, claims, err := auth.IssueJoinToken(s.cfg.AuthSecret, sessionId, role, ttl)
+	if err != nil {
+		return dto.JoinTokenDTO{}, err
+	}
+	return dto.JoinTokenDTO{
+		Token:     token,
+		Role:      string(claims.Role),
+		ExpiresAt: claims.ExpiresAt,
+	}, nil
+}
+
+func bearerToken(c *fiber.Ctx) string {
+	return parseBearer(c.Get(fiber.HeaderAuthorization))
+}
+
+func parseBearer(header string) string {
+	if len(header) > len("Bearer ") && strings.EqualFold(header[:len("Bearer ")], "Bearer ") {
+		return header[len("Bearer "):]
+	}
+	return ""
+}
+
+type CreateJoinTokenV1Cmd struct {
+	Role       auth.Role `json:"role"`
+	TtlSeconds int64     `json:"ttlSeconds"`
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/dwilkolek/browse-together-api/auth"
+	"github.com/dwilkolek/browse-together-api/dto"
+)
+
+func TestRequireHost(t *testing.T) {
+	s := newTestServer(t)
+	other := createSession(t, s)
+	viewer := func(session dto.CreatedSessionDTO) string {
+		token, err := s.issueJoinToken(session.Id, auth.RoleViewer, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token.Token
+	}
+
+	for _, credential := range []func(session dto.CreatedSessionDTO) string{
+		func(session dto.CreatedSessionDTO) string { return session.OwnerSecret },
+		func(session dto.CreatedSessionDTO) string { return session.HostToken.Token },
+	} {
+		session := createSession(t, s)
+		path := "/api/v1/sessions/" + session.Id
+		rejected := map[string]string{
+			"no credential":         "",
+			"presenter token":       session.JoinToken.Token,
+			"viewer token":          viewer(session),
+			"owner secret of other": other.OwnerSecret,
+			"host token of other":   other.HostToken.Token,
+			"owner secret hash":     auth.HashOwnerSecret(session.OwnerSecret),
+		}
+		for name, token := range rejected {
+			if status := call(t, s, fiber.MethodDelete, path, token, nil, nil); status != fiber.StatusUnauthorized {
+				t.Errorf("%s: status %d, expected 401", name, status)
+			}
+			if status := call(t, s, fiber.MethodDelete, path+"/members/1", token, nil, nil); status != fiber.StatusUnauthorized {
+				t.Errorf("%s kicking member: status %d, expected 401", name, status)
+			}
+		}
+		if status := call(t, s, fiber.MethodDelete, path, credential(session), nil, nil); status != fiber.StatusNoContent {
+			t.Errorf("status %d, expected 204", status)
+		}
+	}
+
+	if status := call(t, s, fiber.MethodDelete, "/api/v1/sessions/unknown", other.OwnerSecret, nil, nil); status != fiber.StatusNotFound {
+		t.Errorf("unknown session: status %d, expected 404", status)
+	}
+}
+
+func TestRequireOwner(t *testing.T) {
+	s := newTestServer(t)
+	session := createSession(t, s)
+	other := createSession(t, s)
+	path := "/api/v1/sessions/" + session.Id + "/tokens"
+	cmd := CreateJoinTokenV1Cmd{Role: auth.RoleHost}
+
+	rejected := map[string]string{
+		"no credential":         "",
+		"host token":            session.HostToken.Token,
+		"presenter token":       session.JoinToken.Token,
+		"owner secret of other": other.OwnerSecret,
+	}
+	for name, token := range rejected {
+		if status := call(t, s, fiber.MethodPost, path, token, cmd, nil); status != fiber.StatusUnauthorized {
+			t.Errorf("%s: status %d, expected 401", name, status)
+		}
+	}
+
+	var issued dto.JoinTokenDTO
+	if status := call(t, s, fiber.MethodPost, path, session.OwnerSecret, cmd, &issued); status != fiber.StatusOK {
+		t.Fatalf("status %d, expected 200", status)
+	}
+	claims, err := auth.VerifyJoinToken(s.cfg.AuthSecret, issued.Token, session.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Role != auth.RoleHost || issued.Role != string(auth.RoleHost) {
+		t.Errorf("issued %+v with claims %+v", issued, claims)
+	}
+
+	if status := call(t, s, fiber.MethodPost, "/api/v1/sessions/unknown/tokens", session.OwnerSecret, cmd, nil); status != fiber.StatusNotFound {
+		t.Errorf("unknown session: status %d, expected 404", status)
+	}
+}
+
+func TestRequireJoinToken(t *testing.T) {
+	s := newTestServer(t)
+	session := createSession(t, s)
+	other := createSession(t, s)
+	path := "/api/v1/sessions/" + session.Id + "/members"
+
+	for name, token := range map[string]string{"no token": "", "token of other": other.JoinToken.Token, "owner secret": session.OwnerSecret} {
+		if status := call(t, s, fiber.MethodGet, path, token, nil, nil); status != fiber.StatusUnauthorized {
+			t.Errorf("%s: status %d, expected 401", name, status)
+		}
+	}
+	if status := call(t, s, fiber.MethodGet, path, session.JoinToken.Token, nil, nil); status != fiber.StatusOK {
+		t.Errorf("status %d, expected 200", status)
+	}
+	if status := call(t, s, fiber.MethodGet, path+"?token="+session.JoinToken.Token, "", nil, nil); status != fiber.StatusOK {
+		t.Errorf("token in query: status %d, expected 200", status)
+	}
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+
+	"github.com/dwilkolek/browse-together-api/db"
+	"github.com/dwilkolek/browse-together-api/dto"
+	"github.com/dwilkolek/browse-together-api/logging"
+)
+
+const problemContentType = "application/problem+json"
+
+// errorHandler renders every error returned by handlers as RFC 7807 problem details.
+// Errors other than *fiber.Error and *validationError are logged and hidden from clients.
+func errorHandler(c *fiber.Ctx, err error) error {
+	problem, internal := problemOf(err, c.OriginalURL())
+	if internal {
+		// path only, query may carry a join token
+		requestLogger(c).Error("Request failed", "method", c.Method(), "path", c.Path(), logging.Err(err))
+	}
+
+	if err := c.Status(problem.Status).JSON(problem); err != nil {
+		return err
+	}
+	c.Set(fiber.HeaderContentType, problemContentType)
+	return nil
+}
+
+// problemOf describes err as problem details of request to instance, internal
+// errors are described only by status.
+func problemOf(err error, instance string) (problem dto.ProblemDTO, internal bool) {
+	problem = dto.ProblemDTO{
+		Type:     "about:blank",
+		Status:   fiber.StatusInternalServerError,
+		Instance: instance,
+	}
+	var validationErr *validationError
+	var fiberErr *fiber.Error
+	switch {
+	case errors.As(err, &validationErr):
+		problem.Status = fiber.StatusBadRequest
+		problem.Detail = validationErr.Error()
+		problem.InvalidParams = validationErr.params
+	case errors.As(err, &fiberErr):
+		problem.Status = fiberErr.Code
+		if fiberErr.Message != utils.StatusMessage(fiberErr.Code) {
+			problem.Detail = fiberErr.Message
+		}
+	default:
+		internal = true
+	}
+	problem.Title = utils.StatusMessage(problem.Status)
+	return problem, internal
+}
+
+// validationError collects all invalid fields of a request, so clients can fix them at once.
+type validationError struct {
+	params []dto.InvalidParamDTO
+}
+
+func (e *validationError) Error() string {
+	names := make([]string, len(e.params))
+	for i, param := range e.params {
+		names[i] = param.Name
+	}
+	return fmt.Sprintf("invalid %s", strings.Join(names, ", "))
+}
+
+func (e *validationError) add(name string, reason string, args ...any) {
+	e.params = append(e.params, dto.InvalidParamDTO{Name: name, Reason: fmt.Sprintf(reason, args...)})
+}
+
+// orNil returns nil when nothing was invalid, typed nil would be a non-nil error.
+func (e *validationError) orNil() error {
+	if len(e.params) == 0 {
+		return nil
+	}
+	return e
+}
+
+// parseBody is c.BodyParser that reports malformed body as bad request,
+// empty body leaves out untouched so it's reported by validation.
+func parseBody(c *fiber.Ctx, out any) error {
+	if len(c.Body()) == 0 {
+		return nil
+	}
+	err := c.BodyParser(out)
+	var fiberErr *fiber.Error
+	if err != nil && !errors.As(err, &fiberErr) {
+		return fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("malformed body: %s", err))
+	}
+	return err
+}
+
+// getSession maps missing session to 404.
+func (s *FiberServer) getSession(id string) (db.Session, error) {
+	session, err := s.store.GetSession(id)
+	if errors.Is(err, db.ErrNotFound) {
+		return session, fiber.NewError(fiber.StatusNotFound, fmt.Sprintf("session %s not found", id))
+	}
+	return session, err
+}
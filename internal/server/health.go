@@ -0,0 +1,76 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/dwilkolek/browse-together-api/dto"
+)
+
+type healthCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// pinger is implemented by stores relying on connections that can be lost.
+type pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// readinessChecks lists dependencies needed to serve sessions, store is only
+// checked when it can lose connection.
+func (s *FiberServer) readinessChecks() []healthCheck {
+	var checks []healthCheck
+	if store, ok := s.store.(pinger); ok {
+		checks = append(checks, healthCheck{name: "store", check: store.Ping})
+	}
+	return append(checks, healthCheck{name: "queue", check: s.sessions.Ping})
+}
+
+// livezHandler reports the process is up, it doesn't check dependencies
+// so instances aren't restarted while Redis is down.
+func (s *FiberServer) livezHandler(c *fiber.Ctx) error {
+	return c.JSON(dto.HealthDTO{Status: dto.HealthOk, Checks: map[string]dto.HealthCheckDTO{}})
+}
+
+// readyzHandler runs all checks concurrently and responds with 503 if any failed,
+// draining servers respond with 503 before getting here.
+func (s *FiberServer) readyzHandler(c *fiber.Ctx) error {
+	checks := s.readinessChecks()
+	results := make(map[string]dto.HealthCheckDTO, len(checks))
+	var resultsLock sync.Mutex
+	var wg sync.WaitGroup
+	for _, check := range checks {
+		wg.Add(1)
+		go func(check healthCheck) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(c.Context(), s.cfg.RedisPingTimeout)
+			defer cancel()
+			start := time.Now()
+			err := check.check(ctx)
+			result := dto.HealthCheckDTO{Status: dto.HealthOk, DurationMs: time.Since(start).Milliseconds()}
+			if err != nil {
+				result.Status = dto.HealthUnavailable
+				result.Error = err.Error()
+			}
+			resultsLock.Lock()
+			results[check.name] = result
+			resultsLock.Unlock()
+		}(check)
+	}
+	wg.Wait()
+
+	health := dto.HealthDTO{Status: dto.HealthOk, Checks: results}
+	for _, result := range results {
+		if result.Status != dto.HealthOk {
+			health.Status = dto.HealthUnavailable
+		}
+	}
+	if health.Status != dto.HealthOk {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(health)
+	}
+	return c.JSON(health)
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/dwilkolek/browse-together-api/auth"
+)
+
+func (s *FiberServer) getMembersHandler(c *fiber.Ctx) error {
+	id := c.Params("id")
+	if _, err := s.getSession(id); err != nil {
+		return err
+	}
+	return c.JSON(s.sessions.GetMembers(id))
+}
+
+func (s *FiberServer) updateMemberHandler(c *fiber.Ctx) error {
+	memberId, err := c.ParamsInt("memberId")
+	if err != nil || memberId < 1 {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid memberId")
+	}
+	var cmd UpdateMemberV1Cmd
+	if err := parseBody(c, &cmd); err != nil {
+		return err
+	}
+	if !cmd.Role.Valid() {
+		return fiber.NewError(fiber.StatusBadRequest, "unknown role")
+	}
+
+	if err := s.requireMember(c.Params("id"), int64(memberId)); err != nil {
+		return err
+	}
+	s.sessions.SetMemberRole(c.Params("id"), int64(memberId), cmd.Role)
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func (s *FiberServer) kickMemberHandler(c *fiber.Ctx) error {
+	memberId, err := c.ParamsInt("memberId")
+	if err != nil || memberId < 1 {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid memberId")
+	}
+
+	if err := s.requireMember(c.Params("id"), int64(memberId)); err != nil {
+		return err
+	}
+	s.sessions.KickMember(c.Params("id"), int64(memberId))
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// requireMember fails with 404 unless member is on the roster of session.
+func (s *FiberServer) requireMember(sessionId string, memberId int64) error {
+	for _, member := range s.sessions.GetMembers(sessionId) {
+		if member.MemberId == memberId {
+			return nil
+		}
+	}
+	return fiber.NewError(fiber.StatusNotFound, fmt.Sprintf("member %d not found", memberId))
+}
+
+type UpdateMemberV1Cmd struct {
+	Role auth.Role `json:"role"`
+}
@@ -1,19 +1,30 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gofiber/contrib/websocket"
 	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
 	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 
+	"github.com/dwilkolek/browse-together-api/auth"
 	"github.com/dwilkolek/browse-together-api/db"
 	"github.com/dwilkolek/browse-together-api/dto"
+	"github.com/dwilkolek/browse-together-api/logging"
+	"github.com/dwilkolek/browse-together-api/protocol"
 	"github.com/dwilkolek/browse-together-api/streaming"
+	"github.com/dwilkolek/browse-together-api/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func (s *FiberServer) RegisterFiberRoutes() {
@@ -23,146 +34,408 @@ func (s *FiberServer) RegisterFiberRoutes() {
 	s.App.Get("/health", func(c *fiber.Ctx) error {
 		return c.SendString("OK")
 	})
+	s.App.Get("/livez", s.livezHandler)
+	s.App.Get("/readyz", s.readyzHandler)
+	s.App.Get("/metrics", adaptor.HTTPHandler(promhttp.Handler()))
 
-	v1 := s.App.Group("/api/v1/sessions")
+	v1 := s.App.Group("/api/v1/sessions", s.authorize)
 	v1.Post("/", s.createSessionHandler)
 	v1.Get("/", s.getAllSessionsHandler)
 	v1.Get("/:id", s.getSessionHandler)
-	v1.Delete("/:id", s.deleteSessionHandler)
+	v1.Patch("/:id", s.requireHost, s.updateSessionHandler)
+	v1.Delete("/:id", s.requireHost, s.deleteSessionHandler)
+	v1.Post("/:id/tokens", s.requireOwner, s.createJoinTokenHandler)
+	v1.Get("/:id/members", s.requireJoinToken, s.getMembersHandler)
+	v1.Patch("/:id/members/:memberId", s.requireHost, s.updateMemberHandler)
+	v1.Delete("/:id/members/:memberId", s.requireHost, s.kickMemberHandler)
 
-	v1.Post("/:id/join", s.getJoinSessionHandler)
+	v1.Post("/:id/join", s.requireJoinToken, s.getJoinSessionHandler)
 
-	s.App.Get("/ws/:sessionId/cursors", websocket.New(s.sessionHandler))
+	s.App.Get(socketRoute, s.authorize, s.requireJoinToken, websocket.New(s.sessionHandler, websocket.Config{
+		Subprotocols: protocol.Subprotocols,
+	}))
+
+	s.registerApiDocs()
 }
 
 func (s *FiberServer) createSessionHandler(c *fiber.Ctx) error {
 	var cmd CreateSessionV1Cmd
-	if err := c.BodyParser(&cmd); err != nil {
+	if err := parseBody(c, &cmd); err != nil {
+		return err
+	}
+	if err := cmd.validate(s.cfg.Session.MaxLifetime); err != nil {
+		return err
+	}
+	ownerSecret, ownerSecretHash, err := auth.NewOwnerSecret()
+	if err != nil {
 		return err
 	}
+	now := time.Now()
 	newSession := db.Session{
-		Id:           uuid.New().String(),
-		Name:         cmd.Name,
-		Creator:      cmd.Creator,
-		BaseLocation: cmd.BaseLocation,
+		Id:                 uuid.New().String(),
+		Name:               cmd.Name,
+		Creator:            cmd.Creator,
+		BaseLocation:       cmd.BaseLocation,
+		TickRate:           cmd.TickRate,
+		OwnerSecretHash:    ownerSecretHash,
+		CreatedAt:          now.Unix(),
+		ExpiresAt:          now.Add(cmd.maxLifetime(s.cfg.Session.MaxLifetime)).Unix(),
+		IdleTimeoutSeconds: cmd.IdleTimeoutSeconds,
+		Version:            1,
+		UpdatedAt:          now.Unix(),
+		Tags:               cmd.Tags,
+		MaxMembers:         cmd.MaxMembers,
+		Attributes:         cmd.Attributes,
 	}
 
-	if err := db.GetDb().StoreSession(newSession); err == nil {
-		return c.JSON(toDto(newSession))
+	if err := s.store.StoreSession(newSession); err != nil {
+		return err
 	}
 
-	return fiber.NewError(fiber.StatusInternalServerError)
+	hostToken, err := s.issueJoinToken(newSession.Id, auth.RoleHost, s.cfg.JoinTokenTTL)
+	if err != nil {
+		return err
+	}
+	joinToken, err := s.issueJoinToken(newSession.Id, auth.RolePresenter, s.cfg.JoinTokenTTL)
+	if err != nil {
+		return err
+	}
+	return c.JSON(dto.CreatedSessionDTO{
+		SessionDTO:  s.toDto(newSession),
+		OwnerSecret: ownerSecret,
+		HostToken:   hostToken,
+		JoinToken:   joinToken,
+	})
 }
 
+const defaultPageSize = 50
+const maxPageSize = 200
+
+// getAllSessionsHandler lists a page of sessions, newest first unless sort=createdAt.
+// Cursor of the next page is passed in Link header.
 func (s *FiberServer) getAllSessionsHandler(c *fiber.Ctx) error {
-	sessions := db.GetDb().GetSessions()
-	sessionsDto := make([]dto.SessionDTO, len(sessions))
-	for i, session := range sessions {
-		sessionsDto[i] = toDto(session)
+	query := db.SessionQuery{
+		Creator:            c.Query("creator"),
+		BaseLocationPrefix: c.Query("baseLocationPrefix"),
+		Cursor:             c.Query("cursor"),
+		Limit:              c.QueryInt("limit", defaultPageSize),
+	}
+	if query.Limit < 1 || query.Limit > maxPageSize {
+		return fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxPageSize))
+	}
+	switch c.Query("sort", "-createdAt") {
+	case "createdAt":
+	case "-createdAt":
+		query.Descending = true
+	default:
+		return fiber.NewError(fiber.StatusBadRequest, "sort must be createdAt or -createdAt")
+	}
+
+	page, err := s.store.ListSessions(query)
+	if errors.Is(err, db.ErrInvalidCursor) {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	if err != nil {
+		return err
+	}
+
+	sessionsDto := make([]dto.SessionDTO, len(page.Sessions))
+	for i, session := range page.Sessions {
+		sessionsDto[i] = s.toDto(session)
+	}
+	if page.NextCursor != "" {
+		next := c.Request().URI().QueryArgs()
+		next.Set("cursor", page.NextCursor)
+		c.Set(fiber.HeaderLink, fmt.Sprintf(`<%s?%s>; rel="next"`, c.Path(), next.String()))
 	}
 	return c.JSON(sessionsDto)
 }
 
 func (s *FiberServer) getSessionHandler(c *fiber.Ctx) error {
-	expectedKey := c.Params("id")
-	if session, err := db.GetDb().GetSession(expectedKey); err == nil {
-		return c.JSON(toDto(session))
+	session, err := s.getSession(c.Params("id"))
+	if err != nil {
+		return err
+	}
+	setETag(c, session)
+	return c.JSON(s.toDto(session))
+}
+
+// updateSessionHandler changes only fields present in body. Version expected by client
+// comes from If-Match header or version field, the update is rejected if session changed since.
+func (s *FiberServer) updateSessionHandler(c *fiber.Ctx) error {
+	var cmd UpdateSessionV1Cmd
+	if err := parseBody(c, &cmd); err != nil {
+		return err
+	}
+	if err := validateUpdatedFields(c.Body()); err != nil {
+		return err
+	}
+	if err := cmd.validate(); err != nil {
+		return err
+	}
+	expectedVersion := cmd.Version
+	conflictStatus := fiber.StatusConflict
+	if ifMatch := c.Get(fiber.HeaderIfMatch); ifMatch != "" {
+		conflictStatus = fiber.StatusPreconditionFailed
+		version, err := parseETag(ifMatch)
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "invalid If-Match header")
+		}
+		expectedVersion = version
+	}
+
+	session, err := s.store.UpdateSession(c.Params("id"), expectedVersion, func(session *db.Session) {
+		if cmd.Name != nil {
+			session.Name = *cmd.Name
+		}
+		if cmd.BaseLocation != nil {
+			session.BaseLocation = *cmd.BaseLocation
+		}
+		if cmd.Creator != nil {
+			session.Creator = *cmd.Creator
+		}
+	})
+	if errors.Is(err, db.ErrNotFound) {
+		return fiber.NewError(fiber.StatusNotFound, fmt.Sprintf("session %s not found", c.Params("id")))
+	}
+	if errors.Is(err, db.ErrVersionConflict) {
+		setETag(c, session)
+		return fiber.NewError(conflictStatus, fmt.Sprintf("session is at version %d", session.Version))
+	}
+	if err != nil {
+		return err
 	}
-	return fiber.NewError(fiber.StatusNotFound)
+
+	sessionDto := s.toDto(session)
+	s.sessions.UpdateSession(sessionDto)
+	setETag(c, session)
+	return c.JSON(sessionDto)
+}
+
+func setETag(c *fiber.Ctx, session db.Session) {
+	c.Set(fiber.HeaderETag, fmt.Sprintf(`"%d"`, session.Version))
+}
+
+func parseETag(etag string) (int64, error) {
+	etag = strings.TrimPrefix(etag, "W/")
+	return strconv.ParseInt(strings.Trim(etag, `"`), 10, 64)
 }
 
 func (s *FiberServer) deleteSessionHandler(c *fiber.Ctx) error {
 	id := c.Params("id")
-	db.GetDb().DeleteSession(id)
-	streaming.CloseSession(id)
-	return nil
+	err := s.store.DeleteSession(id)
+	if errors.Is(err, db.ErrNotFound) {
+		return fiber.NewError(fiber.StatusNotFound, fmt.Sprintf("session %s not found", id))
+	}
+	if err != nil {
+		return err
+	}
+	s.sessions.CloseSession(id)
+	return c.SendStatus(fiber.StatusNoContent)
 }
 func (s *FiberServer) getJoinSessionHandler(c *fiber.Ctx) error {
 	id := c.Params("id")
-	return c.JSON(map[string]string{
-		"joinUrl": fmt.Sprintf("/ws/%s/cursors", id),
+	session, err := s.getSession(id)
+	if err != nil {
+		return err
+	}
+	if session.MaxMembers > 0 && s.sessions.MemberCount(id) >= session.MaxMembers {
+		return fiber.NewError(fiber.StatusConflict, "session is full")
+	}
+	token := c.Query("token")
+	if token == "" {
+		token = bearerToken(c)
+	}
+	return c.JSON(dto.JoinSessionDTO{
+		JoinUrl: s.path(fmt.Sprintf("/ws/%s/cursors?token=%s", id, url.QueryEscape(token))),
 	})
 }
 
-func (s *FiberServer) sessionHandler(c *websocket.Conn) {
-	sessionId := c.Params("sessionId")
-	log.Printf("Trying to connect to session %s\n", sessionId)
-	var (
-		msg []byte
-		err error
-	)
+// serveMember streams cursors of the session to member connected with c, until
+// either side closes the connection.
+func (s *FiberServer) serveMember(c streaming.Conn, req socketRequest) {
+	sessionId := req.sessionId
+	logger := req.logger.With(logging.SessionIdKey, sessionId)
+	logger.Info("Trying to connect to session")
 	defer c.Close()
+	connCtx, connSpan := tracing.Tracer.Start(req.ctx, "websocket connection",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(tracing.SessionIdKey.String(sessionId)))
+	defer connSpan.End()
 
-	if _, err := db.GetDb().GetSession(sessionId); err != nil {
+	session, err := s.store.GetSession(sessionId)
+	if err != nil {
 		return
 	}
 
 	var memberId int64 = 0
-	rejoinToken := c.Query("rejoinToken", "")
-	if rejoinToken != "" {
-		memberId, _ = db.GetDb().GetMemberIdForRejoinToken(rejoinToken)
+	if req.rejoinToken != "" {
+		if memberId, err = s.store.GetMemberIdForRejoinToken(sessionId, req.rejoinToken); err != nil {
+			logger.Info("Ignoring rejoin token", logging.Err(err))
+		}
 	}
 
-	memberId, sessionState := streaming.JoinSession(sessionId, c, memberId)
+	codec := protocol.ForSubprotocol(req.subprotocol)
+	member, sessionState, err := s.sessions.JoinSession(session, c, codec, memberId, req.claims.Role)
+	if errors.Is(err, streaming.ErrSessionFull) {
+		logger.Info("Session is full, rejecting member")
+		connSpan.SetAttributes(attribute.String("browse_together.close_reason", dto.CloseSessionFull))
+		if frame, err := codec.EncodeClose(dto.CloseDTO{Reason: dto.CloseSessionFull}); err == nil {
+			c.WriteMessage(frame.MessageType, frame.Data)
+		}
+		return
+	}
+	memberId = member.Id
+	logger = logger.With(logging.MemberIdKey, memberId)
+	connSpan.SetAttributes(tracing.MemberIdKey.Int64(memberId))
 	done := sessionState.OnSessionClosed()
-	var newMessage = make(chan dto.PositionStateDTO)
-
-	newRejoinToken := db.GetDb().StoreRejoinToken(memberId)
 	identifier := fmt.Sprintf("member-%d", memberId)
-	err = c.WriteJSON(fmt.Sprintf("%d;%s", memberId, newRejoinToken))
-	if err != nil {
-		fmt.Printf("Error sending first message: %s\n", err)
+
+	newRejoinToken := s.store.StoreRejoinToken(sessionId, memberId)
+	hello := dto.HelloDTO{
+		MemberId:    memberId,
+		RejoinToken: newRejoinToken,
+		Role:        string(member.Role()),
+	}
+	if err := sessionState.Greet(member, hello, identifier); err != nil {
+		logger.Error("Error encoding first message", logging.Err(err))
+		sessionState.Leave(member)
 		return
 	}
+	s.hookMember(s.options.Hooks.Join, sessionId, member)
 
+	// positions are traced separately, one trace per connection would grow for hours
+	connLink, _ := tracing.LinkFrom(connCtx)
+	type positionChange struct {
+		ctx      context.Context
+		position dto.PositionStateDTO
+	}
+	var newMessage = make(chan positionChange)
+	var newIdentifier = make(chan string)
+	readDone := make(chan struct{})
 	go func() {
+		defer close(readDone)
 		for {
-			if _, msg, err = c.ReadMessage(); err != nil {
-				sessionState.MemberLeft(memberId)
-				log.Println("read:", err)
-				break
+			messageType, msg, err := c.ReadMessage()
+			if err != nil {
+				logger.Debug("Read failed", logging.Err(err))
+				return
 			}
 
-			if strings.HasPrefix(string(msg), "Identifier:") {
-				identifier = string(msg)[len("Identifier:"):]
+			cmd, err := codec.Decode(messageType, msg)
+			var protocolErr *protocol.Error
+			if errors.As(err, &protocolErr) {
+				logger.Info("Member sent invalid message", logging.Err(err))
+				sessionState.ReplyError(member, protocolErr)
+				continue
+			}
+			if err != nil {
+				logger.Warn("Failed to decode message", logging.Err(err))
 				continue
 			}
 
-			var event dto.UpdatePositionCmdDTO
-			json.Unmarshal(msg, &event)
-			newMessage <- dto.PositionStateDTO{
-				MemberId:        memberId,
-				X:               event.X,
-				Y:               event.Y,
-				Selector:        event.Selector,
-				Location:        event.Location,
-				UpdatedAt:       time.Now().UnixMilli(),
-				GivenIdentifier: identifier,
+			if cmd.Kind == protocol.Identify {
+				select {
+				case newIdentifier <- cmd.Identifier:
+				case <-done:
+					return
+				}
+				continue
+			}
+			if !member.Role().CanBroadcast() {
+				sessionState.ReplyError(member, &protocol.Error{
+					Code:    dto.ErrorForbidden,
+					Message: fmt.Sprintf("%s can't broadcast position", member.Role()),
+				})
+				continue
+			}
+
+			event := cmd.Position
+			ctx, span := tracing.Tracer.Start(context.Background(), "position received",
+				trace.WithNewRoot(),
+				trace.WithLinks(connLink),
+				trace.WithAttributes(tracing.SessionIdKey.String(sessionId), tracing.MemberIdKey.Int64(memberId)))
+			select {
+			case newMessage <- positionChange{ctx: ctx, position: dto.PositionStateDTO{
+				MemberId:  memberId,
+				X:         event.X,
+				Y:         event.Y,
+				Selector:  event.Selector,
+				Location:  event.Location,
+				UpdatedAt: time.Now().UnixMilli(),
+			}}:
+			case <-done:
+				span.End()
+				return
 			}
 		}
 	}()
+	// pending frames are flushed before closing connection, it's released
+	// once handler returns so reader must be done by then
+	defer func() {
+		sessionState.Leave(member)
+		c.Close()
+		<-readDone
+		s.hookMember(s.options.Hooks.Leave, sessionId, member)
+	}()
 
 	for {
 
 		select {
-		case pos := <-newMessage:
-			sessionState.SessionMemberPositionChange(pos)
+		case change := <-newMessage:
+			change.position.GivenIdentifier = identifier
+			sessionState.PositionChanged(change.ctx, member, change.position)
+			trace.SpanFromContext(change.ctx).End()
+			if s.options.Hooks.Position != nil {
+				s.options.Hooks.Position(Member{SessionId: sessionId, MemberId: memberId, Role: member.Role()}, change.position)
+			}
+
+		case newIdentifier := <-newIdentifier:
+			identifier = newIdentifier
+			sessionState.Rename(member, identifier)
+
+		case <-readDone:
+			return
 
 		case <-done:
-			log.Printf("Closing conn!")
+			logger.Info("Session closed, closing connection")
+			connSpan.SetAttributes(attribute.String("browse_together.close_reason", dto.CloseSessionClosed))
+			sessionState.SendClose(member, dto.CloseDTO{Reason: dto.CloseSessionClosed})
 			return
 		}
 
 	}
 
 }
-func toDto(session db.Session) dto.SessionDTO {
+
+// hookMember calls Join or Leave hook, if set.
+func (s *FiberServer) hookMember(hook func(member Member), sessionId string, member *streaming.Member) {
+	if hook != nil {
+		hook(Member{SessionId: sessionId, MemberId: member.Id, Role: member.Role()})
+	}
+}
+
+func (s *FiberServer) toDto(session db.Session) dto.SessionDTO {
+	tags := session.Tags
+	if tags == nil {
+		tags = []string{}
+	}
 	return dto.SessionDTO{
-		Id:                session.Id,
-		JoinUrl:           fmt.Sprintf("/api/v1/sessions/%s/join", session.Id),
-		Name:              session.Name,
-		BaseUrl:           session.BaseLocation,
-		CreatorIdentifier: session.Creator,
+		Id:                 session.Id,
+		JoinUrl:            s.path(fmt.Sprintf("/api/v1/sessions/%s/join", session.Id)),
+		Name:               session.Name,
+		BaseUrl:            session.BaseLocation,
+		CreatorIdentifier:  session.Creator,
+		TickRate:           s.sessions.TickRate(session),
+		ExpiresAt:          session.ExpiresAt,
+		IdleTimeoutSeconds: int(s.sessions.IdleTimeout(session).Seconds()),
+		Version:            session.Version,
+		MemberCount:        s.sessions.MemberCount(session.Id),
+		CreatedAt:          session.CreatedAt,
+		UpdatedAt:          max(session.UpdatedAt, session.CreatedAt),
+		Tags:               tags,
+		MaxMembers:         session.MaxMembers,
+		Attributes:         session.Attributes,
 	}
 }
 
@@ -170,6 +443,21 @@ type CreateSessionV1Cmd struct {
 	Name         string `json:"name"`
 	BaseLocation string `json:"baseLocation"`
 	Creator      string `json:"creator"`
+	TickRate     int    `json:"tickRate"`
+	// MaxLifetimeSeconds and IdleTimeoutSeconds fall back to SESSION_MAX_LIFETIME and SESSION_IDLE_TIMEOUT when 0.
+	MaxLifetimeSeconds int             `json:"maxLifetimeSeconds"`
+	IdleTimeoutSeconds int             `json:"idleTimeoutSeconds"`
+	Tags               []string        `json:"tags"`
+	MaxMembers         int             `json:"maxMembers"`
+	Attributes         json.RawMessage `json:"attributes"`
+}
+
+// UpdateSessionV1Cmd leaves fields that are nil untouched.
+type UpdateSessionV1Cmd struct {
+	Name         *string `json:"name"`
+	BaseLocation *string `json:"baseLocation"`
+	Creator      *string `json:"creator"`
+	Version      int64   `json:"version"`
 }
 
 type CloseSessionV1Cmd struct {
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/dwilkolek/browse-together-api/dto"
+)
+
+// patchSession sends PATCH of session with If-Match, if any, and returns status, ETag and response body.
+func patchSession(t *testing.T, s *FiberServer, session dto.CreatedSessionDTO, ifMatch string, body string) (int, string, []byte) {
+	t.Helper()
+	req := httptest.NewRequest(fiber.MethodPatch, "/api/v1/sessions/"+session.Id, bytes.NewReader([]byte(body)))
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	req.Header.Set(fiber.HeaderAuthorization, "Bearer "+session.OwnerSecret)
+	if ifMatch != "" {
+		req.Header.Set(fiber.HeaderIfMatch, ifMatch)
+	}
+	resp, err := s.App.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, resp.Header.Get(fiber.HeaderETag), data
+}
+
+func TestUpdateSession(t *testing.T) {
+	s := newTestServer(t)
+	session := createSession(t, s)
+
+	status, etag, body := patchSession(t, s, session, `"1"`, `{"name":"renamed"}`)
+	if status != fiber.StatusOK {
+		t.Fatalf("status %d: %s", status, body)
+	}
+	if etag != `"2"` {
+		t.Errorf("ETag %s, expected \"2\"", etag)
+	}
+	var updated dto.SessionDTO
+	if err := json.Unmarshal(body, &updated); err != nil {
+		t.Fatal(err)
+	}
+	if updated.Name != "renamed" || updated.BaseUrl != "https://example.com" || updated.Version != 2 {
+		t.Errorf("updated to %+v, expected only name and version to change", updated)
+	}
+
+	var stored dto.SessionDTO
+	if status := call(t, s, fiber.MethodGet, "/api/v1/sessions/"+session.Id, "", nil, &stored); status != fiber.StatusOK || stored.Name != "renamed" {
+		t.Errorf("status %d, stored name %q", status, stored.Name)
+	}
+}
+
+func TestUpdateSessionRejectsStaleVersion(t *testing.T) {
+	tests := []struct {
+		name    string
+		ifMatch string
+		body    string
+		status  int
+	}{
+		{"stale If-Match", `"1"`, `{"name":"late"}`, fiber.StatusPreconditionFailed},
+		{"stale weak If-Match", `W/"1"`, `{"name":"late"}`, fiber.StatusPreconditionFailed},
+		{"stale version in body", "", `{"name":"late","version":1}`, fiber.StatusConflict},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestServer(t)
+			session := createSession(t, s)
+			if status, _, body := patchSession(t, s, session, "", `{"name":"first"}`); status != fiber.StatusOK {
+				t.Fatalf("first update: status %d: %s", status, body)
+			}
+
+			status, etag, _ := patchSession(t, s, session, test.ifMatch, test.body)
+			if status != test.status {
+				t.Errorf("status %d, expected %d", status, test.status)
+			}
+			if etag != `"2"` {
+				t.Errorf("ETag %s, expected current version \"2\"", etag)
+			}
+			var stored dto.SessionDTO
+			call(t, s, fiber.MethodGet, "/api/v1/sessions/"+session.Id, "", nil, &stored)
+			if stored.Name != "first" {
+				t.Errorf("stored name %q, stale update must not apply", stored.Name)
+			}
+		})
+	}
+}
+
+func TestUpdateSessionRejectsImmutableFields(t *testing.T) {
+	s := newTestServer(t)
+	session := createSession(t, s)
+	tests := []struct {
+		body  string
+		param string
+	}{
+		{`{"id":"other"}`, "id"},
+		{`{"name":"renamed","tickRate":5}`, "tickRate"},
+		{`{"maxMembers":2}`, "maxMembers"},
+		{`{"expiresAt":"2030-01-01T00:00:00Z"}`, "expiresAt"},
+	}
+	for _, test := range tests {
+		t.Run(test.param, func(t *testing.T) {
+			status, _, body := patchSession(t, s, session, "", test.body)
+			if status != fiber.StatusBadRequest {
+				t.Fatalf("status %d, expected 400", status)
+			}
+			var problem dto.ProblemDTO
+			if err := json.Unmarshal(body, &problem); err != nil {
+				t.Fatal(err)
+			}
+			if len(problem.InvalidParams) != 1 || problem.InvalidParams[0].Name != test.param {
+				t.Errorf("invalid params %+v, expected %s", problem.InvalidParams, test.param)
+			}
+		})
+	}
+
+	var stored dto.SessionDTO
+	call(t, s, fiber.MethodGet, "/api/v1/sessions/"+session.Id, "", nil, &stored)
+	if stored.Name != "test" || stored.Version != 1 {
+		t.Errorf("session changed to %+v by rejected updates", stored)
+	}
+}
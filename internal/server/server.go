@@ -1,23 +1,96 @@
 package server
 
 import (
+	"context"
+	"expvar"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
 	"github.com/gofiber/contrib/websocket"
 	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
 	"github.com/gofiber/fiber/v2/middleware/compress"
 	"github.com/gofiber/fiber/v2/middleware/cors"
+	"github.com/gofiber/fiber/v2/middleware/requestid"
+
+	"github.com/dwilkolek/browse-together-api/auth"
+	"github.com/dwilkolek/browse-together-api/config"
+	"github.com/dwilkolek/browse-together-api/db"
+	"github.com/dwilkolek/browse-together-api/dto"
+	"github.com/dwilkolek/browse-together-api/logging"
+	"github.com/dwilkolek/browse-together-api/streaming"
 )
 
 type FiberServer struct {
 	*fiber.App
+	cfg      config.Config
+	store    db.Db
+	sessions streaming.SessionRegistry
+	options  Options
+	draining atomic.Bool
+}
+
+// Options customize server embedded in other applications, zero value is used by main.
+type Options struct {
+	// Auth is called before API and socket handlers of both Fiber and net/http, returned
+	// error rejects the request and *fiber.Error sets its status. Join tokens and owner
+	// secrets are still required.
+	Auth  func(r *http.Request) error
+	Hooks Hooks
+}
+
+// Member identifies connection of a member passed to hooks.
+type Member struct {
+	SessionId string
+	MemberId  int64
+	Role      auth.Role
+}
+
+// Hooks are called on goroutine of the member connection, they must not block.
+type Hooks struct {
+	// Join is called once member was greeted, Leave once it's disconnected.
+	Join  func(member Member)
+	Leave func(member Member)
+	// Position is called for every position accepted from member.
+	Position func(member Member, position dto.PositionStateDTO)
 }
 
-func New() *FiberServer {
+// New returns server keeping sessions in store and tracking members connected to it in sessions.
+// Servers sharing neither store nor queues of sessions are isolated from each other.
+func New(cfg config.Config, store db.Db, sessions streaming.SessionRegistry, options Options) *FiberServer {
 	server := &FiberServer{
-		App: fiber.New(),
+		cfg:      cfg,
+		store:    store,
+		sessions: sessions,
+		options:  options,
+		App: fiber.New(fiber.Config{
+			ErrorHandler: errorHandler,
+			// banner would break JSON logs
+			DisableStartupMessage: cfg.LogFormat == "json",
+		}),
 	}
 
-	server.Use(cors.New())
+	server.Use(requestid.New(requestid.Config{ContextKey: requestIdLocal}))
+	server.Use(accessLog)
+	server.Use(traceRequests)
+	server.Use(cors.New(cors.Config{
+		ExposeHeaders: fiber.HeaderETag + "," + fiber.HeaderLink,
+	}))
 	server.Use(compress.New())
+	if cfg.Debug {
+		server.Use(debugVars)
+	}
+	server.Use(func(c *fiber.Ctx) error {
+		// /livez keeps passing so the process isn't killed before members moved elsewhere
+		if server.draining.Load() && c.Path() != "/livez" {
+			c.Set(fiber.HeaderConnection, "close")
+			return fiber.NewError(fiber.StatusServiceUnavailable, "server is shutting down")
+		}
+		return c.Next()
+	})
 	server.Use("/ws", func(c *fiber.Ctx) error {
 		// IsWebSocketUpgrade returns true if the client
 		// requested upgrade to the WebSocket protocol.
@@ -31,3 +104,76 @@ func New() *FiberServer {
 	server.RegisterFiberRoutes()
 	return server
 }
+
+const requestIdLocal = "requestId"
+
+// debugVars serves memory stats at /debug/vars, read by cmd/loadtest. The rest of
+// expvar is left out, cmdline would reveal -auth-secret.
+func debugVars(c *fiber.Ctx) error {
+	if c.Path() != "/debug/vars" {
+		return c.Next()
+	}
+	c.Type("json", "utf-8")
+	return c.SendString(`{"memstats": ` + expvar.Get("memstats").String() + "}")
+}
+
+// requestLogger returns logger with id of the request, also sent back in X-Request-ID header.
+func requestLogger(c *fiber.Ctx) *slog.Logger {
+	return slog.With(logging.RequestIdKey, c.Locals(requestIdLocal))
+}
+
+// accessLog logs every request once it's handled, probes and scrapes only at debug level.
+func accessLog(c *fiber.Ctx) error {
+	start := time.Now()
+	err := c.Next()
+	level := slog.LevelInfo
+	switch c.Path() {
+	case "/health", "/livez", "/readyz", "/metrics":
+		level = slog.LevelDebug
+	}
+	status := c.Response().StatusCode()
+	if err != nil {
+		// error handler runs after middlewares, response doesn't have its status yet
+		problem, _ := problemOf(err, "")
+		status = problem.Status
+	}
+	requestLogger(c).Log(c.Context(), level, "Request handled",
+		"method", c.Method(),
+		"path", c.Path(),
+		"status", status,
+		"duration", time.Since(start),
+	)
+	return err
+}
+
+// Shutdown drains the server and stops listening, giving up when ctx is done.
+func (s *FiberServer) Shutdown(ctx context.Context) error {
+	s.Drain(ctx)
+	return s.App.ShutdownWithContext(ctx)
+}
+
+// Drain rejects new requests, asks connected members to reconnect elsewhere
+// and persists sessions, giving up when ctx is done.
+func (s *FiberServer) Drain(ctx context.Context) {
+	s.draining.Store(true)
+	s.sessions.Drain(ctx, s.store.StoreRejoinToken)
+}
+
+// authorize runs Auth hook of options, if any.
+func (s *FiberServer) authorize(c *fiber.Ctx) error {
+	if s.options.Auth != nil {
+		r, err := adaptor.ConvertRequest(c, true)
+		if err != nil {
+			return err
+		}
+		if err := s.options.Auth(r); err != nil {
+			return err
+		}
+	}
+	return c.Next()
+}
+
+// path prepends path the app was mounted at to p.
+func (s *FiberServer) path(p string) string {
+	return strings.TrimSuffix(s.App.MountPath(), "/") + p
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/dwilkolek/browse-together-api/config"
+	"github.com/dwilkolek/browse-together-api/db"
+	"github.com/dwilkolek/browse-together-api/dto"
+	"github.com/dwilkolek/browse-together-api/queue"
+	"github.com/dwilkolek/browse-together-api/streaming"
+)
+
+// newTestServer returns server keeping sessions in memory.
+func newTestServer(t *testing.T) *FiberServer {
+	t.Helper()
+	cfg := config.Default()
+	cfg.AuthSecret = []byte("test secret")
+	store, err := db.Open(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queues, err := queue.NewFactory(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return New(cfg, store, streaming.NewRegistry(cfg, queues), Options{})
+}
+
+// call sends request with bearer token, if any, and decodes JSON response into out, if any.
+func call(t *testing.T, s *FiberServer, method string, path string, token string, body any, out any) int {
+	t.Helper()
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = bytes.NewReader(data)
+	}
+	req := httptest.NewRequest(method, path, reader)
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	if token != "" {
+		req.Header.Set(fiber.HeaderAuthorization, "Bearer "+token)
+	}
+	resp, err := s.App.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if out != nil && resp.StatusCode == fiber.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func createSession(t *testing.T, s *FiberServer) dto.CreatedSessionDTO {
+	t.Helper()
+	var created dto.CreatedSessionDTO
+	cmd := CreateSessionV1Cmd{Name: "test", BaseLocation: "https://example.com"}
+	if status := call(t, s, fiber.MethodPost, "/api/v1/sessions", "", cmd, &created); status != fiber.StatusOK {
+		t.Fatalf("creating session: status %d", status)
+	}
+	return created
+}
+
+func TestDebugVarsOnlyServesMemstats(t *testing.T) {
+	s := newTestServer(t)
+	if status := call(t, s, fiber.MethodGet, "/debug/vars", "", nil, nil); status != fiber.StatusNotFound {
+		t.Errorf("status %d without DEBUG, expected 404", status)
+	}
+
+	s.cfg.Debug = true
+	s = New(s.cfg, s.store, s.sessions, Options{})
+	var vars map[string]json.RawMessage
+	if status := call(t, s, fiber.MethodGet, "/debug/vars", "", nil, &vars); status != fiber.StatusOK {
+		t.Fatalf("status %d", status)
+	}
+	if _, ok := vars["memstats"]; !ok || len(vars) != 1 {
+		t.Errorf("%d vars, expected only memstats", len(vars))
+	}
+}
+
+func TestDrainingFailsReadinessOnly(t *testing.T) {
+	s := newTestServer(t)
+	s.Drain(context.Background())
+	if status := call(t, s, fiber.MethodGet, "/livez", "", nil, nil); status != fiber.StatusOK {
+		t.Errorf("/livez status %d while draining, expected 200", status)
+	}
+	for _, path := range []string{"/readyz", "/api/v1/sessions"} {
+		if status := call(t, s, fiber.MethodGet, path, "", nil, nil); status != fiber.StatusServiceUnavailable {
+			t.Errorf("%s status %d while draining, expected 503", path, status)
+		}
+	}
+}
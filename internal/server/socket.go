@@ -0,0 +1,155 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	fasthttpws "github.com/fasthttp/websocket"
+	"github.com/gofiber/contrib/websocket"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/dwilkolek/browse-together-api/auth"
+	"github.com/dwilkolek/browse-together-api/logging"
+	"github.com/dwilkolek/browse-together-api/protocol"
+	"github.com/dwilkolek/browse-together-api/tracing"
+)
+
+const socketRoute = "/ws/:sessionId/cursors"
+
+// socketRequest is the upgrade request of cursors socket, whichever transport accepted it.
+type socketRequest struct {
+	// ctx carries trace of the upgrade request.
+	ctx         context.Context
+	sessionId   string
+	rejoinToken string
+	subprotocol string
+	claims      auth.Claims
+	logger      *slog.Logger
+}
+
+// sessionHandler serves cursors socket upgraded by Fiber, middlewares already checked the request.
+func (s *FiberServer) sessionHandler(c *websocket.Conn) {
+	s.serveMember(c, socketRequest{
+		ctx:         connTraceContext(c),
+		sessionId:   c.Params("sessionId"),
+		rejoinToken: c.Query("rejoinToken"),
+		subprotocol: c.Subprotocol(),
+		claims:      c.Locals(claimsLocal).(auth.Claims),
+		logger:      slog.With(logging.RequestIdKey, c.Locals(requestIdLocal)),
+	})
+}
+
+// SocketHandler serves cursors socket at /ws/{sessionId}/cursors to net/http servers,
+// checking requests the way Fiber middlewares do. Path prefix must be stripped.
+func (s *FiberServer) SocketHandler() http.Handler {
+	return http.HandlerFunc(s.serveSocket)
+}
+
+func (s *FiberServer) serveSocket(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	requestId := r.Header.Get(fiber.HeaderXRequestID)
+	if requestId == "" {
+		requestId = uuid.New().String()
+	}
+	w.Header().Set(fiber.HeaderXRequestID, requestId)
+	logger := slog.With(logging.RequestIdKey, requestId)
+
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := tracing.Tracer.Start(ctx, r.Method+" "+socketRoute,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(semconv.HTTPMethod(r.Method), semconv.HTTPRoute(socketRoute)))
+
+	status := http.StatusSwitchingProtocols
+	req, err := s.checkSocketRequest(r)
+	var conn *fasthttpws.Conn
+	if err != nil {
+		status = writeProblem(w, r, logger, err)
+	} else {
+		upgrader := fasthttpws.Upgrader{
+			Subprotocols: protocol.Subprotocols,
+			// like Fiber, members connect from pages on any origin
+			CheckOrigin: func(r *http.Request) bool { return true },
+			Error: func(w http.ResponseWriter, r *http.Request, code int, reason error) {
+				status = writeProblem(w, r, logger, fiber.NewError(code, reason.Error()))
+			},
+		}
+		conn, _ = upgrader.Upgrade(w, r, nil)
+	}
+
+	span.SetAttributes(semconv.HTTPStatusCode(status))
+	if status >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, "")
+	}
+	span.End()
+	logger.Info("Request handled", "method", r.Method, "path", r.URL.Path, "status", status, "duration", time.Since(start))
+	if conn == nil {
+		return
+	}
+
+	req.ctx = ctx
+	req.logger = logger
+	req.subprotocol = conn.Subprotocol()
+	s.serveMember(conn, req)
+}
+
+// checkSocketRequest does what draining middleware, routing, authorize and
+// requireJoinToken do for Fiber.
+func (s *FiberServer) checkSocketRequest(r *http.Request) (socketRequest, error) {
+	if s.draining.Load() {
+		return socketRequest{}, fiber.NewError(fiber.StatusServiceUnavailable, "server is shutting down")
+	}
+	if !fasthttpws.IsWebSocketUpgrade(r) {
+		return socketRequest{}, fiber.ErrUpgradeRequired
+	}
+	sessionId, ok := strings.CutPrefix(r.URL.Path, "/ws/")
+	if ok {
+		sessionId, ok = strings.CutSuffix(sessionId, "/cursors")
+	}
+	if !ok || sessionId == "" || strings.Contains(sessionId, "/") {
+		return socketRequest{}, fiber.ErrNotFound
+	}
+	if r.Method != http.MethodGet {
+		return socketRequest{}, fiber.ErrMethodNotAllowed
+	}
+	if s.options.Auth != nil {
+		if err := s.options.Auth(r); err != nil {
+			return socketRequest{}, err
+		}
+	}
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		token = parseBearer(r.Header.Get(fiber.HeaderAuthorization))
+	}
+	claims, err := auth.VerifyJoinToken(s.cfg.AuthSecret, token, sessionId)
+	if err != nil {
+		return socketRequest{}, fiber.NewError(fiber.StatusUnauthorized, err.Error())
+	}
+	return socketRequest{
+		sessionId:   sessionId,
+		rejoinToken: r.URL.Query().Get("rejoinToken"),
+		claims:      claims,
+	}, nil
+}
+
+// writeProblem is errorHandler of net/http requests, it returns status written.
+func writeProblem(w http.ResponseWriter, r *http.Request, logger *slog.Logger, err error) int {
+	problem, internal := problemOf(err, r.URL.RequestURI())
+	if internal {
+		// path only, query may carry a join token
+		logger.Error("Request failed", "method", r.Method, "path", r.URL.Path, logging.Err(err))
+	}
+	w.Header().Set(fiber.HeaderContentType, problemContentType)
+	w.WriteHeader(problem.Status)
+	_ = json.NewEncoder(w).Encode(problem)
+	return problem.Status
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"context"
+
+	"github.com/gofiber/contrib/websocket"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+	"github.com/valyala/fasthttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/dwilkolek/browse-together-api/tracing"
+)
+
+// traceContextLocal holds context of request span, websocket handlers run after
+// the request span ended and continue its trace.
+const traceContextLocal = "traceContext"
+
+// traceRequests starts span of every request continuing trace context from its headers.
+func traceRequests(c *fiber.Ctx) error {
+	// fiber strings point to buffers reused by following requests, spans outlive them
+	method := utils.CopyString(c.Method())
+	ctx := otel.GetTextMapPropagator().Extract(c.Context(), headerCarrier{&c.Request().Header})
+	ctx, span := tracing.Tracer.Start(ctx, method,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(semconv.HTTPMethod(method)))
+	defer span.End()
+	c.SetUserContext(ctx)
+	c.Locals(traceContextLocal, ctx)
+
+	err := c.Next()
+
+	// route is known once handler ran
+	span.SetName(method + " " + c.Route().Path)
+	span.SetAttributes(semconv.HTTPRoute(c.Route().Path))
+	status := c.Response().StatusCode()
+	if err != nil {
+		// error handler runs after middlewares, response doesn't have its status yet
+		problem, _ := problemOf(err, "")
+		status = problem.Status
+	}
+	span.SetAttributes(semconv.HTTPStatusCode(status))
+	if status >= fiber.StatusInternalServerError {
+		span.SetStatus(codes.Error, "")
+		if err != nil {
+			span.RecordError(err)
+		}
+	}
+	return err
+}
+
+// connTraceContext returns context of the upgrade request span stored by traceRequests.
+func connTraceContext(c *websocket.Conn) context.Context {
+	if ctx, ok := c.Locals(traceContextLocal).(context.Context); ok {
+		return ctx
+	}
+	return context.Background()
+}
+
+type headerCarrier struct {
+	header *fasthttp.RequestHeader
+}
+
+func (h headerCarrier) Get(key string) string {
+	return string(h.header.Peek(key))
+}
+
+func (h headerCarrier) Set(key string, value string) {
+	h.header.Set(key, value)
+}
+
+func (h headerCarrier) Keys() []string {
+	var keys []string
+	h.header.VisitAll(func(key, _ []byte) {
+		keys = append(keys, string(key))
+	})
+	return keys
+}
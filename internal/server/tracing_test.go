@@ -0,0 +1,142 @@
+package server
+
+import (
+	"context"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/dwilkolek/browse-together-api/client"
+	"github.com/dwilkolek/browse-together-api/dto"
+	"github.com/dwilkolek/browse-together-api/tracing"
+)
+
+// spanRecorder is installed once, global tracer keeps delegating to the first
+// provider installed. Spans of all tests accumulate in it.
+var spanRecorder = sync.OnceValue(func() *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	tracing.Install(recorder)
+	return recorder
+})
+
+func TestTraceRequest(t *testing.T) {
+	recorder := spanRecorder()
+	s := newTestServer(t)
+	req := httptest.NewRequest(fiber.MethodGet, "/api/v1/sessions/unknown", nil)
+	parent := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{0x0a, 0xf7, 1},
+		SpanID:     trace.SpanID{0xb7, 0xad, 1},
+		TraceFlags: trace.FlagsSampled,
+	})
+	req.Header.Set("traceparent", "00-"+parent.TraceID().String()+"-"+parent.SpanID().String()+"-01")
+	if _, err := s.App.Test(req); err != nil {
+		t.Fatal(err)
+	}
+
+	span := waitForSpan(t, recorder, "GET /api/v1/sessions/:id", func(span sdktrace.ReadOnlySpan) bool {
+		return span.Parent().TraceID() == parent.TraceID()
+	})
+	if span.SpanKind() != trace.SpanKindServer {
+		t.Errorf("span kind %s", span.SpanKind())
+	}
+	if span.Parent().SpanID() != parent.SpanID() || !span.Parent().IsRemote() {
+		t.Errorf("parent %v, expected span of traceparent header", span.Parent())
+	}
+	expectAttribute(t, span, semconv.HTTPRoute("/api/v1/sessions/:id"))
+	expectAttribute(t, span, semconv.HTTPStatusCode(fiber.StatusNotFound))
+}
+
+func TestTraceSocketAndBroadcast(t *testing.T) {
+	recorder := spanRecorder()
+	s := newTestServer(t)
+	session := createSession(t, s)
+	socketServer := httptest.NewServer(s.SocketHandler())
+	defer socketServer.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := client.New(socketServer.URL).Connect(ctx, session.Id, session.JoinToken.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := conn.Move(dto.UpdatePositionCmdDTO{X: 0.5, Y: 0.5, Selector: "#a", Location: "https://example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	for moved := false; !moved; {
+		select {
+		case positions := <-conn.Snapshots():
+			moved = len(positions) == 1
+		case <-ctx.Done():
+			t.Fatal("position wasn't broadcast")
+		}
+	}
+	inSession := func(span sdktrace.ReadOnlySpan) bool {
+		return hasAttribute(span, tracing.SessionIdKey.String(session.Id))
+	}
+
+	received := waitForSpan(t, recorder, "position received", inSession)
+	expectAttribute(t, received, tracing.MemberIdKey.Int64(conn.MemberId()))
+	if received.Parent().IsValid() || len(received.Links()) != 1 {
+		t.Errorf("position received has parent %v and links %v, expected a root linking the connection", received.Parent(), received.Links())
+	}
+	waitForSpan(t, recorder, "broadcast", func(span sdktrace.ReadOnlySpan) bool {
+		for _, link := range span.Links() {
+			if link.SpanContext.SpanID() == received.SpanContext().SpanID() {
+				return inSession(span)
+			}
+		}
+		return false
+	})
+
+	conn.Close()
+	connection := waitForSpan(t, recorder, "websocket connection", inSession)
+	expectAttribute(t, connection, tracing.MemberIdKey.Int64(conn.MemberId()))
+	if received.Links()[0].SpanContext.SpanID() != connection.SpanContext().SpanID() {
+		t.Errorf("position received links %v, expected connection", received.Links()[0].SpanContext)
+	}
+	upgrade := waitForSpan(t, recorder, "GET "+socketRoute, func(span sdktrace.ReadOnlySpan) bool {
+		return span.SpanContext().SpanID() == connection.Parent().SpanID()
+	})
+	expectAttribute(t, upgrade, semconv.HTTPStatusCode(fiber.StatusSwitchingProtocols))
+}
+
+// waitForSpan returns span named name that matches, spans can be ended by goroutines of the server.
+func waitForSpan(t *testing.T, recorder *tracetest.SpanRecorder, name string, matches func(span sdktrace.ReadOnlySpan) bool) sdktrace.ReadOnlySpan {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		for _, span := range recorder.Ended() {
+			if span.Name() == name && matches(span) {
+				return span
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no %q span ended", name)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func hasAttribute(span sdktrace.ReadOnlySpan, expected attribute.KeyValue) bool {
+	for _, attr := range span.Attributes() {
+		if attr == expected {
+			return true
+		}
+	}
+	return false
+}
+
+func expectAttribute(t *testing.T, span sdktrace.ReadOnlySpan, expected attribute.KeyValue) {
+	t.Helper()
+	if !hasAttribute(span, expected) {
+		t.Errorf("%q has attributes %v, expected %s=%s", span.Name(), span.Attributes(), expected.Key, expected.Value.Emit())
+	}
+}
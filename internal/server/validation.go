@@ -0,0 +1,129 @@
+package server
+
+import (
+	"encoding/json"
+	"net/url"
+	"slices"
+	"time"
+	"unicode/utf8"
+
+	"github.com/dwilkolek/browse-together-api/config"
+)
+
+const maxNameLength = 128
+const maxCreatorLength = 128
+const maxUrlLength = 2048
+const maxTags = 20
+const maxTagLength = 64
+const maxAttributesSize = 16 << 10
+
+// validate allows sessions living up to maxSessionLifetime.
+func (cmd CreateSessionV1Cmd) validate(maxSessionLifetime time.Duration) error {
+	errs := &validationError{}
+	validateName(errs, cmd.Name)
+	validateBaseLocation(errs, cmd.BaseLocation)
+	validateCreator(errs, cmd.Creator)
+	if cmd.TickRate < 0 || cmd.TickRate > config.MaxTickRate {
+		errs.add("tickRate", "must be between 1 and %d, or 0 for the default", config.MaxTickRate)
+	}
+	maxLifetime := cmd.maxLifetime(maxSessionLifetime)
+	if maxLifetime <= 0 || maxLifetime > maxSessionLifetime {
+		errs.add("maxLifetimeSeconds", "must be between 1 and %d, or 0 for the default", int(maxSessionLifetime.Seconds()))
+	}
+	if cmd.IdleTimeoutSeconds < 0 || time.Duration(cmd.IdleTimeoutSeconds)*time.Second > maxLifetime {
+		errs.add("idleTimeoutSeconds", "must be between 1 and maxLifetimeSeconds, or 0 for the default")
+	}
+	if len(cmd.Tags) > maxTags {
+		errs.add("tags", "at most %d tags are allowed", maxTags)
+	}
+	for _, tag := range cmd.Tags {
+		if tag == "" || utf8.RuneCountInString(tag) > maxTagLength {
+			errs.add("tags", "must have between 1 and %d characters", maxTagLength)
+			break
+		}
+	}
+	if cmd.MaxMembers < 0 {
+		errs.add("maxMembers", "can't be negative")
+	}
+	if len(cmd.Attributes) > maxAttributesSize {
+		errs.add("attributes", "can't exceed %d bytes", maxAttributesSize)
+	} else if len(cmd.Attributes) > 0 && string(cmd.Attributes) != "null" {
+		var attributes map[string]any
+		if err := json.Unmarshal(cmd.Attributes, &attributes); err != nil {
+			errs.add("attributes", "must be a JSON object")
+		}
+	}
+	return errs.orNil()
+}
+
+// maxLifetime falls back to defaultLifetime.
+func (cmd CreateSessionV1Cmd) maxLifetime(defaultLifetime time.Duration) time.Duration {
+	if cmd.MaxLifetimeSeconds != 0 {
+		return time.Duration(cmd.MaxLifetimeSeconds) * time.Second
+	}
+	return defaultLifetime
+}
+
+// updatableFields are the fields of a session PATCH may change, the rest is fixed at creation.
+var updatableFields = map[string]bool{"name": true, "baseLocation": true, "creator": true, "version": true}
+
+// validateUpdatedFields rejects fields of PATCH body that can't be changed, instead of
+// silently ignoring them. Body that isn't a JSON object was already rejected by parseBody.
+func validateUpdatedFields(body []byte) error {
+	var fields map[string]json.RawMessage
+	if len(body) == 0 || json.Unmarshal(body, &fields) != nil {
+		return nil
+	}
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		if !updatableFields[name] {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	errs := &validationError{}
+	for _, name := range names {
+		errs.add(name, "can't be changed")
+	}
+	return errs.orNil()
+}
+
+func (cmd UpdateSessionV1Cmd) validate() error {
+	errs := &validationError{}
+	if cmd.Name != nil {
+		validateName(errs, *cmd.Name)
+	}
+	if cmd.BaseLocation != nil {
+		validateBaseLocation(errs, *cmd.BaseLocation)
+	}
+	if cmd.Creator != nil {
+		validateCreator(errs, *cmd.Creator)
+	}
+	if cmd.Version < 0 {
+		errs.add("version", "can't be negative")
+	}
+	return errs.orNil()
+}
+
+func validateName(errs *validationError, name string) {
+	if name == "" || utf8.RuneCountInString(name) > maxNameLength {
+		errs.add("name", "must have between 1 and %d characters", maxNameLength)
+	}
+}
+
+func validateCreator(errs *validationError, creator string) {
+	if utf8.RuneCountInString(creator) > maxCreatorLength {
+		errs.add("creator", "can't exceed %d characters", maxCreatorLength)
+	}
+}
+
+func validateBaseLocation(errs *validationError, baseLocation string) {
+	if len(baseLocation) > maxUrlLength {
+		errs.add("baseLocation", "can't exceed %d characters", maxUrlLength)
+		return
+	}
+	location, err := url.ParseRequestURI(baseLocation)
+	if err != nil || (location.Scheme != "http" && location.Scheme != "https") || location.Host == "" {
+		errs.add("baseLocation", "must be an absolute http(s) URL")
+	}
+}
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCreateSessionDefaults(t *testing.T) {
+	cmd := CreateSessionV1Cmd{Name: "test", BaseLocation: "https://example.com"}
+	if err := cmd.validate(time.Hour); err != nil {
+		t.Errorf("zero tickRate, maxLifetimeSeconds and idleTimeoutSeconds rejected: %v", err)
+	}
+}
+
+func TestCreateSessionRejects(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(cmd *CreateSessionV1Cmd)
+		param  string
+	}{
+		{"negative tick rate", func(cmd *CreateSessionV1Cmd) { cmd.TickRate = -1 }, "tickRate"},
+		{"tick rate too high", func(cmd *CreateSessionV1Cmd) { cmd.TickRate = 1001 }, "tickRate"},
+		{"negative lifetime", func(cmd *CreateSessionV1Cmd) { cmd.MaxLifetimeSeconds = -1 }, "maxLifetimeSeconds"},
+		{"lifetime too long", func(cmd *CreateSessionV1Cmd) { cmd.MaxLifetimeSeconds = 3601 }, "maxLifetimeSeconds"},
+		{"negative idle timeout", func(cmd *CreateSessionV1Cmd) { cmd.IdleTimeoutSeconds = -1 }, "idleTimeoutSeconds"},
+		{"idle timeout over lifetime", func(cmd *CreateSessionV1Cmd) { cmd.MaxLifetimeSeconds = 60; cmd.IdleTimeoutSeconds = 61 }, "idleTimeoutSeconds"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cmd := CreateSessionV1Cmd{Name: "test", BaseLocation: "https://example.com"}
+			test.change(&cmd)
+			var validationErr *validationError
+			if err := cmd.validate(time.Hour); !errors.As(err, &validationErr) {
+				t.Fatalf("expected validation error, got %v", err)
+			}
+			if validationErr.params[0].Name != test.param {
+				t.Fatalf("invalid params %+v, expected %s", validationErr.params, test.param)
+			}
+			if reason := validationErr.params[0].Reason; !strings.Contains(reason, "0 for the default") {
+				t.Errorf("reason %q doesn't tell 0 means default", reason)
+			}
+		})
+	}
+}
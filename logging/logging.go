@@ -0,0 +1,89 @@
+// Package logging configures log/slog and defines attribute keys shared by all packages,
+// so logs of one session, member or request can be filtered across instances.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"regexp"
+	"strings"
+)
+
+const (
+	SessionIdKey = "sessionId"
+	MemberIdKey  = "memberId"
+	RequestIdKey = "requestId"
+	ErrorKey     = "error"
+)
+
+const redacted = "[REDACTED]"
+
+// secretKeys are attributes whose values never reach logs, compared case-insensitively.
+var secretKeys = map[string]bool{
+	"token":         true,
+	"jointoken":     true,
+	"rejointoken":   true,
+	"hosttoken":     true,
+	"ownersecret":   true,
+	"secret":        true,
+	"password":      true,
+	"authorization": true,
+	"redisurl":      true,
+}
+
+// urlCredentials and tokenParam find secrets in URLs that ended up in messages, errors or
+// other attributes, e.g. an error of a Redis client repeating REDIS_URL.
+var urlCredentials = regexp.MustCompile(`://[^/@\s"]+@`)
+var tokenParam = regexp.MustCompile(`([?&](?i:token|jointoken|rejointoken)=)[^&#\s"]+`)
+
+// ParseLevel accepts debug, info, warn and error.
+func ParseLevel(level string) (slog.Level, error) {
+	var parsed slog.Level
+	err := parsed.UnmarshalText([]byte(level))
+	return parsed, err
+}
+
+// NewHandler returns handler writing in json or text format, redacting secrets.
+func NewHandler(w io.Writer, level slog.Level, format string) (slog.Handler, error) {
+	options := &slog.HandlerOptions{Level: level, ReplaceAttr: redact}
+	switch strings.ToLower(format) {
+	case "json":
+		return slog.NewJSONHandler(w, options), nil
+	case "text":
+		return slog.NewTextHandler(w, options), nil
+	}
+	return nil, fmt.Errorf("unknown log format %s", format)
+}
+
+func redact(_ []string, attr slog.Attr) slog.Attr {
+	if secretKeys[strings.ToLower(attr.Key)] {
+		return slog.String(attr.Key, redacted)
+	}
+	var text string
+	switch value := attr.Value.Any().(type) {
+	case string:
+		text = value
+	case error:
+		text = value.Error()
+	default:
+		return attr
+	}
+	if clean := redactURLs(text); clean != text {
+		return slog.String(attr.Key, clean)
+	}
+	return attr
+}
+
+func redactURLs(text string) string {
+	if !strings.Contains(text, "://") && !strings.Contains(strings.ToLower(text), "token=") {
+		return text
+	}
+	text = urlCredentials.ReplaceAllString(text, "://"+redacted+"@")
+	return tokenParam.ReplaceAllString(text, "${1}"+redacted)
+}
+
+// Err is attribute of an error.
+func Err(err error) slog.Attr {
+	return slog.Any(ErrorKey, err)
+}
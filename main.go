@@ -1,30 +1,95 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
+	"os/signal"
+	"syscall"
 
+	"github.com/redis/go-redis/v9"
+
+	"github.com/dwilkolek/browse-together-api/clients"
+	"github.com/dwilkolek/browse-together-api/config"
 	"github.com/dwilkolek/browse-together-api/db"
 	"github.com/dwilkolek/browse-together-api/internal/server"
+	"github.com/dwilkolek/browse-together-api/logging"
+	"github.com/dwilkolek/browse-together-api/queue"
+	"github.com/dwilkolek/browse-together-api/streaming"
+	"github.com/dwilkolek/browse-together-api/tracing"
 )
 
 func main() {
-	log.SetOutput(os.Stdout)
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	cfg, err := config.Load(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		slog.Error("Invalid configuration", logging.Err(err))
+		os.Exit(1)
 	}
-	env := os.Getenv("ENV")
-	if env == "" {
-		env = "prod"
+	handler, err := logging.NewHandler(os.Stdout, cfg.LogLevel, cfg.LogFormat)
+	if err != nil {
+		slog.Error("Invalid configuration", logging.Err(err))
+		os.Exit(1)
+	}
+	slog.SetDefault(slog.New(handler))
+	if cfg.RandomAuthSecret {
+		slog.Warn("AUTH_SECRET not set, using random secret. Join tokens won't work across instances.")
 	}
 
-	db.GetDb()
+	var redisClient *redis.Client
+	if cfg.UsesRedis() {
+		if redisClient, err = clients.NewRedisClient(cfg.RedisURL); err != nil {
+			slog.Error("Failed to create redis client", logging.Err(err))
+			os.Exit(1)
+		}
+	}
+	store, err := db.Open(cfg, redisClient)
+	if err != nil {
+		slog.Error("Failed to open storage", logging.Err(err))
+		os.Exit(1)
+	}
+	queues, err := queue.NewFactory(cfg, redisClient)
+	if err != nil {
+		slog.Error("Failed to create queue", logging.Err(err))
+		os.Exit(1)
+	}
+	sessions := streaming.NewRegistry(cfg, queues)
 
-	log.Printf("Running %s mode on port %s", env, port)
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.OtelTracesExporter)
+	if err != nil {
+		slog.Error("Failed to set up tracing", logging.Err(err))
+		os.Exit(1)
+	}
 
-	srv := server.New()
+	slog.Info("Running", "env", cfg.Env, "port", cfg.Port)
 
-	log.Fatal(srv.Listen(fmt.Sprintf(":%s", port)))
+	srv := server.New(cfg, store, sessions, server.Options{})
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	go sessions.RunJanitor(ctx, store, cfg.Session.JanitorInterval)
+
+	go func() {
+		if err := srv.Listen(fmt.Sprintf(":%d", cfg.Port)); err != nil {
+			slog.Error("Listen failed", logging.Err(err))
+			os.Exit(1)
+		}
+	}()
+
+	<-ctx.Done()
+
+	slog.Info("Shutting down, draining sessions", "timeout", cfg.ShutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		slog.Error("Shutdown failed", logging.Err(err))
+	}
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		slog.Error("Flushing spans failed", logging.Err(err))
+	}
 }
@@ -0,0 +1,79 @@
+// Package metrics holds Prometheus collectors of the server, served at /metrics.
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "browse_together"
+
+var PositionUpdates = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "position_updates_received_total",
+	Help:      "Position updates received from members connected to this instance.",
+})
+
+// FramesBroadcast is labeled by kind, snapshot or delta.
+var FramesBroadcast = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "frames_broadcast_total",
+	Help:      "Position frames queued for members by the broadcast loop.",
+}, []string{"kind"})
+
+var BroadcastDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+	Namespace: namespace,
+	Name:      "broadcast_duration_seconds",
+	Help:      "Time spent fanning out changes of a session to its members.",
+	Buckets:   prometheus.ExponentialBuckets(0.00001, 4, 10),
+})
+
+var PubSubLatency = promauto.NewHistogram(prometheus.HistogramOpts{
+	Namespace: namespace,
+	Name:      "redis_pubsub_latency_seconds",
+	Help:      "Time between a position update being received by an instance and delivered over Redis pub/sub.",
+	Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 12),
+})
+
+var FramesDropped = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "frames_dropped_total",
+	Help:      "Frames dropped because write queue of a member was full.",
+})
+
+// MemberEventsDropped is labeled by kind, role, kick, presence or session.
+var MemberEventsDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "member_events_dropped_total",
+	Help:      "Role changes, kicks, presence and session updates dropped because the session didn't keep up.",
+}, []string{"kind"})
+
+var UnresponsiveMembers = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "unresponsive_members_total",
+	Help:      "Members disconnected because they didn't read frames in time.",
+})
+
+var WriteErrors = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "member_write_errors_total",
+	Help:      "Failed writes to member connections.",
+})
+
+// ObserveSessions registers gauges of sessions and members connected to this instance.
+func ObserveSessions(sessions func() int, members func() int) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "active_sessions",
+		Help:      "Sessions with members connected to this instance.",
+	}, func() float64 {
+		return float64(sessions())
+	})
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "connected_members",
+		Help:      "Members connected to this instance.",
+	}, func() float64 {
+		return float64(members())
+	})
+}
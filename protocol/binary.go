@@ -0,0 +1,387 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	"github.com/dwilkolek/browse-together-api/dto"
+)
+
+// Binary frames start with a frame type byte followed by varint encoded fields.
+// Strings that repeat between frames (identifiers, selectors, locations) are
+// interned: each direction keeps its own table, a string is sent once together
+// with its id and referenced by that id afterwards. Id 0 is the empty string.
+//
+//	hello:    0x01 memberId:uvarint rejoinToken:string role:string members:count:uvarint {member}*
+//	snapshot: 0x02 flags:byte entries:table states
+//	delta:    0x03 flags:byte entries:table added:states moved:states removed:count:uvarint {memberId:uvarint}*
+//	presence: 0x04 type:byte member
+//	error:    0x05 code:string message:string
+//	close:    0x06 reason:string rejoinToken:string
+//	session:  0x07 version:uvarint name:string baseUrl:string creatorIdentifier:string tickRate:uvarint expiresAt:varint idleTimeoutSeconds:uvarint
+//	identify: 0x10 identifier:string
+//	position: 0x11 flags:byte entries:table x:varint y:varint selector:ref location:ref
+//
+// states is count:uvarint followed by
+// {memberId:uvarint identifier:ref x:varint y:varint selector:ref location:ref updatedAt:varint}*,
+// member is memberId:uvarint identifier:string role:string joinedAt:varint lastActivityAt:varint state:byte,
+// presence type is 1 joined, 2 left, 3 renamed and state is 1 connected, 2 disconnected.
+// table is count:uvarint followed by {id:uvarint value:string}*, string is
+// length:uvarint followed by utf-8 bytes. Coordinates are scaled by 10^4.
+const (
+	frameHello    byte = 0x01
+	frameSnapshot byte = 0x02
+	frameDelta    byte = 0x03
+	framePresence byte = 0x04
+	frameError    byte = 0x05
+	frameClose    byte = 0x06
+	frameSession  byte = 0x07
+	frameIdentify byte = 0x10
+	framePosition byte = 0x11
+)
+
+// flagTableReset tells the receiver to drop its table before applying entries.
+const flagTableReset byte = 0x01
+
+var presenceTypes = map[string]byte{dto.PresenceJoined: 1, dto.PresenceLeft: 2, dto.PresenceRenamed: 3}
+var memberStates = map[string]byte{dto.MemberConnected: 1, dto.MemberDisconnected: 2}
+
+const maxTableSize = 4096
+const maxStringLength = 8192
+const coordinateScale = 10000
+
+type BinaryCodec struct {
+	out *internTable
+	in  map[uint64]string
+}
+
+func NewBinaryCodec() *BinaryCodec {
+	return &BinaryCodec{
+		out: newInternTable(),
+		in:  make(map[uint64]string),
+	}
+}
+
+func (c *BinaryCodec) Subprotocol() string {
+	return SubprotocolBinary
+}
+
+func (c *BinaryCodec) EncodeHello(hello dto.HelloDTO) (Frame, error) {
+	buf := []byte{frameHello}
+	buf = binary.AppendUvarint(buf, uint64(hello.MemberId))
+	buf = appendString(buf, hello.RejoinToken)
+	buf = appendString(buf, hello.Role)
+	buf = binary.AppendUvarint(buf, uint64(len(hello.Members)))
+	for _, member := range hello.Members {
+		buf = appendMember(buf, member)
+	}
+	return Frame{MessageType: BinaryMessage, Data: buf}, nil
+}
+
+func (c *BinaryCodec) EncodeError(e dto.ErrorDTO) (Frame, error) {
+	buf := []byte{frameError}
+	buf = appendString(buf, e.Code)
+	buf = appendString(buf, e.Message)
+	return Frame{MessageType: BinaryMessage, Data: buf}, nil
+}
+
+func (c *BinaryCodec) EncodeClose(closeMsg dto.CloseDTO) (Frame, error) {
+	buf := []byte{frameClose}
+	buf = appendString(buf, closeMsg.Reason)
+	buf = appendString(buf, closeMsg.RejoinToken)
+	return Frame{MessageType: BinaryMessage, Data: buf}, nil
+}
+
+func (c *BinaryCodec) EncodeSessionUpdated(session dto.SessionDTO) (Frame, error) {
+	buf := []byte{frameSession}
+	buf = binary.AppendUvarint(buf, uint64(session.Version))
+	buf = appendString(buf, session.Name)
+	buf = appendString(buf, session.BaseUrl)
+	buf = appendString(buf, session.CreatorIdentifier)
+	buf = binary.AppendUvarint(buf, uint64(session.TickRate))
+	buf = binary.AppendVarint(buf, session.ExpiresAt)
+	buf = binary.AppendUvarint(buf, uint64(session.IdleTimeoutSeconds))
+	return Frame{MessageType: BinaryMessage, Data: buf}, nil
+}
+
+func (c *BinaryCodec) SupportsDelta() bool {
+	return true
+}
+
+func (c *BinaryCodec) EncodeSnapshot(states []dto.PositionStateDTO) (Frame, error) {
+	flags, entries := c.out.prepare(internedStrings(states))
+
+	buf := []byte{frameSnapshot, flags}
+	buf = appendEntries(buf, entries)
+	buf = c.appendStates(buf, states)
+	return Frame{MessageType: BinaryMessage, Data: buf}, nil
+}
+
+func (c *BinaryCodec) EncodeDelta(delta dto.PositionDeltaDTO) (Frame, error) {
+	flags, entries := c.out.prepare(append(internedStrings(delta.Added), internedStrings(delta.Moved)...))
+
+	buf := []byte{frameDelta, flags}
+	buf = appendEntries(buf, entries)
+	buf = c.appendStates(buf, delta.Added)
+	buf = c.appendStates(buf, delta.Moved)
+	buf = binary.AppendUvarint(buf, uint64(len(delta.Removed)))
+	for _, memberId := range delta.Removed {
+		buf = binary.AppendUvarint(buf, uint64(memberId))
+	}
+	return Frame{MessageType: BinaryMessage, Data: buf}, nil
+}
+
+func (c *BinaryCodec) EncodePresence(event dto.PresenceEventDTO) (Frame, error) {
+	presenceType, ok := presenceTypes[event.Type]
+	if !ok {
+		return Frame{}, fmt.Errorf("unknown presence type %s", event.Type)
+	}
+	buf := appendMember([]byte{framePresence, presenceType}, event.Member)
+	return Frame{MessageType: BinaryMessage, Data: buf}, nil
+}
+
+func appendMember(buf []byte, member dto.MemberDTO) []byte {
+	buf = binary.AppendUvarint(buf, uint64(member.MemberId))
+	buf = appendString(buf, member.GivenIdentifier)
+	buf = appendString(buf, member.Role)
+	buf = binary.AppendVarint(buf, member.JoinedAt)
+	buf = binary.AppendVarint(buf, member.LastActivityAt)
+	return append(buf, memberStates[member.State])
+}
+
+func (c *BinaryCodec) appendStates(buf []byte, states []dto.PositionStateDTO) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(states)))
+	for _, state := range states {
+		buf = binary.AppendUvarint(buf, uint64(state.MemberId))
+		buf = binary.AppendUvarint(buf, c.out.ids[state.GivenIdentifier])
+		buf = binary.AppendVarint(buf, encodeCoordinate(state.X))
+		buf = binary.AppendVarint(buf, encodeCoordinate(state.Y))
+		buf = binary.AppendUvarint(buf, c.out.ids[state.Selector])
+		buf = binary.AppendUvarint(buf, c.out.ids[state.Location])
+		buf = binary.AppendVarint(buf, state.UpdatedAt)
+	}
+	return buf
+}
+
+func internedStrings(states []dto.PositionStateDTO) []string {
+	strs := make([]string, 0, len(states)*3)
+	for _, state := range states {
+		strs = append(strs, state.GivenIdentifier, state.Selector, state.Location)
+	}
+	return strs
+}
+
+func (c *BinaryCodec) Reset() {
+	c.out = newInternTable()
+	c.out.resetPending = true
+}
+
+func (c *BinaryCodec) Decode(messageType int, data []byte) (ClientMessage, error) {
+	if messageType != BinaryMessage {
+		return ClientMessage{}, malformed("expected binary message")
+	}
+	r := &reader{data: data}
+	frameType, err := r.byte()
+	if err != nil {
+		return ClientMessage{}, err
+	}
+
+	switch frameType {
+	case frameIdentify:
+		identifier, err := r.string()
+		if err != nil {
+			return ClientMessage{}, err
+		}
+		return validate(ClientMessage{Kind: Identify, Identifier: identifier})
+	case framePosition:
+		if err := c.readEntries(r); err != nil {
+			return ClientMessage{}, err
+		}
+		var position dto.UpdatePositionCmdDTO
+		if position.X, err = r.coordinate(); err != nil {
+			return ClientMessage{}, err
+		}
+		if position.Y, err = r.coordinate(); err != nil {
+			return ClientMessage{}, err
+		}
+		if position.Selector, err = c.readRef(r); err != nil {
+			return ClientMessage{}, err
+		}
+		if position.Location, err = c.readRef(r); err != nil {
+			return ClientMessage{}, err
+		}
+		return validate(ClientMessage{Kind: Position, Position: position})
+	}
+
+	return ClientMessage{}, errorf(dto.ErrorUnknownType, "unknown frame type 0x%02x", frameType)
+}
+
+func (c *BinaryCodec) readEntries(r *reader) error {
+	flags, err := r.byte()
+	if err != nil {
+		return err
+	}
+	if flags&flagTableReset != 0 {
+		c.in = make(map[uint64]string)
+	}
+	count, err := r.uvarint()
+	if err != nil {
+		return err
+	}
+	for i := uint64(0); i < count; i++ {
+		id, err := r.uvarint()
+		if err != nil {
+			return err
+		}
+		value, err := r.string()
+		if err != nil {
+			return err
+		}
+		if id == 0 {
+			return malformed("table id 0 is reserved")
+		}
+		c.in[id] = value
+		if len(c.in) > maxTableSize {
+			return malformed("string table exceeds %d entries", maxTableSize)
+		}
+	}
+	return nil
+}
+
+func (c *BinaryCodec) readRef(r *reader) (string, error) {
+	id, err := r.uvarint()
+	if err != nil {
+		return "", err
+	}
+	if id == 0 {
+		return "", nil
+	}
+	value, ok := c.in[id]
+	if !ok {
+		return "", malformed("unknown string ref %d", id)
+	}
+	return value, nil
+}
+
+type tableEntry struct {
+	id    uint64
+	value string
+}
+
+type internTable struct {
+	ids          map[string]uint64
+	next         uint64
+	resetPending bool
+}
+
+func newInternTable() *internTable {
+	return &internTable{ids: map[string]uint64{"": 0}, next: 1}
+}
+
+// prepare interns all strs, resetting the table first when they wouldn't fit.
+// It returns the frame flags and the entries the receiver doesn't know yet.
+func (t *internTable) prepare(strs []string) (byte, []tableEntry) {
+	missing := make(map[string]bool)
+	for _, s := range strs {
+		if _, ok := t.ids[s]; !ok {
+			missing[s] = true
+		}
+	}
+
+	var flags byte
+	if len(t.ids)+len(missing) > maxTableSize {
+		*t = *newInternTable()
+		t.resetPending = true
+	}
+	if t.resetPending {
+		t.resetPending = false
+		flags |= flagTableReset
+	}
+
+	var entries []tableEntry
+	for _, s := range strs {
+		if _, ok := t.ids[s]; !ok {
+			entries = append(entries, t.add(s))
+		}
+	}
+	return flags, entries
+}
+
+func (t *internTable) add(s string) tableEntry {
+	id := t.next
+	t.next++
+	t.ids[s] = id
+	return tableEntry{id: id, value: s}
+}
+
+func appendEntries(buf []byte, entries []tableEntry) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(entries)))
+	for _, entry := range entries {
+		buf = binary.AppendUvarint(buf, entry.id)
+		buf = appendString(buf, entry.value)
+	}
+	return buf
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+func encodeCoordinate(v float64) int64 {
+	return int64(math.Round(v * coordinateScale))
+}
+
+type reader struct {
+	data []byte
+	pos  int
+}
+
+func (r *reader) byte() (byte, error) {
+	if r.pos >= len(r.data) {
+		return 0, malformed("unexpected end of frame")
+	}
+	b := r.data[r.pos]
+	r.pos++
+	return b, nil
+}
+
+func (r *reader) uvarint() (uint64, error) {
+	v, n := binary.Uvarint(r.data[r.pos:])
+	if n <= 0 {
+		return 0, malformed("invalid uvarint")
+	}
+	r.pos += n
+	return v, nil
+}
+
+func (r *reader) varint() (int64, error) {
+	v, n := binary.Varint(r.data[r.pos:])
+	if n <= 0 {
+		return 0, malformed("invalid varint")
+	}
+	r.pos += n
+	return v, nil
+}
+
+func (r *reader) coordinate() (float64, error) {
+	v, err := r.varint()
+	if err != nil {
+		return 0, err
+	}
+	return float64(v) / coordinateScale, nil
+}
+
+func (r *reader) string() (string, error) {
+	length, err := r.uvarint()
+	if err != nil {
+		return "", err
+	}
+	if length > maxStringLength || length > uint64(len(r.data)-r.pos) {
+		return "", malformed("invalid string length %d", length)
+	}
+	s := string(r.data[r.pos : r.pos+int(length)])
+	r.pos += int(length)
+	return s, nil
+}
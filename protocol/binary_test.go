@@ -0,0 +1,378 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/dwilkolek/browse-together-api/dto"
+)
+
+// clientTable decodes server frames the way clients do, keeping the interned strings.
+type clientTable struct {
+	strings map[uint64]string
+}
+
+func newClientTable() *clientTable {
+	return &clientTable{strings: map[uint64]string{0: ""}}
+}
+
+// entries applies table of a frame and returns its flags and number of entries.
+func (c *clientTable) entries(r *reader) (byte, int, error) {
+	flags, err := r.byte()
+	if err != nil {
+		return 0, 0, err
+	}
+	if flags&flagTableReset != 0 {
+		c.strings = map[uint64]string{0: ""}
+	}
+	count, err := r.uvarint()
+	if err != nil {
+		return 0, 0, err
+	}
+	for i := uint64(0); i < count; i++ {
+		id, err := r.uvarint()
+		if err != nil {
+			return 0, 0, err
+		}
+		if c.strings[id], err = r.string(); err != nil {
+			return 0, 0, err
+		}
+	}
+	return flags, int(count), nil
+}
+
+func (c *clientTable) ref(r *reader) (string, error) {
+	id, err := r.uvarint()
+	if err != nil {
+		return "", err
+	}
+	s, ok := c.strings[id]
+	if !ok {
+		return "", fmt.Errorf("unknown ref %d", id)
+	}
+	return s, nil
+}
+
+func (c *clientTable) states(r *reader) ([]dto.PositionStateDTO, error) {
+	count, err := r.uvarint()
+	if err != nil {
+		return nil, err
+	}
+	var states []dto.PositionStateDTO
+	for i := uint64(0); i < count; i++ {
+		var state dto.PositionStateDTO
+		memberId, err := r.uvarint()
+		if err != nil {
+			return nil, err
+		}
+		state.MemberId = int64(memberId)
+		if state.GivenIdentifier, err = c.ref(r); err != nil {
+			return nil, err
+		}
+		if state.X, err = r.coordinate(); err != nil {
+			return nil, err
+		}
+		if state.Y, err = r.coordinate(); err != nil {
+			return nil, err
+		}
+		if state.Selector, err = c.ref(r); err != nil {
+			return nil, err
+		}
+		if state.Location, err = c.ref(r); err != nil {
+			return nil, err
+		}
+		if state.UpdatedAt, err = r.varint(); err != nil {
+			return nil, err
+		}
+		states = append(states, state)
+	}
+	return states, nil
+}
+
+// snapshot decodes snapshot frame, returning its flags and number of table entries.
+func (c *clientTable) snapshot(t *testing.T, frame Frame) ([]dto.PositionStateDTO, byte, int) {
+	t.Helper()
+	r := &reader{data: frame.Data}
+	if frameType, _ := r.byte(); frameType != frameSnapshot {
+		t.Fatalf("frame type 0x%02x, expected snapshot", frameType)
+	}
+	flags, entries, err := c.entries(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	states, err := c.states(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.pos != len(r.data) {
+		t.Fatalf("%d trailing bytes", len(r.data)-r.pos)
+	}
+	return states, flags, entries
+}
+
+var testStates = []dto.PositionStateDTO{
+	{MemberId: 1, GivenIdentifier: "alice", X: 0.25, Y: -1, Selector: "#planet-1", Location: "https://example.com/a", UpdatedAt: 1700000000000},
+	{MemberId: 300, GivenIdentifier: "bob", X: 1.9999, Y: 0.5, Selector: "#planet-2", Location: "https://example.com/a", UpdatedAt: 1700000000001},
+}
+
+func TestBinarySnapshotRoundTrip(t *testing.T) {
+	codec := NewBinaryCodec()
+	client := newClientTable()
+
+	frame, err := codec.EncodeSnapshot(testStates)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frame.MessageType != BinaryMessage {
+		t.Fatalf("message type %d", frame.MessageType)
+	}
+	states, _, entries := client.snapshot(t, frame)
+	if !reflect.DeepEqual(states, testStates) {
+		t.Fatalf("decoded %+v, expected %+v", states, testStates)
+	}
+	// alice, bob, two selectors and the shared location
+	if entries != 5 {
+		t.Errorf("%d table entries, expected 5", entries)
+	}
+
+	frame, _ = codec.EncodeSnapshot(testStates)
+	states, flags, entries := client.snapshot(t, frame)
+	if entries != 0 || flags != 0 {
+		t.Errorf("repeated snapshot sent %d entries with flags %d", entries, flags)
+	}
+	if !reflect.DeepEqual(states, testStates) {
+		t.Fatalf("decoded %+v, expected %+v", states, testStates)
+	}
+}
+
+func TestBinaryDeltaRoundTrip(t *testing.T) {
+	codec := NewBinaryCodec()
+	client := newClientTable()
+	delta := dto.PositionDeltaDTO{
+		Added:   testStates[:1],
+		Moved:   testStates[1:],
+		Removed: []int64{7, 1 << 40},
+	}
+
+	frame, err := codec.EncodeDelta(delta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &reader{data: frame.Data}
+	if frameType, _ := r.byte(); frameType != frameDelta {
+		t.Fatalf("frame type 0x%02x, expected delta", frameType)
+	}
+	if _, _, err := client.entries(r); err != nil {
+		t.Fatal(err)
+	}
+	var decoded dto.PositionDeltaDTO
+	if decoded.Added, err = client.states(r); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Moved, err = client.states(r); err != nil {
+		t.Fatal(err)
+	}
+	count, err := r.uvarint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := uint64(0); i < count; i++ {
+		memberId, err := r.uvarint()
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded.Removed = append(decoded.Removed, int64(memberId))
+	}
+	if !reflect.DeepEqual(decoded, delta) {
+		t.Fatalf("decoded %+v, expected %+v", decoded, delta)
+	}
+}
+
+func TestBinaryResetResendsStrings(t *testing.T) {
+	codec := NewBinaryCodec()
+	client := newClientTable()
+	frame, _ := codec.EncodeSnapshot(testStates)
+	client.snapshot(t, frame)
+
+	// client missed frames, e.g. they were dropped from a full write queue
+	codec.Reset()
+	client.strings[1] = "stale"
+
+	frame, _ = codec.EncodeSnapshot(testStates)
+	states, flags, entries := client.snapshot(t, frame)
+	if flags&flagTableReset == 0 {
+		t.Error("frame after Reset doesn't reset table")
+	}
+	if entries != 5 {
+		t.Errorf("%d table entries after Reset, expected 5", entries)
+	}
+	if !reflect.DeepEqual(states, testStates) {
+		t.Fatalf("decoded %+v, expected %+v", states, testStates)
+	}
+
+	frame, _ = codec.EncodeSnapshot(testStates)
+	if _, flags, _ := client.snapshot(t, frame); flags != 0 {
+		t.Error("table was reset twice")
+	}
+}
+
+func TestBinaryTableOverflowResets(t *testing.T) {
+	codec := NewBinaryCodec()
+	client := newClientTable()
+	var resets int
+	for i := 0; i < maxTableSize; i++ {
+		state := dto.PositionStateDTO{MemberId: 1, Selector: fmt.Sprintf("#element-%d", i), Location: "https://example.com"}
+		frame, err := codec.EncodeSnapshot([]dto.PositionStateDTO{state})
+		if err != nil {
+			t.Fatal(err)
+		}
+		states, flags, _ := client.snapshot(t, frame)
+		if flags&flagTableReset != 0 {
+			resets++
+		}
+		if states[0].Selector != state.Selector {
+			t.Fatalf("decoded selector %q, expected %q", states[0].Selector, state.Selector)
+		}
+	}
+	if resets != 1 {
+		t.Errorf("table was reset %d times, expected once", resets)
+	}
+	if len(codec.out.ids) > maxTableSize {
+		t.Errorf("table has %d strings", len(codec.out.ids))
+	}
+}
+
+func TestBinaryHelloAndPresence(t *testing.T) {
+	codec := NewBinaryCodec()
+	member := dto.MemberDTO{MemberId: 2, GivenIdentifier: "bob", Role: "viewer", JoinedAt: 10, LastActivityAt: 20, State: dto.MemberConnected}
+
+	memberBytes := binary.AppendUvarint(nil, 2)
+	memberBytes = appendString(memberBytes, "bob")
+	memberBytes = appendString(memberBytes, "viewer")
+	memberBytes = binary.AppendVarint(memberBytes, 10)
+	memberBytes = binary.AppendVarint(memberBytes, 20)
+	memberBytes = append(memberBytes, 1)
+
+	frame, err := codec.EncodeHello(dto.HelloDTO{MemberId: 3, RejoinToken: "token", Role: "host", Members: []dto.MemberDTO{member}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []byte{frameHello, 3}
+	expected = appendString(expected, "token")
+	expected = appendString(expected, "host")
+	expected = append(append(expected, 1), memberBytes...)
+	if !reflect.DeepEqual(frame.Data, expected) {
+		t.Errorf("hello is % x, expected % x", frame.Data, expected)
+	}
+
+	frame, err = codec.EncodePresence(dto.PresenceEventDTO{Type: dto.PresenceLeft, Member: member})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = append([]byte{framePresence, 2}, memberBytes...)
+	if !reflect.DeepEqual(frame.Data, expected) {
+		t.Errorf("presence is % x, expected % x", frame.Data, expected)
+	}
+
+	if _, err := codec.EncodePresence(dto.PresenceEventDTO{Type: "unknown"}); err == nil {
+		t.Error("unknown presence type was encoded")
+	}
+}
+
+// positionFrame builds a position frame the way clients do.
+func positionFrame(flags byte, entries []tableEntry, x int64, y int64, selector uint64, location uint64) []byte {
+	buf := []byte{framePosition, flags}
+	buf = appendEntries(buf, entries)
+	buf = binary.AppendVarint(buf, x)
+	buf = binary.AppendVarint(buf, y)
+	buf = binary.AppendUvarint(buf, selector)
+	return binary.AppendUvarint(buf, location)
+}
+
+func TestBinaryDecodePosition(t *testing.T) {
+	codec := NewBinaryCodec()
+	entries := []tableEntry{{id: 1, value: "#planet-1"}, {id: 2, value: "https://example.com"}}
+
+	msg, err := codec.Decode(BinaryMessage, positionFrame(0, entries, 2500, -10000, 1, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := ClientMessage{Kind: Position, Position: dto.UpdatePositionCmdDTO{X: 0.25, Y: -1, Selector: "#planet-1", Location: "https://example.com"}}
+	if !reflect.DeepEqual(msg, expected) {
+		t.Fatalf("decoded %+v, expected %+v", msg, expected)
+	}
+
+	// strings are referenced without entries once client sent them
+	msg, err = codec.Decode(BinaryMessage, positionFrame(0, nil, 5000, 5000, 1, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Position.Selector != "#planet-1" || msg.Position.Location != "" || msg.Position.X != 0.5 {
+		t.Errorf("decoded %+v", msg.Position)
+	}
+
+	// table reset by client forgets previous strings
+	if _, err := codec.Decode(BinaryMessage, positionFrame(flagTableReset, nil, 0, 0, 1, 0)); err == nil {
+		t.Error("ref from before table reset was accepted")
+	}
+}
+
+func TestBinaryDecodeIdentify(t *testing.T) {
+	msg, err := NewBinaryCodec().Decode(BinaryMessage, appendString([]byte{frameIdentify}, "alice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Kind != Identify || msg.Identifier != "alice" {
+		t.Errorf("decoded %+v", msg)
+	}
+}
+
+func TestBinaryDecodeRejects(t *testing.T) {
+	long := make([]byte, maxIdentifierLength+1)
+	for i := range long {
+		long[i] = 'a'
+	}
+	tooManyEntries := make([]tableEntry, maxTableSize+1)
+	for i := range tooManyEntries {
+		tooManyEntries[i] = tableEntry{id: uint64(i + 1), value: "s"}
+	}
+
+	tests := []struct {
+		name        string
+		messageType int
+		data        []byte
+		code        string
+	}{
+		{"text message", TextMessage, appendString([]byte{frameIdentify}, "alice"), dto.ErrorMalformedMessage},
+		{"empty frame", BinaryMessage, nil, dto.ErrorMalformedMessage},
+		{"unknown frame type", BinaryMessage, []byte{0x7f}, dto.ErrorUnknownType},
+		{"server frame type", BinaryMessage, []byte{frameSnapshot, 0, 0, 0}, dto.ErrorUnknownType},
+		{"truncated string", BinaryMessage, []byte{frameIdentify, 5, 'a'}, dto.ErrorMalformedMessage},
+		{"invalid varint", BinaryMessage, []byte{frameIdentify, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, dto.ErrorMalformedMessage},
+		{"string too long", BinaryMessage, binary.AppendUvarint([]byte{frameIdentify}, maxStringLength+1), dto.ErrorMalformedMessage},
+		{"empty identifier", BinaryMessage, appendString([]byte{frameIdentify}, ""), dto.ErrorInvalidPayload},
+		{"identifier too long", BinaryMessage, appendString([]byte{frameIdentify}, string(long)), dto.ErrorInvalidPayload},
+		{"invalid utf-8", BinaryMessage, appendString([]byte{frameIdentify}, "\xff"), dto.ErrorInvalidPayload},
+		{"truncated position", BinaryMessage, []byte{framePosition, 0, 0, 2}, dto.ErrorMalformedMessage},
+		{"unknown ref", BinaryMessage, positionFrame(0, nil, 0, 0, 1, 0), dto.ErrorMalformedMessage},
+		{"reserved table id", BinaryMessage, positionFrame(0, []tableEntry{{id: 0, value: "x"}}, 0, 0, 0, 0), dto.ErrorMalformedMessage},
+		{"table too large", BinaryMessage, positionFrame(0, tooManyEntries, 0, 0, 0, 0), dto.ErrorMalformedMessage},
+		{"coordinate out of range", BinaryMessage, positionFrame(0, nil, 2*coordinateScale+1, 0, 0, 0), dto.ErrorInvalidPayload},
+		{"negative coordinate out of range", BinaryMessage, positionFrame(0, nil, 0, -coordinateScale-1, 0, 0), dto.ErrorInvalidPayload},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := NewBinaryCodec().Decode(test.messageType, test.data)
+			var protocolErr *Error
+			if !errors.As(err, &protocolErr) {
+				t.Fatalf("expected *Error, got %v", err)
+			}
+			if protocolErr.Code != test.code {
+				t.Errorf("code %s, expected %s (%s)", protocolErr.Code, test.code, protocolErr.Message)
+			}
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package protocol
+
+import (
+	"fmt"
+	"math"
+	"unicode/utf8"
+
+	"github.com/dwilkolek/browse-together-api/dto"
+)
+
+const maxIdentifierLength = 128
+const maxSelectorLength = 2048
+const maxLocationLength = 2048
+
+// Error is a protocol violation that is reported back to the client.
+type Error struct {
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+func (e *Error) DTO() dto.ErrorDTO {
+	return dto.ErrorDTO{Code: e.Code, Message: e.Message}
+}
+
+func errorf(code string, format string, args ...any) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func malformed(format string, args ...any) *Error {
+	return errorf(dto.ErrorMalformedMessage, format, args...)
+}
+
+// validate checks decoded message regardless of wire format.
+func validate(msg ClientMessage) (ClientMessage, error) {
+	switch msg.Kind {
+	case Identify:
+		if msg.Identifier == "" || len(msg.Identifier) > maxIdentifierLength || !utf8.ValidString(msg.Identifier) {
+			return ClientMessage{}, errorf(dto.ErrorInvalidPayload, "identifier must be 1-%d bytes of utf-8", maxIdentifierLength)
+		}
+	case Position:
+		position := msg.Position
+		if !validCoordinate(position.X) || !validCoordinate(position.Y) {
+			return ClientMessage{}, errorf(dto.ErrorInvalidPayload, "coordinates must be between -1 and 2")
+		}
+		if len(position.Selector) > maxSelectorLength {
+			return ClientMessage{}, errorf(dto.ErrorInvalidPayload, "selector longer than %d bytes", maxSelectorLength)
+		}
+		if len(position.Location) > maxLocationLength {
+			return ClientMessage{}, errorf(dto.ErrorInvalidPayload, "location longer than %d bytes", maxLocationLength)
+		}
+	}
+	return msg, nil
+}
+
+// validCoordinate allows positions relative to tracked element, -1 means out of tracking.
+func validCoordinate(v float64) bool {
+	return !math.IsNaN(v) && v >= -1 && v <= 2
+}
@@ -0,0 +1,106 @@
+package protocol
+
+import (
+	"encoding/json"
+
+	"github.com/dwilkolek/browse-together-api/dto"
+)
+
+// JSONCodec wraps every message in a versioned dto.EnvelopeDTO.
+type JSONCodec struct{}
+
+func (c *JSONCodec) Subprotocol() string {
+	return SubprotocolJSON
+}
+
+func (c *JSONCodec) SupportsDelta() bool {
+	return true
+}
+
+func (c *JSONCodec) EncodeHello(hello dto.HelloDTO) (Frame, error) {
+	if hello.Members == nil {
+		hello.Members = []dto.MemberDTO{}
+	}
+	return c.encode(dto.MessageHello, hello)
+}
+
+func (c *JSONCodec) EncodeSnapshot(states []dto.PositionStateDTO) (Frame, error) {
+	if states == nil {
+		states = []dto.PositionStateDTO{}
+	}
+	return c.encode(dto.MessageSnapshot, states)
+}
+
+func (c *JSONCodec) EncodeDelta(delta dto.PositionDeltaDTO) (Frame, error) {
+	if delta.Added == nil {
+		delta.Added = []dto.PositionStateDTO{}
+	}
+	if delta.Moved == nil {
+		delta.Moved = []dto.PositionStateDTO{}
+	}
+	if delta.Removed == nil {
+		delta.Removed = []int64{}
+	}
+	return c.encode(dto.MessageDelta, delta)
+}
+
+func (c *JSONCodec) EncodePresence(event dto.PresenceEventDTO) (Frame, error) {
+	return c.encode(dto.MessagePresence, event)
+}
+
+func (c *JSONCodec) EncodeError(e dto.ErrorDTO) (Frame, error) {
+	return c.encode(dto.MessageError, e)
+}
+
+func (c *JSONCodec) EncodeClose(closeMsg dto.CloseDTO) (Frame, error) {
+	return c.encode(dto.MessageClose, closeMsg)
+}
+
+func (c *JSONCodec) EncodeSessionUpdated(session dto.SessionDTO) (Frame, error) {
+	return c.encode(dto.MessageSessionUpdated, session)
+}
+
+func (c *JSONCodec) Reset() {
+	//noop
+}
+
+func (c *JSONCodec) Decode(messageType int, data []byte) (ClientMessage, error) {
+	if messageType != TextMessage {
+		return ClientMessage{}, malformed("expected text message")
+	}
+	var envelope dto.EnvelopeDTO
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return ClientMessage{}, malformed("%s", err)
+	}
+	if envelope.V != dto.ProtocolVersion {
+		return ClientMessage{}, errorf(dto.ErrorUnsupportedVersion, "unsupported version %d, server speaks %d", envelope.V, dto.ProtocolVersion)
+	}
+
+	switch envelope.Type {
+	case dto.MessageIdentify:
+		var identify dto.IdentifyCmdDTO
+		if err := json.Unmarshal(envelope.Payload, &identify); err != nil {
+			return ClientMessage{}, errorf(dto.ErrorInvalidPayload, "%s", err)
+		}
+		return validate(ClientMessage{Kind: Identify, Identifier: identify.Identifier})
+	case dto.MessagePosition:
+		var position dto.UpdatePositionCmdDTO
+		if err := json.Unmarshal(envelope.Payload, &position); err != nil {
+			return ClientMessage{}, errorf(dto.ErrorInvalidPayload, "%s", err)
+		}
+		return validate(ClientMessage{Kind: Position, Position: position})
+	}
+	return ClientMessage{}, errorf(dto.ErrorUnknownType, "unknown message type %q", envelope.Type)
+}
+
+func (c *JSONCodec) encode(messageType string, payload any) (Frame, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return Frame{}, err
+	}
+	envelope, err := json.Marshal(dto.EnvelopeDTO{Type: messageType, V: dto.ProtocolVersion, Payload: data})
+	if err != nil {
+		return Frame{}, err
+	}
+	return Frame{MessageType: TextMessage, Data: envelope}, nil
+}
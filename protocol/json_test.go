@@ -0,0 +1,150 @@
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/dwilkolek/browse-together-api/dto"
+)
+
+func envelope(t *testing.T, v int, messageType string, payload any) []byte {
+	t.Helper()
+	data, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame, err := json.Marshal(dto.EnvelopeDTO{Type: messageType, V: v, Payload: data})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return frame
+}
+
+func TestJSONDecode(t *testing.T) {
+	codec := &JSONCodec{}
+	msg, err := codec.Decode(TextMessage, envelope(t, dto.ProtocolVersion, dto.MessageIdentify, dto.IdentifyCmdDTO{Identifier: "alice"}))
+	if err != nil || msg.Kind != Identify || msg.Identifier != "alice" {
+		t.Fatalf("%+v %v, expected identify alice", msg, err)
+	}
+
+	position := dto.UpdatePositionCmdDTO{X: -1, Y: 2, Selector: "#a", Location: "https://example.com"}
+	msg, err = codec.Decode(TextMessage, envelope(t, dto.ProtocolVersion, dto.MessagePosition, position))
+	if err != nil || msg.Kind != Position || msg.Position != position {
+		t.Fatalf("%+v %v, expected position %+v", msg, err, position)
+	}
+}
+
+func TestJSONEncodeEnvelope(t *testing.T) {
+	frame, err := (&JSONCodec{}).EncodeError(dto.ErrorDTO{Code: dto.ErrorForbidden, Message: "viewer"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frame.MessageType != TextMessage {
+		t.Errorf("message type %d", frame.MessageType)
+	}
+	var decoded dto.EnvelopeDTO
+	if err := json.Unmarshal(frame.Data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Type != dto.MessageError || decoded.V != dto.ProtocolVersion {
+		t.Fatalf("envelope %+v", decoded)
+	}
+	var payload dto.ErrorDTO
+	if err := json.Unmarshal(decoded.Payload, &payload); err != nil || payload.Code != dto.ErrorForbidden {
+		t.Fatalf("payload %+v %v", payload, err)
+	}
+}
+
+func TestJSONDecodeRejects(t *testing.T) {
+	identify := func(identifier string) []byte {
+		return envelope(t, dto.ProtocolVersion, dto.MessageIdentify, dto.IdentifyCmdDTO{Identifier: identifier})
+	}
+	position := func(position dto.UpdatePositionCmdDTO) []byte {
+		return envelope(t, dto.ProtocolVersion, dto.MessagePosition, position)
+	}
+	long := strings.Repeat("a", maxSelectorLength+1)
+
+	tests := []struct {
+		name        string
+		messageType int
+		data        []byte
+		code        string
+	}{
+		{"binary message", BinaryMessage, identify("alice"), dto.ErrorMalformedMessage},
+		{"invalid json", TextMessage, []byte(`{"type":`), dto.ErrorMalformedMessage},
+		{"not an object", TextMessage, []byte(`[]`), dto.ErrorMalformedMessage},
+		{"missing version", TextMessage, []byte(`{"type":"identify","payload":{"identifier":"alice"}}`), dto.ErrorUnsupportedVersion},
+		{"future version", TextMessage, envelope(t, dto.ProtocolVersion+1, dto.MessageIdentify, dto.IdentifyCmdDTO{Identifier: "alice"}), dto.ErrorUnsupportedVersion},
+		{"unknown type", TextMessage, envelope(t, dto.ProtocolVersion, "wave", nil), dto.ErrorUnknownType},
+		{"server type", TextMessage, envelope(t, dto.ProtocolVersion, dto.MessageSnapshot, []dto.PositionStateDTO{}), dto.ErrorUnknownType},
+		{"missing payload", TextMessage, []byte(`{"type":"position","v":1}`), dto.ErrorInvalidPayload},
+		{"payload of wrong shape", TextMessage, envelope(t, dto.ProtocolVersion, dto.MessagePosition, map[string]string{"x": "left"}), dto.ErrorInvalidPayload},
+		{"empty identifier", TextMessage, identify(""), dto.ErrorInvalidPayload},
+		{"identifier too long", TextMessage, identify(strings.Repeat("a", maxIdentifierLength+1)), dto.ErrorInvalidPayload},
+		{"x out of range", TextMessage, position(dto.UpdatePositionCmdDTO{X: 2.01}), dto.ErrorInvalidPayload},
+		{"y out of range", TextMessage, position(dto.UpdatePositionCmdDTO{Y: -1.01}), dto.ErrorInvalidPayload},
+		{"selector too long", TextMessage, position(dto.UpdatePositionCmdDTO{Selector: long}), dto.ErrorInvalidPayload},
+		{"location too long", TextMessage, position(dto.UpdatePositionCmdDTO{Location: long}), dto.ErrorInvalidPayload},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := (&JSONCodec{}).Decode(test.messageType, test.data)
+			var protocolErr *Error
+			if !errors.As(err, &protocolErr) {
+				t.Fatalf("expected *Error, got %v", err)
+			}
+			if protocolErr.Code != test.code {
+				t.Errorf("code %s, expected %s: %s", protocolErr.Code, test.code, protocolErr.Message)
+			}
+		})
+	}
+}
+
+func TestValidateBounds(t *testing.T) {
+	accepted := []ClientMessage{
+		{Kind: Identify, Identifier: strings.Repeat("a", maxIdentifierLength)},
+		{Kind: Identify, Identifier: "żółw"},
+		{Kind: Position, Position: dto.UpdatePositionCmdDTO{X: -1, Y: 2}},
+		{Kind: Position, Position: dto.UpdatePositionCmdDTO{Selector: strings.Repeat("a", maxSelectorLength), Location: strings.Repeat("a", maxLocationLength)}},
+	}
+	for _, msg := range accepted {
+		if _, err := validate(msg); err != nil {
+			t.Errorf("%+v rejected: %v", msg, err)
+		}
+	}
+	// encoding/json replaces invalid utf-8, only binary and legacy frames can carry it
+	if _, err := validate(ClientMessage{Kind: Identify, Identifier: "\xff"}); err == nil {
+		t.Error("invalid utf-8 accepted")
+	}
+	for _, v := range []float64{math.NaN(), math.Inf(1), math.Inf(-1)} {
+		if _, err := validate(ClientMessage{Kind: Position, Position: dto.UpdatePositionCmdDTO{X: v}}); err == nil {
+			t.Errorf("coordinate %v accepted", v)
+		}
+	}
+}
+
+func TestLegacyDecode(t *testing.T) {
+	codec := &LegacyCodec{}
+	msg, err := codec.Decode(TextMessage, []byte(identifierPrefix+"alice"))
+	if err != nil || msg.Kind != Identify || msg.Identifier != "alice" {
+		t.Fatalf("%+v %v, expected identify alice", msg, err)
+	}
+	msg, err = codec.Decode(TextMessage, []byte(`{"x":0.5,"y":0.5,"selector":"#a","location":"https://example.com"}`))
+	if err != nil || msg.Kind != Position || msg.Position.X != 0.5 {
+		t.Fatalf("%+v %v, expected position", msg, err)
+	}
+
+	var protocolErr *Error
+	if _, err := codec.Decode(TextMessage, []byte(identifierPrefix)); !errors.As(err, &protocolErr) || protocolErr.Code != dto.ErrorInvalidPayload {
+		t.Errorf("empty identifier: %v", err)
+	}
+	if _, err := codec.Decode(TextMessage, []byte(`{"x":`)); !errors.As(err, &protocolErr) || protocolErr.Code != dto.ErrorMalformedMessage {
+		t.Errorf("invalid json: %v", err)
+	}
+	if _, err := codec.Decode(TextMessage, []byte(`{"x":3}`)); !errors.As(err, &protocolErr) || protocolErr.Code != dto.ErrorInvalidPayload {
+		t.Errorf("coordinate out of range: %v", err)
+	}
+}
@@ -0,0 +1,82 @@
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/dwilkolek/browse-together-api/dto"
+)
+
+const identifierPrefix = "Identifier:"
+
+// LegacyCodec is the original text protocol used by SDKs that don't negotiate
+// a subprotocol. They expect a full snapshot in every frame and can't handle
+// any other message after hello.
+type LegacyCodec struct{}
+
+func (c *LegacyCodec) Subprotocol() string {
+	return ""
+}
+
+func (c *LegacyCodec) SupportsDelta() bool {
+	return false
+}
+
+func (c *LegacyCodec) EncodeHello(hello dto.HelloDTO) (Frame, error) {
+	return c.encode(fmt.Sprintf("%d;%s", hello.MemberId, hello.RejoinToken))
+}
+
+func (c *LegacyCodec) EncodeSnapshot(states []dto.PositionStateDTO) (Frame, error) {
+	if states == nil {
+		states = []dto.PositionStateDTO{}
+	}
+	return c.encode(states)
+}
+
+func (c *LegacyCodec) EncodeDelta(delta dto.PositionDeltaDTO) (Frame, error) {
+	return Frame{}, ErrUnsupported
+}
+
+func (c *LegacyCodec) EncodePresence(event dto.PresenceEventDTO) (Frame, error) {
+	return Frame{}, ErrUnsupported
+}
+
+func (c *LegacyCodec) EncodeError(e dto.ErrorDTO) (Frame, error) {
+	return Frame{}, ErrUnsupported
+}
+
+func (c *LegacyCodec) EncodeClose(closeMsg dto.CloseDTO) (Frame, error) {
+	return Frame{}, ErrUnsupported
+}
+
+func (c *LegacyCodec) EncodeSessionUpdated(session dto.SessionDTO) (Frame, error) {
+	return Frame{}, ErrUnsupported
+}
+
+func (c *LegacyCodec) Reset() {
+	//noop
+}
+
+func (c *LegacyCodec) Decode(messageType int, data []byte) (ClientMessage, error) {
+	if strings.HasPrefix(string(data), identifierPrefix) {
+		return validate(ClientMessage{
+			Kind:       Identify,
+			Identifier: string(data)[len(identifierPrefix):],
+		})
+	}
+
+	var position dto.UpdatePositionCmdDTO
+	if err := json.Unmarshal(data, &position); err != nil {
+		return ClientMessage{}, malformed("%s", err)
+	}
+	return validate(ClientMessage{Kind: Position, Position: position})
+}
+
+func (c *LegacyCodec) encode(v any) (Frame, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return Frame{}, err
+	}
+	return Frame{MessageType: TextMessage, Data: data}, nil
+}
@@ -0,0 +1,73 @@
+package protocol
+
+import (
+	"errors"
+
+	"github.com/dwilkolek/browse-together-api/dto"
+)
+
+// WebSocket message types as defined by RFC 6455, mirrored here so codecs
+// don't depend on a particular websocket implementation.
+const (
+	TextMessage   = 1
+	BinaryMessage = 2
+)
+
+const SubprotocolBinary = "browse-together.v1.binary"
+const SubprotocolJSON = "browse-together.v1.json"
+
+// Subprotocols lists supported subprotocols in order of preference.
+// Clients that don't request any subprotocol get LegacyCodec.
+var Subprotocols = []string{SubprotocolBinary, SubprotocolJSON}
+
+// ErrUnsupported is returned when client's protocol can't carry given message, it should be skipped.
+var ErrUnsupported = errors.New("message not supported by protocol")
+
+type ClientMessageKind int
+
+const (
+	Identify ClientMessageKind = iota + 1
+	Position
+)
+
+type ClientMessage struct {
+	Kind       ClientMessageKind
+	Identifier string
+	Position   dto.UpdatePositionCmdDTO
+}
+
+type Frame struct {
+	MessageType int
+	Data        []byte
+}
+
+// Codec translates between the wire format and DTOs. Codecs are stateful
+// (e.g. interned string tables) and must be used by a single connection.
+type Codec interface {
+	Subprotocol() string
+	EncodeHello(hello dto.HelloDTO) (Frame, error)
+	EncodeSnapshot(states []dto.PositionStateDTO) (Frame, error)
+	EncodeDelta(delta dto.PositionDeltaDTO) (Frame, error)
+	EncodePresence(event dto.PresenceEventDTO) (Frame, error)
+	EncodeError(e dto.ErrorDTO) (Frame, error)
+	EncodeClose(closeMsg dto.CloseDTO) (Frame, error)
+	EncodeSessionUpdated(session dto.SessionDTO) (Frame, error)
+	// SupportsDelta reports whether client understands delta frames,
+	// otherwise every broadcast is sent as a snapshot.
+	SupportsDelta() bool
+	// Decode returns *Error for messages that violate the protocol.
+	Decode(messageType int, data []byte) (ClientMessage, error)
+	// Reset forgets state shared with the client after frames were dropped,
+	// so the next encoded frame is self-contained.
+	Reset()
+}
+
+func ForSubprotocol(subprotocol string) Codec {
+	switch subprotocol {
+	case SubprotocolBinary:
+		return NewBinaryCodec()
+	case SubprotocolJSON:
+		return &JSONCodec{}
+	}
+	return &LegacyCodec{}
+}
@@ -1,9 +1,13 @@
 package queue
 
 import (
+	"context"
 	"sync"
+	"time"
 
+	"github.com/dwilkolek/browse-together-api/auth"
 	"github.com/dwilkolek/browse-together-api/dto"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type InMemoryEventQueue struct {
@@ -11,6 +15,12 @@ type InMemoryEventQueue struct {
 	sessionClosedChan chan struct{}
 	memberCount       int64
 	cache             map[int64]dto.PositionStateDTO
+	changed           map[int64]struct{}
+	roles             map[int64]auth.Role
+	members           map[int64]dto.MemberDTO
+	memberEventsChan  chan MemberEvent
+	lastActivity      time.Time
+	traceLinks        traceLinks
 	mu                sync.Mutex
 	outdated          bool
 	closed            bool
@@ -19,28 +29,44 @@ type InMemoryEventQueue struct {
 func (q *InMemoryEventQueue) Initialise() {
 	//noop
 }
+func (q *InMemoryEventQueue) PersistSnapshot() {
+	//noop
+}
 func (q *InMemoryEventQueue) RefreshNeeded() bool {
 	q.mu.Lock()
 	defer q.mu.Unlock()
 	return q.outdated && !q.closed
 }
 func (q *InMemoryEventQueue) GetSnapshot() map[int64]dto.PositionStateDTO {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	removeInvalidPositionStates(q.cache, q.changed)
+	return copyPositionStates(q.cache)
+}
+func (q *InMemoryEventQueue) GetChanges() ([]dto.PositionStateDTO, []int64) {
 	q.mu.Lock()
 	defer q.mu.Unlock()
 	q.outdated = false
-	q.cache = validPositionStates(q.cache)
-	return q.cache
+	removeInvalidPositionStates(q.cache, q.changed)
+	return collectChanges(q.cache, q.changed)
 }
-func (q *InMemoryEventQueue) SessionMemberPositionChange(update dto.PositionStateDTO) {
+func (q *InMemoryEventQueue) SessionMemberPositionChange(ctx context.Context, update dto.PositionStateDTO) {
 	q.mu.Lock()
 	defer q.mu.Unlock()
 	delete(q.cache, update.MemberId)
 	if q.closed {
 		return
 	}
+	q.traceLinks.add(ctx)
 
 	q.outdated = true
 	q.cache[update.MemberId] = update
+	q.changed[update.MemberId] = struct{}{}
+}
+func (q *InMemoryEventQueue) TraceLinks() []trace.Link {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.traceLinks.take()
 }
 func (q *InMemoryEventQueue) MemberLeft(memberId int64) {
 	q.mu.Lock()
@@ -49,6 +75,7 @@ func (q *InMemoryEventQueue) MemberLeft(memberId int64) {
 		return
 	}
 	delete(q.cache, memberId)
+	q.changed[memberId] = struct{}{}
 	q.outdated = true
 }
 func (q *InMemoryEventQueue) CloseSession() {
@@ -70,3 +97,104 @@ func (q *InMemoryEventQueue) NextMemberId() int64 {
 func (q *InMemoryEventQueue) OnSessionClosed() <-chan struct{} {
 	return q.sessionClosedChan
 }
+
+func (q *InMemoryEventQueue) SetMemberRole(memberId int64, role auth.Role) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return
+	}
+	q.roles[memberId] = role
+	if member, ok := q.members[memberId]; ok {
+		member.Role = string(role)
+		q.members[memberId] = member
+	}
+	emitMemberEvent(q.sessionId, q.memberEventsChan, MemberEvent{Kind: MemberRoleChanged, MemberId: memberId, Role: role})
+}
+func (q *InMemoryEventQueue) GetMemberRole(memberId int64) (auth.Role, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	role, ok := q.roles[memberId]
+	return role, ok
+}
+func (q *InMemoryEventQueue) KickMember(memberId int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return
+	}
+	emitMemberEvent(q.sessionId, q.memberEventsChan, MemberEvent{Kind: MemberKicked, MemberId: memberId})
+}
+func (q *InMemoryEventQueue) SessionUpdated(session dto.SessionDTO) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return
+	}
+	emitMemberEvent(q.sessionId, q.memberEventsChan, MemberEvent{Kind: SessionUpdated, Session: session})
+}
+
+func (q *InMemoryEventQueue) MemberJoined(member dto.MemberDTO) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return
+	}
+	q.members[member.MemberId] = member
+	q.lastActivity = time.Now()
+	emitMemberEvent(q.sessionId, q.memberEventsChan, presenceEvent(dto.PresenceJoined, member))
+}
+func (q *InMemoryEventQueue) MemberRenamed(memberId int64, identifier string) {
+	q.updateMember(memberId, dto.PresenceRenamed, func(member *dto.MemberDTO) {
+		member.GivenIdentifier = identifier
+	})
+}
+func (q *InMemoryEventQueue) MemberDisconnected(memberId int64) {
+	q.updateMember(memberId, dto.PresenceLeft, func(member *dto.MemberDTO) {
+		member.State = dto.MemberDisconnected
+		member.LastActivityAt = time.Now().UnixMilli()
+	})
+}
+func (q *InMemoryEventQueue) TouchMember(memberId int64) {
+	q.updateMember(memberId, "", func(member *dto.MemberDTO) {
+		member.LastActivityAt = time.Now().UnixMilli()
+	})
+}
+func (q *InMemoryEventQueue) GetMembers() []dto.MemberDTO {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	members := make([]dto.MemberDTO, 0, len(q.members))
+	for memberId, member := range q.members {
+		if rosterExpired(member) {
+			delete(q.members, memberId)
+			continue
+		}
+		members = append(members, member)
+	}
+	return members
+}
+func (q *InMemoryEventQueue) LastActivity() time.Time {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.lastActivity
+}
+
+// updateMember applies update to roster entry and emits presence event unless eventType is empty.
+func (q *InMemoryEventQueue) updateMember(memberId int64, eventType string, update func(member *dto.MemberDTO)) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	member, ok := q.members[memberId]
+	if q.closed || !ok {
+		return
+	}
+	update(&member)
+	q.members[memberId] = member
+	q.lastActivity = time.Now()
+	if eventType != "" {
+		emitMemberEvent(q.sessionId, q.memberEventsChan, presenceEvent(eventType, member))
+	}
+}
+
+func (q *InMemoryEventQueue) OnMemberEvent() <-chan MemberEvent {
+	return q.memberEventsChan
+}
@@ -1,65 +1,223 @@
 package queue
 
 import (
-	"os"
+	"context"
+	"fmt"
+	"log/slog"
 	"sync"
 	"time"
 
-	"github.com/dwilkolek/browse-together-api/clients"
+	"github.com/dwilkolek/browse-together-api/auth"
+	"github.com/dwilkolek/browse-together-api/config"
 	"github.com/dwilkolek/browse-together-api/dto"
+	"github.com/dwilkolek/browse-together-api/logging"
+	"github.com/dwilkolek/browse-together-api/metrics"
+	"github.com/dwilkolek/browse-together-api/tracing"
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type EventQueue interface {
 	Initialise()
 	GetSnapshot() map[int64]dto.PositionStateDTO
-	SessionMemberPositionChange(update dto.PositionStateDTO)
+	// GetChanges returns positions of members that were added or moved and ids of
+	// members that were removed since the previous call.
+	GetChanges() ([]dto.PositionStateDTO, []int64)
+	// PersistSnapshot stores positions so sessions can be restored by other instances.
+	PersistSnapshot()
+	// SessionMemberPositionChange publishes update, trace context of ctx travels with it.
+	SessionMemberPositionChange(ctx context.Context, update dto.PositionStateDTO)
+	// TraceLinks returns spans that delivered positions since the previous call.
+	TraceLinks() []trace.Link
 	MemberLeft(memberId int64)
 	CloseSession()
 	NextMemberId() int64
+	// SetMemberRole overrides role member joined with, on every instance.
+	SetMemberRole(memberId int64, role auth.Role)
+	GetMemberRole(memberId int64) (auth.Role, bool)
+	KickMember(memberId int64)
+	// SessionUpdated notifies members on every instance about changed session.
+	SessionUpdated(session dto.SessionDTO)
+
+	// MemberJoined, MemberRenamed and MemberDisconnected maintain the roster
+	// and broadcast presence events.
+	MemberJoined(member dto.MemberDTO)
+	MemberRenamed(memberId int64, identifier string)
+	MemberDisconnected(memberId int64)
+	TouchMember(memberId int64)
+	GetMembers() []dto.MemberDTO
+	// LastActivity is time of the latest roster change on any instance, zero if there was none.
+	LastActivity() time.Time
 
 	OnSessionClosed() <-chan struct{}
+	OnMemberEvent() <-chan MemberEvent
 	RefreshNeeded() bool
 }
 
-func GetEventQueueForSession(sessionId string) EventQueue {
-	queue := os.Getenv("QUEUE")
-	if queue == "" {
-		queue = "IN_MEMORY"
+// maxTraceLinks bounds links kept between broadcasts, positions arriving faster are still broadcast.
+const maxTraceLinks = 32
+
+// traceLinks collects spans that delivered positions, guarded by mutex of the queue.
+type traceLinks struct {
+	links []trace.Link
+}
+
+func (t *traceLinks) add(ctx context.Context) {
+	if link, ok := tracing.LinkFrom(ctx); ok && len(t.links) < maxTraceLinks {
+		t.links = append(t.links, link)
 	}
+}
 
-	if queue == "IN_MEMORY" {
-		return &InMemoryEventQueue{
-			sessionClosedChan: make(chan struct{}),
-			memberCount:       0,
-			cache:             make(map[int64]dto.PositionStateDTO),
-			sessionId:         sessionId,
-			closed:            false,
-		}
+func (t *traceLinks) take() []trace.Link {
+	links := t.links
+	t.links = nil
+	return links
+}
+
+// Pinger is implemented by queues relying on connections that can be lost.
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+type MemberEventKind int
+
+const (
+	MemberRoleChanged MemberEventKind = iota + 1
+	MemberKicked
+	MemberPresence
+	SessionUpdated
+)
+
+func (k MemberEventKind) String() string {
+	switch k {
+	case MemberRoleChanged:
+		return "role"
+	case MemberKicked:
+		return "kick"
+	case MemberPresence:
+		return "presence"
+	case SessionUpdated:
+		return "session"
 	}
+	return fmt.Sprintf("MemberEventKind(%d)", int(k))
+}
 
-	if queue == "REDIS" {
-		return &RedisEventQueue{
-			sessionId:         sessionId,
-			redisClient:       clients.CreateRedisClient(),
-			sessionClosedChan: make(chan struct{}),
-			cache:             make(map[int64]dto.PositionStateDTO),
-			mu:                sync.Mutex{},
-			outdated:          false,
-			closed:            false,
-		}
+type MemberEvent struct {
+	Kind     MemberEventKind
+	MemberId int64
+	Role     auth.Role
+	Presence dto.PresenceEventDTO
+	Session  dto.SessionDTO
+}
+
+// rosterRetention is how long disconnected members stay in the roster.
+const rosterRetention = 10 * time.Minute
+
+const memberEventsBuffer = 64
+
+// Factory creates queue of a session, called when first member joins on the instance
+// and to publish to sessions without members on the instance.
+type Factory func(sessionId string) EventQueue
+
+// NewFactory returns factory of queues selected by cfg.Queue, redisClient is only used by Redis queues.
+func NewFactory(cfg config.Config, redisClient *redis.Client) (Factory, error) {
+	switch cfg.Queue {
+	case config.InMemory:
+		return newInMemoryEventQueue, nil
+	case config.Redis:
+		return func(sessionId string) EventQueue {
+			return newRedisEventQueue(sessionId, redisClient, cfg.Session.MaxLifetime)
+		}, nil
 	}
+	return nil, fmt.Errorf("unknown QUEUE %s", cfg.Queue)
+}
 
-	panic("Unknown QUEUE config")
+func newInMemoryEventQueue(sessionId string) EventQueue {
+	return &InMemoryEventQueue{
+		sessionClosedChan: make(chan struct{}),
+		memberCount:       0,
+		cache:             make(map[int64]dto.PositionStateDTO),
+		changed:           make(map[int64]struct{}),
+		roles:             make(map[int64]auth.Role),
+		members:           make(map[int64]dto.MemberDTO),
+		memberEventsChan:  make(chan MemberEvent, memberEventsBuffer),
+		sessionId:         sessionId,
+		closed:            false,
+	}
+}
+
+func newRedisEventQueue(sessionId string, redisClient *redis.Client, rosterTTL time.Duration) EventQueue {
+	return &RedisEventQueue{
+		sessionId:         sessionId,
+		redisClient:       redisClient,
+		rosterTTL:         rosterTTL,
+		logger:            slog.With(logging.SessionIdKey, sessionId),
+		sessionClosedChan: make(chan struct{}),
+		cache:             make(map[int64]dto.PositionStateDTO),
+		changed:           make(map[int64]struct{}),
+		memberEventsChan:  make(chan MemberEvent, memberEventsBuffer),
+		mu:                sync.Mutex{},
+		outdated:          false,
+		closed:            false,
+	}
+}
+
+// emitMemberEvent doesn't block, queues of sessions without members on the instance
+// have nobody listening. Events that don't fit are counted and logged.
+func emitMemberEvent(sessionId string, events chan MemberEvent, event MemberEvent) {
+	select {
+	case events <- event:
+	default:
+		metrics.MemberEventsDropped.WithLabelValues(event.Kind.String()).Inc()
+		slog.Warn("Dropped member event, nobody keeps up with the session", logging.SessionIdKey, sessionId, logging.MemberIdKey, event.MemberId, "kind", event.Kind)
+	}
+}
+
+func presenceEvent(eventType string, member dto.MemberDTO) MemberEvent {
+	return MemberEvent{
+		Kind:     MemberPresence,
+		MemberId: member.MemberId,
+		Presence: dto.PresenceEventDTO{Type: eventType, Member: member},
+	}
 }
 
-func validPositionStates(states map[int64]dto.PositionStateDTO) map[int64]dto.PositionStateDTO {
-	var filtered = make(map[int64]dto.PositionStateDTO)
+func rosterExpired(member dto.MemberDTO) bool {
+	return member.State == dto.MemberDisconnected &&
+		time.Now().UnixMilli() > member.LastActivityAt+rosterRetention.Milliseconds()
+}
+
+// removeInvalidPositionStates drops states inactive for a minute or without location
+// and marks them as changed so they are broadcast as removed.
+func removeInvalidPositionStates(states map[int64]dto.PositionStateDTO, changed map[int64]struct{}) {
 	for memberId, state := range states {
 		inactiveForMinute := time.Now().UnixMilli() > state.UpdatedAt+1*time.Minute.Milliseconds()
 		validLocation := state.Location != ""
-		if !inactiveForMinute && validLocation {
-			filtered[memberId] = state
+		if inactiveForMinute || !validLocation {
+			delete(states, memberId)
+			changed[memberId] = struct{}{}
+		}
+	}
+}
+
+func copyPositionStates(states map[int64]dto.PositionStateDTO) map[int64]dto.PositionStateDTO {
+	var copied = make(map[int64]dto.PositionStateDTO, len(states))
+	for memberId, state := range states {
+		copied[memberId] = state
+	}
+	return copied
+}
+
+// collectChanges splits changed members into current states and removed ids and clears changed.
+func collectChanges(states map[int64]dto.PositionStateDTO, changed map[int64]struct{}) ([]dto.PositionStateDTO, []int64) {
+	var updated []dto.PositionStateDTO
+	var removed []int64
+	for memberId := range changed {
+		if state, ok := states[memberId]; ok {
+			updated = append(updated, state)
+		} else {
+			removed = append(removed, memberId)
 		}
+		delete(changed, memberId)
 	}
-	return filtered
+	return updated, removed
 }
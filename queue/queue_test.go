@@ -0,0 +1,40 @@
+package queue
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/dwilkolek/browse-together-api/config"
+	"github.com/dwilkolek/browse-together-api/metrics"
+)
+
+func TestEmitMemberEventCountsDrops(t *testing.T) {
+	events := make(chan MemberEvent, 1)
+	dropped := metrics.MemberEventsDropped.WithLabelValues(MemberKicked.String())
+	before := testutil.ToFloat64(dropped)
+
+	emitMemberEvent("session", events, MemberEvent{Kind: MemberKicked, MemberId: 1})
+	emitMemberEvent("session", events, MemberEvent{Kind: MemberKicked, MemberId: 2})
+
+	if event := <-events; event.MemberId != 1 {
+		t.Errorf("event of member %d, expected the first one", event.MemberId)
+	}
+	if count := testutil.ToFloat64(dropped) - before; count != 1 {
+		t.Errorf("%v drops counted, expected 1", count)
+	}
+}
+
+func TestRedisRosterFollowsSessionLifetime(t *testing.T) {
+	cfg := config.Default()
+	cfg.Queue = config.Redis
+	cfg.Session.MaxLifetime = 3 * time.Hour
+	queues, err := NewFactory(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl := queues("session").(*RedisEventQueue).rosterTTL; ttl != cfg.Session.MaxLifetime {
+		t.Errorf("roster kept for %s, expected session lifetime", ttl)
+	}
+}
@@ -4,61 +4,103 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"github.com/dwilkolek/browse-together-api/config"
-	"log"
+	"log/slog"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/dwilkolek/browse-together-api/auth"
 	"github.com/dwilkolek/browse-together-api/dto"
+	"github.com/dwilkolek/browse-together-api/internal/rediskeys"
+	"github.com/dwilkolek/browse-together-api/logging"
+	"github.com/dwilkolek/browse-together-api/metrics"
+	"github.com/dwilkolek/browse-together-api/tracing"
+	"github.com/google/uuid"
 	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const sessionCommunicationChannelPrefix string = "communication-"
 const sessionPositionUpdatesChannelPrefix string = "position-"
-const memberIdPrefix string = "memberId-"
-const snapshotPrefix string = "snapshot-"
+const heartbeatPrefix string = "heartbeat-"
+const presenceMessagePrefix string = "PRESENCE;"
+const sessionMessagePrefix string = "SESSION;"
+
+// positionMessage is published on position channel. Trace is ignored by instances
+// that don't know it, so they can run side by side during deploys.
+type positionMessage struct {
+	dto.PositionStateDTO
+	Trace map[string]string `json:"trace,omitempty"`
+}
+
+// instanceId tells apart members connected to this process in rosters shared over Redis.
+var instanceId = uuid.NewString()
+
+// heartbeatInterval is how often instance confirms it still serves members of a session.
+// Members of instances without heartbeat for heartbeatTTL, e.g. crashed ones, count as disconnected.
+const heartbeatInterval = 15 * time.Second
+const heartbeatTTL = 3 * heartbeatInterval
 
 type RedisEventQueue struct {
-	sessionId         string
-	redisClient       *redis.Client
+	sessionId   string
+	redisClient *redis.Client
+	// rosterTTL is the longest session lifetime, so roles and roster outlive the session.
+	rosterTTL         time.Duration
 	sessionClosedChan chan struct{}
 	cache             map[int64]dto.PositionStateDTO
+	changed           map[int64]struct{}
+	memberEventsChan  chan MemberEvent
 	mu                sync.Mutex
 	outdated          bool
 	closed            bool
 	initialized       bool
+	subscriptions     []*redis.PubSub
+	traceLinks        traceLinks
+	logger            *slog.Logger
 }
 
 func (q *RedisEventQueue) Initialise() {
 
 	q.cache = make(map[int64]dto.PositionStateDTO)
 	var cacheTmp map[int64]dto.PositionStateDTO
-	if snapshot, err := q.redisClient.Get(context.Background(), snapshotPrefix+q.sessionId).Result(); err == nil {
+	if snapshot, err := q.redisClient.Get(context.Background(), rediskeys.SnapshotPrefix+q.sessionId).Result(); err == nil {
 		if err = json.Unmarshal([]byte(snapshot), &cacheTmp); err == nil {
 			q.cache = cacheTmp
+			for memberId := range q.cache {
+				q.changed[memberId] = struct{}{}
+			}
+			q.outdated = len(q.cache) > 0
 		}
 	}
 
+	q.heartbeat()
+	pubSub := q.redisClient.Subscribe(context.Background(), sessionPositionUpdatesChannelPrefix+q.sessionId)
+	pubSubInternal := q.redisClient.Subscribe(context.Background(), sessionCommunicationChannelPrefix+q.sessionId)
+	q.mu.Lock()
+	q.subscriptions = []*redis.PubSub{pubSub, pubSubInternal}
+	q.mu.Unlock()
+
 	go func() {
-		pubSub := q.redisClient.Subscribe(context.Background(), sessionPositionUpdatesChannelPrefix+q.sessionId)
 		defer func(pubSub *redis.PubSub) {
 			err := pubSub.Close()
 			if err != nil {
-				log.Default().Println("Error closing position changed channel", err)
+				q.logger.Warn("Error closing position changed channel", logging.Err(err))
 			}
 		}(pubSub)
 
-		pubSubInternal := q.redisClient.Subscribe(context.Background(), sessionCommunicationChannelPrefix+q.sessionId)
 		defer func(pubSubInternal *redis.PubSub) {
 			err := pubSubInternal.Close()
 			if err != nil {
-				log.Default().Println("Error closing session communication channel", err)
+				q.logger.Warn("Error closing session communication channel", logging.Err(err))
 			}
 		}(pubSubInternal)
 
 		persistCacheTicker := time.NewTicker(time.Minute).C
+		heartbeatTicker := time.NewTicker(heartbeatInterval)
+		defer heartbeatTicker.Stop()
 		subscriptionChannel := pubSub.Channel()
 		subscriptionChannelInternal := pubSubInternal.Channel()
 
@@ -66,59 +108,97 @@ func (q *RedisEventQueue) Initialise() {
 			select {
 			case <-persistCacheTicker:
 				{
-					func() {
-						q.mu.Lock()
-						defer q.mu.Unlock()
-						q.cache = validPositionStates(q.cache)
-						if snapshot, err := json.Marshal(q.cache); err == nil {
-							q.redisClient.Set(context.Background(), snapshotPrefix+q.sessionId, snapshot, time.Hour)
-						}
-					}()
+					q.PersistSnapshot()
 				}
+			case <-heartbeatTicker.C:
+				q.heartbeat()
 			case msg, ok := <-subscriptionChannel:
 				{
 					if !ok {
 						continue
 					}
 
-					var positionState dto.PositionStateDTO
-					err := json.Unmarshal([]byte(msg.Payload), &positionState)
+					var message positionMessage
+					err := json.Unmarshal([]byte(msg.Payload), &message)
 					if err != nil {
-						log.Printf("Failed to unmarshal PositionStateDTO: %s\n", err)
+						q.logger.Error("Failed to unmarshal PositionStateDTO", logging.Err(err))
 					}
-					if config.DEBUG {
-						fmt.Printf("Received message from %s: %s\n", msg.Channel, msg.Payload)
+					positionState := message.PositionStateDTO
+					q.logger.Debug("Received message", "channel", msg.Channel, logging.MemberIdKey, positionState.MemberId)
+					if positionState.UpdatedAt > 0 {
+						metrics.PubSubLatency.Observe(time.Since(time.UnixMilli(positionState.UpdatedAt)).Seconds())
 					}
+					ctx, span := tracing.Tracer.Start(tracing.Extract(context.Background(), message.Trace), "position receive",
+						trace.WithSpanKind(trace.SpanKindConsumer),
+						trace.WithAttributes(
+							semconv.MessagingSystem("redis"),
+							semconv.MessagingDestinationName(msg.Channel),
+							tracing.SessionIdKey.String(q.sessionId),
+							tracing.MemberIdKey.Int64(positionState.MemberId),
+						))
 					func() {
 						q.mu.Lock()
 						defer q.mu.Unlock()
 						q.outdated = true
 						q.cache[positionState.MemberId] = positionState
+						q.changed[positionState.MemberId] = struct{}{}
+						q.traceLinks.add(ctx)
 					}()
+					span.End()
 				}
 			case msg, ok := <-subscriptionChannelInternal:
 				{
 					if !ok {
 						break
 					}
-					if config.DEBUG {
-						fmt.Printf("Received message from %s: %s\n", msg.Channel, msg.Payload)
+					q.logger.Debug("Received message", "channel", msg.Channel, "payload", msg.Payload)
+					if strings.HasPrefix(msg.Payload, presenceMessagePrefix) {
+						var presence dto.PresenceEventDTO
+						if err := json.Unmarshal([]byte(msg.Payload[len(presenceMessagePrefix):]), &presence); err != nil {
+							q.logger.Error("Failed to unmarshal PresenceEventDTO", logging.Err(err))
+							continue
+						}
+						emitMemberEvent(q.sessionId, q.memberEventsChan, presenceEvent(presence.Type, presence.Member))
+						continue
+					}
+					if strings.HasPrefix(msg.Payload, sessionMessagePrefix) {
+						var session dto.SessionDTO
+						if err := json.Unmarshal([]byte(msg.Payload[len(sessionMessagePrefix):]), &session); err != nil {
+							q.logger.Error("Failed to unmarshal SessionDTO", logging.Err(err))
+							continue
+						}
+						emitMemberEvent(q.sessionId, q.memberEventsChan, MemberEvent{Kind: SessionUpdated, Session: session})
+						continue
 					}
 					parts := strings.Split(msg.Payload, ";")
 					if parts[0] == "MEM_LEFT" {
 						memberId, err := strconv.ParseInt(parts[1], 10, 64)
 						if err != nil {
-							log.Println("Failed to convert str to memberId", err)
+							q.logger.Error("Failed to convert str to memberId", logging.Err(err))
 							continue
 						}
 						func(memberId int64) {
 							q.mu.Lock()
 							defer q.mu.Unlock()
 							delete(q.cache, memberId)
+							q.changed[memberId] = struct{}{}
 							q.outdated = true
 						}(memberId)
 						continue
 					}
+					if (parts[0] == "ROLE" && len(parts) == 3) || (parts[0] == "KICK" && len(parts) == 2) {
+						memberId, err := strconv.ParseInt(parts[1], 10, 64)
+						if err != nil {
+							q.logger.Error("Failed to convert str to memberId", logging.Err(err))
+							continue
+						}
+						if parts[0] == "ROLE" {
+							emitMemberEvent(q.sessionId, q.memberEventsChan, MemberEvent{Kind: MemberRoleChanged, MemberId: memberId, Role: auth.Role(parts[2])})
+						} else {
+							emitMemberEvent(q.sessionId, q.memberEventsChan, MemberEvent{Kind: MemberKicked, MemberId: memberId})
+						}
+						continue
+					}
 					if parts[0] == "CLOSED" {
 						func() {
 							q.mu.Lock()
@@ -136,27 +216,80 @@ func (q *RedisEventQueue) Initialise() {
 	}()
 }
 
+// Ping checks connections of pub/sub subscriptions, go-redis reconnects them in background.
+// Queues that only publish check connection of the client.
+func (q *RedisEventQueue) Ping(ctx context.Context) error {
+	q.mu.Lock()
+	subscriptions := q.subscriptions
+	closed := q.closed
+	q.mu.Unlock()
+	if closed {
+		return nil
+	}
+	if len(subscriptions) == 0 {
+		return q.redisClient.Ping(ctx).Err()
+	}
+	for _, subscription := range subscriptions {
+		if err := subscription.Ping(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (q *RedisEventQueue) PersistSnapshot() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	removeInvalidPositionStates(q.cache, q.changed)
+	q.outdated = q.outdated || len(q.changed) > 0
+	if snapshot, err := json.Marshal(q.cache); err == nil {
+		q.redisClient.Set(context.Background(), rediskeys.SnapshotPrefix+q.sessionId, snapshot, time.Hour)
+	}
+}
+
 func (q *RedisEventQueue) RefreshNeeded() bool {
 	q.mu.Lock()
 	defer q.mu.Unlock()
 	return q.outdated && !q.closed
 }
 func (q *RedisEventQueue) GetSnapshot() map[int64]dto.PositionStateDTO {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return copyPositionStates(q.cache)
+}
+func (q *RedisEventQueue) GetChanges() ([]dto.PositionStateDTO, []int64) {
 	q.mu.Lock()
 	defer q.mu.Unlock()
 	q.outdated = false
-	return q.cache
+	return collectChanges(q.cache, q.changed)
 }
-func (q *RedisEventQueue) SessionMemberPositionChange(update dto.PositionStateDTO) {
+func (q *RedisEventQueue) SessionMemberPositionChange(ctx context.Context, update dto.PositionStateDTO) {
 	if q.closed {
 		return
 	}
-	data, err := json.Marshal(update)
+	channel := sessionPositionUpdatesChannelPrefix + q.sessionId
+	ctx, span := tracing.Tracer.Start(ctx, "position publish",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			semconv.MessagingSystem("redis"),
+			semconv.MessagingDestinationName(channel),
+			tracing.SessionIdKey.String(q.sessionId),
+			tracing.MemberIdKey.Int64(update.MemberId),
+		))
+	defer span.End()
+	data, err := json.Marshal(positionMessage{PositionStateDTO: update, Trace: tracing.Inject(ctx)})
 	if err != nil {
-		log.Printf("Failed to marshal PositionStateDTO: %s\n", err)
+		q.logger.Error("Failed to marshal PositionStateDTO", logging.Err(err))
+	}
+	if err := q.redisClient.Publish(ctx, channel, data).Err(); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
 	}
-	q.redisClient.Publish(context.Background(), sessionPositionUpdatesChannelPrefix+q.sessionId, data)
-
+}
+func (q *RedisEventQueue) TraceLinks() []trace.Link {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.traceLinks.take()
 }
 func (q *RedisEventQueue) MemberLeft(memberId int64) {
 	if q.closed {
@@ -175,13 +308,208 @@ func (q *RedisEventQueue) CloseSession() {
 	q.redisClient.Publish(context.Background(), sessionCommunicationChannelPrefix+q.sessionId, "CLOSED")
 }
 func (q *RedisEventQueue) NextMemberId() int64 {
-	memberId, err := q.redisClient.Incr(context.Background(), memberIdPrefix+q.sessionId).Result()
+	memberId, err := q.redisClient.Incr(context.Background(), rediskeys.MemberIdPrefix+q.sessionId).Result()
 	if err != nil {
 		panic(err)
 	}
 	return memberId
 }
 
+func (q *RedisEventQueue) SetMemberRole(memberId int64, role auth.Role) {
+	if q.closed {
+		return
+	}
+	key := rediskeys.RolesPrefix + q.sessionId
+	q.redisClient.HSet(context.Background(), key, strconv.FormatInt(memberId, 10), string(role))
+	q.redisClient.Expire(context.Background(), key, q.rosterTTL)
+	if member, err := q.getMember(memberId); err == nil {
+		member.Role = string(role)
+		q.storeMember(member)
+	}
+	q.redisClient.Publish(context.Background(), sessionCommunicationChannelPrefix+q.sessionId, fmt.Sprintf("ROLE;%d;%s", memberId, role))
+}
+func (q *RedisEventQueue) GetMemberRole(memberId int64) (auth.Role, bool) {
+	role, err := q.redisClient.HGet(context.Background(), rediskeys.RolesPrefix+q.sessionId, strconv.FormatInt(memberId, 10)).Result()
+	if err != nil {
+		return "", false
+	}
+	return auth.Role(role), true
+}
+func (q *RedisEventQueue) KickMember(memberId int64) {
+	if q.closed {
+		return
+	}
+	q.redisClient.Publish(context.Background(), sessionCommunicationChannelPrefix+q.sessionId, fmt.Sprintf("KICK;%d", memberId))
+}
+func (q *RedisEventQueue) SessionUpdated(session dto.SessionDTO) {
+	if q.closed {
+		return
+	}
+	data, err := json.Marshal(session)
+	if err != nil {
+		q.logger.Error("Failed to marshal SessionDTO", logging.Err(err))
+		return
+	}
+	q.redisClient.Publish(context.Background(), sessionCommunicationChannelPrefix+q.sessionId, sessionMessagePrefix+string(data))
+}
+
+func (q *RedisEventQueue) MemberJoined(member dto.MemberDTO) {
+	if q.closed {
+		return
+	}
+	q.storeMember(member)
+	key := rediskeys.InstancesPrefix + q.sessionId
+	q.redisClient.HSet(context.Background(), key, strconv.FormatInt(member.MemberId, 10), instanceId)
+	q.redisClient.Expire(context.Background(), key, q.rosterTTL)
+	q.TouchMember(member.MemberId)
+	q.publishPresence(dto.PresenceJoined, member)
+}
+func (q *RedisEventQueue) MemberRenamed(memberId int64, identifier string) {
+	q.updateMember(memberId, dto.PresenceRenamed, func(member *dto.MemberDTO) {
+		member.GivenIdentifier = identifier
+	})
+}
+func (q *RedisEventQueue) MemberDisconnected(memberId int64) {
+	q.TouchMember(memberId)
+	q.updateMember(memberId, dto.PresenceLeft, func(member *dto.MemberDTO) {
+		member.State = dto.MemberDisconnected
+		member.LastActivityAt = time.Now().UnixMilli()
+	})
+}
+func (q *RedisEventQueue) TouchMember(memberId int64) {
+	key := rediskeys.ActivityPrefix + q.sessionId
+	q.redisClient.HSet(context.Background(), key, strconv.FormatInt(memberId, 10), time.Now().UnixMilli())
+	q.redisClient.Expire(context.Background(), key, q.rosterTTL)
+	q.redisClient.Set(context.Background(), rediskeys.LastActivityPrefix+q.sessionId, time.Now().UnixMilli(), q.rosterTTL)
+}
+func (q *RedisEventQueue) LastActivity() time.Time {
+	lastActivity, err := q.redisClient.Get(context.Background(), rediskeys.LastActivityPrefix+q.sessionId).Int64()
+	if err != nil {
+		return time.Time{}
+	}
+	return time.UnixMilli(lastActivity)
+}
+
+// GetMembers reads the roster in two round trips, one for its hashes and one for heartbeats.
+func (q *RedisEventQueue) GetMembers() []dto.MemberDTO {
+	members := make([]dto.MemberDTO, 0)
+	pipe := q.redisClient.Pipeline()
+	entriesCmd := pipe.HGetAll(context.Background(), rediskeys.MembersPrefix+q.sessionId)
+	activityCmd := pipe.HGetAll(context.Background(), rediskeys.ActivityPrefix+q.sessionId)
+	instancesCmd := pipe.HGetAll(context.Background(), rediskeys.InstancesPrefix+q.sessionId)
+	_, _ = pipe.Exec(context.Background())
+	entries, err := entriesCmd.Result()
+	if err != nil {
+		q.logger.Error("Failed to get members", logging.Err(err))
+		return members
+	}
+	activity, err := activityCmd.Result()
+	if err != nil {
+		q.logger.Error("Failed to get activity", logging.Err(err))
+	}
+	instances, err := instancesCmd.Result()
+	if err != nil {
+		q.logger.Error("Failed to get instances", logging.Err(err))
+	}
+	alive := q.aliveInstances(instances)
+
+	for field, entry := range entries {
+		var member dto.MemberDTO
+		if err := json.Unmarshal([]byte(entry), &member); err != nil {
+			continue
+		}
+		if lastActivityAt, err := strconv.ParseInt(activity[field], 10, 64); err == nil {
+			member.LastActivityAt = max(member.LastActivityAt, lastActivityAt)
+		}
+		if member.State == dto.MemberConnected && !alive[instances[field]] {
+			member.State = dto.MemberDisconnected
+		}
+		if rosterExpired(member) {
+			q.redisClient.HDel(context.Background(), rediskeys.MembersPrefix+q.sessionId, field)
+			q.redisClient.HDel(context.Background(), rediskeys.ActivityPrefix+q.sessionId, field)
+			q.redisClient.HDel(context.Background(), rediskeys.InstancesPrefix+q.sessionId, field)
+			continue
+		}
+		members = append(members, member)
+	}
+	return members
+}
+
+// heartbeat confirms this instance still serves members of the session.
+func (q *RedisEventQueue) heartbeat() {
+	q.redisClient.Set(context.Background(), heartbeatPrefix+q.sessionId+"-"+instanceId, time.Now().UnixMilli(), heartbeatTTL)
+}
+
+// aliveInstances tells which instances of roster still send heartbeats. Members stored
+// without instance, e.g. by older versions, are assumed to be connected.
+func (q *RedisEventQueue) aliveInstances(instances map[string]string) map[string]bool {
+	alive := map[string]bool{"": true}
+	heartbeats := make(map[string]*redis.IntCmd)
+	pipe := q.redisClient.Pipeline()
+	for _, instance := range instances {
+		if _, checked := heartbeats[instance]; checked || instance == "" {
+			continue
+		}
+		heartbeats[instance] = pipe.Exists(context.Background(), heartbeatPrefix+q.sessionId+"-"+instance)
+	}
+	if len(heartbeats) > 0 {
+		_, _ = pipe.Exec(context.Background())
+	}
+	for instance, heartbeat := range heartbeats {
+		exists, err := heartbeat.Result()
+		// members aren't dropped while Redis can't tell
+		alive[instance] = err != nil || exists > 0
+	}
+	return alive
+}
+
+func (q *RedisEventQueue) updateMember(memberId int64, eventType string, update func(member *dto.MemberDTO)) {
+	if q.closed {
+		return
+	}
+	member, err := q.getMember(memberId)
+	if err != nil {
+		return
+	}
+	update(&member)
+	q.storeMember(member)
+	q.publishPresence(eventType, member)
+}
+
+func (q *RedisEventQueue) getMember(memberId int64) (dto.MemberDTO, error) {
+	var member dto.MemberDTO
+	entry, err := q.redisClient.HGet(context.Background(), rediskeys.MembersPrefix+q.sessionId, strconv.FormatInt(memberId, 10)).Result()
+	if err != nil {
+		return member, err
+	}
+	err = json.Unmarshal([]byte(entry), &member)
+	return member, err
+}
+
+func (q *RedisEventQueue) storeMember(member dto.MemberDTO) {
+	data, err := json.Marshal(member)
+	if err != nil {
+		q.logger.Error("Failed to marshal MemberDTO", logging.Err(err))
+		return
+	}
+	key := rediskeys.MembersPrefix + q.sessionId
+	q.redisClient.HSet(context.Background(), key, strconv.FormatInt(member.MemberId, 10), data)
+	q.redisClient.Expire(context.Background(), key, q.rosterTTL)
+}
+
+func (q *RedisEventQueue) publishPresence(eventType string, member dto.MemberDTO) {
+	data, err := json.Marshal(dto.PresenceEventDTO{Type: eventType, Member: member})
+	if err != nil {
+		q.logger.Error("Failed to marshal PresenceEventDTO", logging.Err(err))
+		return
+	}
+	q.redisClient.Publish(context.Background(), sessionCommunicationChannelPrefix+q.sessionId, presenceMessagePrefix+string(data))
+}
+
 func (q *RedisEventQueue) OnSessionClosed() <-chan struct{} {
 	return q.sessionClosedChan
 }
+
+func (q *RedisEventQueue) OnMemberEvent() <-chan MemberEvent {
+	return q.memberEventsChan
+}
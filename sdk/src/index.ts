@@ -7,12 +7,33 @@ export type SessionMember = {
   location: string | undefined;
 };
 
+export type JoinToken = {
+  token: string;
+  role: string;
+  expiresAt: number;
+};
+
 export type Session = {
   id: string;
   joinUrl: string;
   name: string;
   base: string;
   creatorIdentifier: string;
+  // unix seconds
+  expiresAt: number;
+  idleTimeoutSeconds: number;
+  version: number;
+  memberCount: number;
+  // unix seconds
+  createdAt: number;
+  updatedAt: number;
+  tags: string[];
+  maxMembers?: number;
+  attributes?: Record<string, unknown>;
+  // only present on session returned by createSession
+  ownerSecret?: string;
+  hostToken?: JoinToken;
+  joinToken?: JoinToken;
 };
 
 type UpdatePositionCmd = {
@@ -104,7 +125,8 @@ export class BrowseTogetherSdk {
   public joinSession(
     session: Session,
     givenIdentifier: string,
-    rejoinToken: string | undefined = undefined
+    rejoinToken: string | undefined = undefined,
+    joinToken: string | undefined = session.hostToken?.token ?? session.joinToken?.token
   ): Promise<string | undefined> {
     return new Promise<string | undefined>(async (resolve, reject) => {
       this.session = session;
@@ -112,14 +134,21 @@ export class BrowseTogetherSdk {
         `${this.url}/api/v1/sessions/${session.id}/join`,
         {
           method: "POST",
+          headers: {
+            Authorization: `Bearer ${joinToken ?? ""}`,
+          },
         }
       );
+      if (!response.ok) {
+        this.session = undefined;
+        reject(`Failed to join session: ${response.status}`);
+        return;
+      }
       const json: { joinUrl: string } = await response.json();
-      const joinUrl = json.joinUrl.startsWith("/")
-        ? this.url.replace(/(http)(s)?\:\/\//, "ws$2://") +
-          json.joinUrl +
-          (rejoinToken ? "?rejoinToken=" + rejoinToken : "")
-        : json.joinUrl;
+      const joinUrl = (json.joinUrl.startsWith("/")
+        ? this.url.replace(/(http)(s)?\:\/\//, "ws$2://") + json.joinUrl
+        : json.joinUrl) +
+        (rejoinToken ? "&rejoinToken=" + rejoinToken : "");
 
       this.sock = new WebSocket(joinUrl);
       this.sock.onclose = () => {
@@ -175,10 +204,13 @@ export class BrowseTogetherSdk {
     }
   }
 
-  public async closeSession() {
+  public async closeSession(ownerSecret: string | undefined = this.session?.ownerSecret) {
     if (this.session) {
       await fetch(`${this.url}/api/v1/sessions/${this.session.id}`, {
         method: "DELETE",
+        headers: {
+          Authorization: `Bearer ${ownerSecret ?? ""}`,
+        },
       });
     }
   }
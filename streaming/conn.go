@@ -0,0 +1,13 @@
+package streaming
+
+import "time"
+
+// Conn is a WebSocket connection of a member. Connections upgraded by Fiber and
+// by net/http Upgrader of github.com/fasthttp/websocket both implement it.
+// Message types are websocket.TextMessage and websocket.BinaryMessage.
+type Conn interface {
+	ReadMessage() (messageType int, data []byte, err error)
+	WriteMessage(messageType int, data []byte) error
+	SetWriteDeadline(t time.Time) error
+	Close() error
+}
@@ -0,0 +1,109 @@
+package streaming
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/dwilkolek/browse-together-api/db"
+	"github.com/dwilkolek/browse-together-api/dto"
+	"github.com/dwilkolek/browse-together-api/logging"
+)
+
+// IdleTimeout returns how long session is kept without connected members, falling back to configured default.
+func (r *Registry) IdleTimeout(session db.Session) time.Duration {
+	if session.IdleTimeoutSeconds > 0 {
+		return time.Duration(session.IdleTimeoutSeconds) * time.Second
+	}
+	return r.defaultIdleTimeout
+}
+
+// RunJanitor closes expired and idle sessions every interval until ctx is done. Only the
+// instance holding the janitor claim sweeps stored sessions, every instance closes its own
+// sessions that are gone from the store and releases publishers it doesn't need.
+func (r *Registry) RunJanitor(ctx context.Context, store db.Db, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			var expired map[string]bool
+			// the claim lapses just before the next tick, so its holder usually keeps it
+			if store.ClaimJanitor(interval - interval/10) {
+				expired = r.sweep(store)
+			}
+			r.tidy(store, expired)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// sweep deletes and closes stored sessions that expired or were idle for too long.
+func (r *Registry) sweep(store db.Db) map[string]bool {
+	now := time.Now()
+	expired := make(map[string]bool)
+	for _, session := range store.GetSessions() {
+		if session.ExpiresAt != 0 && now.Unix() >= session.ExpiresAt {
+			slog.Info("Session expired", logging.SessionIdKey, session.Id)
+			expired[session.Id] = true
+		} else if idle := r.idleFor(session, now); idle >= r.IdleTimeout(session) {
+			slog.Info("Session idle", logging.SessionIdKey, session.Id, "idle", idle.Round(time.Second))
+			expired[session.Id] = true
+		}
+	}
+	for sessionId := range expired {
+		if err := store.DeleteSession(sessionId); err != nil && !errors.Is(err, db.ErrNotFound) {
+			slog.Error("Failed to remove expired session", logging.SessionIdKey, sessionId, logging.Err(err))
+		}
+		r.CloseSession(sessionId)
+	}
+	return expired
+}
+
+// tidy closes sessions of this instance that vanished from store on their own, e.g. with
+// redis TTL, except those sweep already closed. Publishers are released when roster is
+// shared, they are created again when needed.
+func (r *Registry) tidy(store db.Db, closed map[string]bool) {
+	r.mu.Lock()
+	sessionIds := make([]string, 0, len(r.sessions)+len(r.publishers))
+	for sessionId := range r.sessions {
+		sessionIds = append(sessionIds, sessionId)
+	}
+	for sessionId := range r.publishers {
+		sessionIds = append(sessionIds, sessionId)
+	}
+	if r.sharedRoster {
+		clear(r.publishers)
+	}
+	r.mu.Unlock()
+	for _, sessionId := range sessionIds {
+		if closed[sessionId] {
+			continue
+		}
+		if _, err := store.GetSession(sessionId); errors.Is(err, db.ErrNotFound) {
+			slog.Info("Session no longer stored", logging.SessionIdKey, sessionId)
+			r.CloseSession(sessionId)
+		}
+	}
+}
+
+// idleFor returns how long nobody was connected to the session, zero if somebody is
+// or there is nothing to tell.
+func (r *Registry) idleFor(session db.Session, now time.Time) time.Duration {
+	roster := r.roster(session.Id)
+	for _, member := range roster.GetMembers() {
+		if member.State == dto.MemberConnected {
+			return 0
+		}
+	}
+	lastActivity := roster.LastActivity()
+	if created := time.Unix(session.CreatedAt, 0); session.CreatedAt != 0 && created.After(lastActivity) {
+		lastActivity = created
+	}
+	if lastActivity.IsZero() {
+		return 0
+	}
+	return now.Sub(lastActivity)
+}
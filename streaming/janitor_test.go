@@ -0,0 +1,86 @@
+package streaming
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/dwilkolek/browse-together-api/config"
+	"github.com/dwilkolek/browse-together-api/db"
+	"github.com/dwilkolek/browse-together-api/queue"
+)
+
+func TestSweepClosesIdleSessionsWithoutKeepingPublishers(t *testing.T) {
+	cfg := config.Default()
+	queues, err := queue.NewFactory(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := db.Open(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := NewRegistry(cfg, queues)
+	now := time.Now()
+	sessions := []db.Session{
+		{Id: "idle", CreatedAt: now.Add(-time.Hour).Unix(), IdleTimeoutSeconds: 60},
+		{Id: "expired", CreatedAt: now.Unix(), ExpiresAt: now.Add(-time.Second).Unix()},
+		{Id: "fresh", CreatedAt: now.Unix()},
+	}
+	for _, session := range sessions {
+		if err := store.StoreSession(session); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expired := registry.sweep(store)
+	if len(expired) != 2 || !expired["idle"] || !expired["expired"] {
+		t.Errorf("expired %v", expired)
+	}
+	for _, sessionId := range []string{"idle", "expired"} {
+		if _, err := store.GetSession(sessionId); !errors.Is(err, db.ErrNotFound) {
+			t.Errorf("session %s is still stored, %v", sessionId, err)
+		}
+	}
+	if _, err := store.GetSession("fresh"); err != nil {
+		t.Error(err)
+	}
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	if len(registry.publishers) != 0 {
+		t.Errorf("sweep kept %d publishers", len(registry.publishers))
+	}
+}
+
+func TestTidyReleasesPublishersOnlyWhenRosterIsShared(t *testing.T) {
+	for _, shared := range []bool{false, true} {
+		cfg := config.Default()
+		queues, err := queue.NewFactory(cfg, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		store, err := db.Open(cfg, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := store.StoreSession(db.Session{Id: "session"}); err != nil {
+			t.Fatal(err)
+		}
+		registry := NewRegistry(cfg, queues)
+		registry.sharedRoster = shared
+		registry.publisher("session")
+		registry.publisher("gone")
+
+		registry.tidy(store, nil)
+		registry.mu.Lock()
+		_, kept := registry.publishers["session"]
+		_, keptGone := registry.publishers["gone"]
+		registry.mu.Unlock()
+		if kept == shared {
+			t.Errorf("with shared roster %v publisher kept is %v", shared, kept)
+		}
+		if keptGone {
+			t.Errorf("with shared roster %v publisher of session that isn't stored is kept", shared)
+		}
+	}
+}
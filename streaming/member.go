@@ -0,0 +1,160 @@
+package streaming
+
+import (
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"github.com/dwilkolek/browse-together-api/auth"
+	"github.com/dwilkolek/browse-together-api/logging"
+	"github.com/dwilkolek/browse-together-api/metrics"
+	"github.com/dwilkolek/browse-together-api/protocol"
+)
+
+// touchInterval throttles roster activity updates caused by position changes.
+const touchInterval = 5 * time.Second
+
+// writeQueueSize bounds frames waiting for a member, queued snapshots and deltas
+// are dropped in favour of a keyframe once it fills up.
+const writeQueueSize = 16
+const writeTimeout = 10 * time.Second
+
+// slowConsumerTimeout is how long a member's queue may stay full without any
+// successful write before the member is disconnected.
+const slowConsumerTimeout = 5 * time.Second
+
+// outgoing is a frame waiting to be written, positions marks snapshots and deltas
+// which may be dropped as the next keyframe supersedes them.
+type outgoing struct {
+	frame     protocol.Frame
+	positions bool
+}
+
+type Member struct {
+	Id            int64
+	conn          Conn
+	codec         protocol.Codec
+	out           chan outgoing
+	done          chan struct{}
+	lastWrite     atomic.Int64
+	role          atomic.Value
+	joinedAt      time.Time
+	lastTouched   time.Time
+	ready         bool
+	needsKeyframe bool
+	logger        *slog.Logger
+}
+
+func newMember(memberId int64, role auth.Role, conn Conn, codec protocol.Codec, logger *slog.Logger) *Member {
+	member := &Member{
+		Id:            memberId,
+		conn:          conn,
+		codec:         codec,
+		out:           make(chan outgoing, writeQueueSize),
+		done:          make(chan struct{}),
+		needsKeyframe: true,
+		joinedAt:      time.Now(),
+		logger:        logger,
+	}
+	member.lastWrite.Store(time.Now().UnixNano())
+	member.role.Store(role)
+	go member.writeLoop()
+	return member
+}
+
+func (m *Member) Role() auth.Role {
+	return m.role.Load().(auth.Role)
+}
+
+func (m *Member) writeLoop() {
+	defer close(m.done)
+	for queued := range m.out {
+		m.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		if err := m.conn.WriteMessage(queued.frame.MessageType, queued.frame.Data); err != nil {
+			m.logger.Warn("Failed writing to member", logging.Err(err))
+			metrics.WriteErrors.Inc()
+			m.conn.Close()
+			for range m.out {
+			}
+			return
+		}
+		m.lastWrite.Store(time.Now().UnixNano())
+	}
+}
+
+// enqueue queues a control or event frame without blocking. When the queue is full,
+// queued snapshots and deltas are dropped to make room and member gets a keyframe
+// next time. It returns false when there is no room even then, member should be
+// evicted. Callers hold lock of the session, so nobody else fills the queue.
+func (m *Member) enqueue(frame protocol.Frame) bool {
+	select {
+	case m.out <- outgoing{frame: frame}:
+		return true
+	default:
+	}
+
+	m.dropPositions()
+	select {
+	case m.out <- outgoing{frame: frame}:
+		return true
+	default:
+		return false
+	}
+}
+
+// enqueuePositions queues a snapshot or delta without blocking, it returns whether the
+// frame was queued. When the queue is full, the frame and stale snapshots and deltas
+// are dropped and member gets a keyframe next time. responsive is false when member
+// hasn't written anything for slowConsumerTimeout and should be evicted.
+func (m *Member) enqueuePositions(frame protocol.Frame) (queued bool, responsive bool) {
+	select {
+	case m.out <- outgoing{frame: frame, positions: true}:
+		return true, true
+	default:
+	}
+
+	if time.Since(time.Unix(0, m.lastWrite.Load())) > slowConsumerTimeout {
+		return false, false
+	}
+	metrics.FramesDropped.Inc()
+	m.dropPositions()
+	return false, true
+}
+
+// enqueueClose queues the last frame for member, it is never dropped. Anything that
+// doesn't fit before it is discarded as the connection is closed afterwards anyway.
+func (m *Member) enqueueClose(frame protocol.Frame) {
+	for {
+		select {
+		case m.out <- outgoing{frame: frame}:
+			return
+		default:
+		}
+		m.dropPositions()
+		select {
+		case <-m.out:
+		default:
+		}
+	}
+}
+
+// dropPositions discards queued snapshots and deltas, other frames are kept in order.
+func (m *Member) dropPositions() {
+	var kept []outgoing
+	for len(m.out) > 0 {
+		select {
+		case stale := <-m.out:
+			if !stale.positions {
+				kept = append(kept, stale)
+				continue
+			}
+			metrics.FramesDropped.Inc()
+		default:
+		}
+	}
+	for _, frame := range kept {
+		m.out <- frame
+	}
+	m.codec.Reset()
+	m.needsKeyframe = true
+}
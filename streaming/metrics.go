@@ -0,0 +1,63 @@
+package streaming
+
+import (
+	"slices"
+	"sync"
+
+	"github.com/dwilkolek/browse-together-api/metrics"
+)
+
+// registries are registries of the process that weren't drained, gauges are global
+// like the rest of metrics.
+var registries []*Registry
+var registriesLock sync.Mutex
+
+func init() {
+	metrics.ObserveSessions(func() int {
+		sessions := 0
+		for _, registry := range observed() {
+			sessions += len(registry.sessionStates())
+		}
+		return sessions
+	}, func() int {
+		members := 0
+		for _, registry := range observed() {
+			for _, sessionState := range registry.sessionStates() {
+				sessionState.lockMe("metrics")
+				members += len(sessionState.members)
+				sessionState.unlockMe("metrics")
+			}
+		}
+		return members
+	})
+}
+
+func observe(registry *Registry) {
+	registriesLock.Lock()
+	defer registriesLock.Unlock()
+	registries = append(registries, registry)
+}
+
+// forget stops observing drained registry, so it can be garbage collected.
+func forget(registry *Registry) {
+	registriesLock.Lock()
+	defer registriesLock.Unlock()
+	registries = slices.DeleteFunc(registries, func(r *Registry) bool { return r == registry })
+}
+
+func observed() []*Registry {
+	registriesLock.Lock()
+	defer registriesLock.Unlock()
+	return append([]*Registry(nil), registries...)
+}
+
+// sessionStates returns sessions with members on this instance.
+func (r *Registry) sessionStates() []*SessionState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sessions := make([]*SessionState, 0, len(r.sessions))
+	for _, sessionState := range r.sessions {
+		sessions = append(sessions, sessionState)
+	}
+	return sessions
+}
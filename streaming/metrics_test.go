@@ -0,0 +1,95 @@
+package streaming
+
+import (
+	"context"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// scrape is what Prometheus reads from /metrics, values are keyed by series like
+// browse_together_frames_broadcast_total{kind="delta"}, types by metric name.
+type scrape struct {
+	values map[string]float64
+	types  map[string]string
+}
+
+func scrapeMetrics(t *testing.T) scrape {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	promhttp.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	s := scrape{values: map[string]float64{}, types: map[string]string{}}
+	for _, line := range strings.Split(recorder.Body.String(), "\n") {
+		if typeLine, ok := strings.CutPrefix(line, "# TYPE "); ok {
+			name, kind, _ := strings.Cut(typeLine, " ")
+			s.types[name] = kind
+			continue
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndexByte(line, ' ')
+		value, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			t.Fatalf("scraped %q: %v", line, err)
+		}
+		s.values[line[:i]] = value
+	}
+	return s
+}
+
+// expectIncrease checks series was scraped after and grew by increase since before.
+func expectIncrease(t *testing.T, before scrape, after scrape, series string, increase float64) {
+	t.Helper()
+	value, ok := after.values[series]
+	if !ok {
+		t.Errorf("%s wasn't scraped", series)
+		return
+	}
+	if value-before.values[series] != increase {
+		t.Errorf("%s grew by %v, expected %v", series, value-before.values[series], increase)
+	}
+}
+
+func TestBroadcastMetricsAreScraped(t *testing.T) {
+	state := newTestSession(t)
+	initial := scrapeMetrics(t)
+
+	// keyframe and deltas filling the queue of a member that stopped reading
+	member, conn := joinStuck(t, state, 1)
+	broadcast := scrapeMetrics(t)
+	expectIncrease(t, initial, broadcast, `browse_together_frames_broadcast_total{kind="snapshot"}`, 1)
+	expectIncrease(t, initial, broadcast, `browse_together_frames_broadcast_total{kind="delta"}`, writeQueueSize)
+	expectIncrease(t, initial, broadcast, "browse_together_broadcast_duration_seconds_count", writeQueueSize+1)
+
+	state.SessionMemberPositionChange(context.Background(), position(1, 0.9, "#a"))
+	notifyClients(state)
+	dropped := scrapeMetrics(t)
+	expectIncrease(t, broadcast, dropped, "browse_together_frames_dropped_total", writeQueueSize+1)
+	expectIncrease(t, broadcast, dropped, `browse_together_frames_broadcast_total{kind="delta"}`, 0)
+
+	for x := 0.1; len(member.out) < writeQueueSize; x += 0.01 {
+		state.SessionMemberPositionChange(context.Background(), position(1, x, "#a"))
+		notifyClients(state)
+	}
+	member.lastWrite.Store(time.Now().Add(-slowConsumerTimeout).UnixNano())
+	state.SessionMemberPositionChange(context.Background(), position(1, 0.9, "#a"))
+	notifyClients(state)
+	evicted := scrapeMetrics(t)
+	expectIncrease(t, dropped, evicted, "browse_together_unresponsive_members_total", 1)
+	for name, kind := range map[string]string{
+		"browse_together_frames_broadcast_total":     "counter",
+		"browse_together_broadcast_duration_seconds": "histogram",
+		"browse_together_frames_dropped_total":       "counter",
+		"browse_together_unresponsive_members_total": "counter",
+	} {
+		if evicted.types[name] != kind {
+			t.Errorf("%s registered as %q, expected %s", name, evicted.types[name], kind)
+		}
+	}
+	close(conn.release)
+}
@@ -1,94 +1,485 @@
 package streaming
 
 import (
-	"github.com/dwilkolek/browse-together-api/config"
-	"log"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
 	"sync"
 	"time"
 
+	"github.com/dwilkolek/browse-together-api/auth"
+	"github.com/dwilkolek/browse-together-api/config"
+	"github.com/dwilkolek/browse-together-api/db"
 	"github.com/dwilkolek/browse-together-api/dto"
+	"github.com/dwilkolek/browse-together-api/logging"
+	"github.com/dwilkolek/browse-together-api/metrics"
+	"github.com/dwilkolek/browse-together-api/protocol"
 	"github.com/dwilkolek/browse-together-api/queue"
-	"github.com/gofiber/contrib/websocket"
+	"github.com/dwilkolek/browse-together-api/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// keyframeInterval is how often a full snapshot replaces the delta broadcast
+// when positions changed, so clients converge even if they missed a frame.
+const keyframeInterval = 5 * time.Second
+
 type SessionState struct {
 	queue.EventQueue
-	sessionId string
-	members   map[int64]*websocket.Conn
-	lock      sync.Mutex
+	sessionId            string
+	members              map[int64]*Member
+	visible              map[int64]dto.PositionStateDTO
+	lastKeyframe         time.Time
+	changedSinceKeyframe bool
+	lock                 sync.Mutex
+	logger               *slog.Logger
 }
 
-var mu = sync.Mutex{}
+// SessionRegistry tracks sessions with members connected to a server, implemented by *Registry.
+type SessionRegistry interface {
+	JoinSession(session db.Session, conn Conn, codec protocol.Codec, memberId int64, role auth.Role) (*Member, *SessionState, error)
+	CloseSession(sessionId string)
+	GetMembers(sessionId string) []dto.MemberDTO
+	MemberCount(sessionId string) int
+	KickMember(sessionId string, memberId int64)
+	UpdateSession(session dto.SessionDTO)
+	SetMemberRole(sessionId string, memberId int64, role auth.Role)
+	// TickRate and IdleTimeout fill in configured defaults for session.
+	TickRate(session db.Session) int
+	IdleTimeout(session db.Session) time.Duration
+	Drain(ctx context.Context, rejoinToken func(sessionId string, memberId int64) string)
+	// Ping checks queues still deliver updates from other instances.
+	Ping(ctx context.Context) error
+}
 
-var state = make(map[string]*SessionState)
+// Registry keeps sessions with members connected to one server, servers in the
+// same process don't share sessions unless their queues do.
+type Registry struct {
+	mu       sync.Mutex
+	sessions map[string]*SessionState
+	// publishers are queues of sessions without members on this instance, kept so
+	// in-memory state, e.g. roles, outlives the request and is taken over on join.
+	publishers map[string]queue.EventQueue
+	// sharedRoster is set when queues keep roster and roles in Redis, publishers
+	// hold nothing then and janitor releases them.
+	sharedRoster bool
+	// pinger is the queue Ping checks besides queues of sessions.
+	pinger             queue.EventQueue
+	newQueue           queue.Factory
+	broadcast          config.Broadcast
+	defaultIdleTimeout time.Duration
+}
 
-func (state *SessionState) lockMe(reason string) {
-	if config.DEBUG {
-		log.Printf("Locking %s: %s\n", reason, state.sessionId)
+// NewRegistry returns registry creating queues of sessions with newQueue.
+func NewRegistry(cfg config.Config, newQueue queue.Factory) *Registry {
+	registry := &Registry{
+		sessions:           make(map[string]*SessionState),
+		publishers:         make(map[string]queue.EventQueue),
+		pinger:             newQueue(""),
+		sharedRoster:       cfg.Queue == config.Redis,
+		newQueue:           newQueue,
+		broadcast:          cfg.Broadcast,
+		defaultIdleTimeout: cfg.Session.IdleTimeout,
 	}
+	observe(registry)
+	return registry
+}
+
+func (state *SessionState) lockMe(reason string) {
+	state.logger.Debug("Locking", "reason", reason)
 	state.lock.Lock()
 }
 func (state *SessionState) unlockMe(reason string) {
-	if config.DEBUG {
-		log.Printf("Unlock %s: %s\n", reason, state.sessionId)
-	}
+	state.logger.Debug("Unlock", "reason", reason)
 	state.lock.Unlock()
 }
-func (state *SessionState) addMember(conn *websocket.Conn) int64 {
+func (state *SessionState) addMember(conn Conn, codec protocol.Codec, memberId int64, role auth.Role, maxMembers int) (*Member, error) {
+	// roster, ids and roles may live in Redis, they're read before locking so a slow
+	// round trip doesn't hold up broadcasts. Local members are counted under the lock.
+	var roster []dto.MemberDTO
+	if maxMembers > 0 {
+		roster = state.GetMembers()
+	}
+	if memberId < 1 {
+		memberId = state.NextMemberId()
+	} else if overridden, ok := state.GetMemberRole(memberId); ok {
+		// rejoining keeps demotions, but never grants more than the join token
+		role = role.Min(overridden)
+	}
+
 	state.lockMe("addClient")
 	defer state.unlockMe("addClient")
-	log.Printf("New client. In total %d members\n", len(state.members))
-	memberId := state.NextMemberId()
-	state.members[memberId] = conn
-	return memberId
+	state.logger.Info("New client", "members", len(state.members))
+	if maxMembers > 0 && state.connectedMembers(roster, memberId) >= maxMembers {
+		return nil, ErrSessionFull
+	}
+	if previous, ok := state.members[memberId]; ok {
+		state.logger.Info("Member rejoined, closing previous connection", logging.MemberIdKey, memberId)
+		state.removeMember(previous)
+		previous.conn.Close()
+	}
+	member := newMember(memberId, role, conn, codec, state.logger.With(logging.MemberIdKey, memberId))
+	state.members[memberId] = member
+	return member, nil
 }
 
-func JoinSession(sessionId string, conn *websocket.Conn, memberId int64) (int64, *SessionState) {
-	log.Printf("Starting position listening %s\n", sessionId)
-	mu.Lock()
-	defer mu.Unlock()
-	if state[sessionId] == nil {
-		queueForSession := queue.GetEventQueueForSession(sessionId)
-		session := &SessionState{
-			EventQueue: queueForSession,
-			sessionId:  sessionId,
-			members:    map[int64]*websocket.Conn{},
+// connectedMembers counts members of roster connected to any instance except the one with
+// given id, members of this instance that weren't greeted yet are also counted.
+func (state *SessionState) connectedMembers(roster []dto.MemberDTO, except int64) int {
+	connected := make(map[int64]bool)
+	for _, member := range roster {
+		if member.State == dto.MemberConnected {
+			connected[member.MemberId] = true
 		}
-		session.Initialise()
+	}
+	for memberId := range state.members {
+		connected[memberId] = true
+	}
+	delete(connected, except)
+	return len(connected)
+}
 
-		go notifyClientsLoop(session, queueForSession)
-		go listenForSessionClose(queueForSession, sessionId)
-		state[sessionId] = session
+// removeMember stops member's writer, it's a noop if member was already removed or replaced.
+func (state *SessionState) removeMember(member *Member) bool {
+	if state.members[member.Id] != member {
+		return false
 	}
+	delete(state.members, member.Id)
+	close(member.out)
+	return true
+}
 
-	if memberId < 1 {
-		memberId = state[sessionId].addMember(conn)
+// Greet sends hello with members already connected as the very first frame,
+// starts broadcasting to member and announces it to others.
+func (state *SessionState) Greet(member *Member, hello dto.HelloDTO, identifier string) error {
+	hello.Members = []dto.MemberDTO{}
+	for _, other := range state.GetMembers() {
+		if other.MemberId != member.Id && other.State == dto.MemberConnected {
+			hello.Members = append(hello.Members, other)
+		}
+	}
+	slices.SortFunc(hello.Members, func(a, b dto.MemberDTO) int {
+		return cmp.Compare(a.MemberId, b.MemberId)
+	})
+	frame, err := member.codec.EncodeHello(hello)
+	if err != nil {
+		return err
+	}
+
+	state.lockMe("greet")
+	if state.members[member.Id] != member {
+		state.unlockMe("greet")
+		return nil
+	}
+	state.deliver(member, frame)
+	member.ready = true
+	state.unlockMe("greet")
+
+	state.MemberJoined(dto.MemberDTO{
+		MemberId:        member.Id,
+		GivenIdentifier: identifier,
+		Role:            string(member.Role()),
+		JoinedAt:        member.joinedAt.UnixMilli(),
+		LastActivityAt:  member.joinedAt.UnixMilli(),
+		State:           dto.MemberConnected,
+	})
+	return nil
+}
+
+func (state *SessionState) Rename(member *Member, identifier string) {
+	state.MemberRenamed(member.Id, identifier)
+}
+
+// PositionChanged publishes position of member, it must be called from a single goroutine per member.
+func (state *SessionState) PositionChanged(ctx context.Context, member *Member, position dto.PositionStateDTO) {
+	metrics.PositionUpdates.Inc()
+	state.SessionMemberPositionChange(ctx, position)
+	if time.Since(member.lastTouched) > touchInterval {
+		member.lastTouched = time.Now()
+		state.TouchMember(member.Id)
+	}
+}
+
+// Leave removes member from the session and waits until its pending writes are done.
+func (state *SessionState) Leave(member *Member) {
+	state.lockMe("leave")
+	removed := state.removeMember(member)
+	state.unlockMe("leave")
+	<-member.done
+	if removed {
+		state.memberGone(member)
+	}
+}
+
+// memberGone removes cursor of a member that is no longer connected.
+func (state *SessionState) memberGone(member *Member) {
+	state.MemberLeft(member.Id)
+	state.MemberDisconnected(member.Id)
+}
+
+// ReplyError tells member its message was rejected.
+func (state *SessionState) ReplyError(member *Member, protocolErr *protocol.Error) {
+	state.lockMe("replyError")
+	defer state.unlockMe("replyError")
+	state.send(member, func(codec protocol.Codec) (protocol.Frame, error) {
+		return codec.EncodeError(protocolErr.DTO())
+	})
+}
+
+// SendClose queues the last message for member before the connection is closed.
+func (state *SessionState) SendClose(member *Member, closeMsg dto.CloseDTO) {
+	state.lockMe("sendClose")
+	defer state.unlockMe("sendClose")
+	state.sendClose(member, closeMsg)
+}
+
+// disconnect sends close message and closes connection once it's written.
+func (state *SessionState) disconnect(member *Member, closeMsg dto.CloseDTO) {
+	state.sendClose(member, closeMsg)
+	if state.removeMember(member) {
+		go func() {
+			<-member.done
+			member.conn.Close()
+			state.memberGone(member)
+		}()
+	}
+}
+
+func (state *SessionState) sendPresence(member *Member, event dto.PresenceEventDTO) {
+	state.send(member, func(codec protocol.Codec) (protocol.Frame, error) {
+		return codec.EncodePresence(event)
+	})
+}
+
+// sendClose queues close message, unlike other frames it is never dropped for a slow member.
+func (state *SessionState) sendClose(member *Member, closeMsg dto.CloseDTO) {
+	if state.members[member.Id] != member {
+		return
+	}
+	frame, err := member.codec.EncodeClose(closeMsg)
+	if errors.Is(err, protocol.ErrUnsupported) {
+		return
+	}
+	if err != nil {
+		member.logger.Error("Failed encoding frame", logging.Err(err))
+		return
+	}
+	member.enqueueClose(frame)
+}
+
+// send encodes and queues a frame for member, messages client's protocol can't carry are skipped.
+func (state *SessionState) send(member *Member, encode func(codec protocol.Codec) (protocol.Frame, error)) {
+	if state.members[member.Id] != member {
+		return
+	}
+	frame, err := encode(member.codec)
+	if errors.Is(err, protocol.ErrUnsupported) {
+		return
+	}
+	if err != nil {
+		member.logger.Error("Failed encoding frame", logging.Err(err))
+		return
+	}
+	state.deliver(member, frame)
+}
+
+// deliver queues a control or event frame, member is evicted when it can't keep up with them.
+func (state *SessionState) deliver(member *Member, frame protocol.Frame) {
+	if !member.enqueue(frame) {
+		state.evict(member)
+	}
+}
+
+// evict disconnects member which doesn't read frames fast enough.
+func (state *SessionState) evict(member *Member) {
+	member.logger.Warn("Member is not responsive")
+	metrics.UnresponsiveMembers.Inc()
+	state.disconnect(member, dto.CloseDTO{Reason: dto.CloseSlowConsumer})
+}
+
+// ErrSessionFull is returned when session already has MaxMembers members connected.
+var ErrSessionFull = errors.New("session is full")
+
+func (r *Registry) JoinSession(session db.Session, conn Conn, codec protocol.Codec, memberId int64, role auth.Role) (*Member, *SessionState, error) {
+	sessionId := session.Id
+	slog.Info("Starting position listening", logging.SessionIdKey, sessionId)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.sessions[sessionId] == nil {
+		queueForSession, ok := r.publishers[sessionId]
+		if ok {
+			delete(r.publishers, sessionId)
+		} else {
+			queueForSession = r.newQueue(sessionId)
+		}
+		sessionState := &SessionState{
+			EventQueue:   queueForSession,
+			sessionId:    sessionId,
+			members:      map[int64]*Member{},
+			visible:      map[int64]dto.PositionStateDTO{},
+			lastKeyframe: time.Now(),
+			logger:       slog.With(logging.SessionIdKey, sessionId),
+		}
+		sessionState.Initialise()
+
+		go notifyClientsLoop(sessionState, queueForSession, r.TickRate(session), r.broadcast)
+		go r.listenForSessionClose(queueForSession, sessionId)
+		go listenForMemberEvents(sessionState)
+		r.sessions[sessionId] = sessionState
+	}
+
+	member, err := r.sessions[sessionId].addMember(conn, codec, memberId, role, session.MaxMembers)
+	return member, r.sessions[sessionId], err
+
+}
+
+func (r *Registry) CloseSession(sessionId string) {
+	slog.Info("Closing session", logging.SessionIdKey, sessionId)
+	r.publisher(sessionId).CloseSession()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.publishers, sessionId)
+}
+
+func (r *Registry) GetMembers(sessionId string) []dto.MemberDTO {
+	members := r.roster(sessionId).GetMembers()
+	slices.SortFunc(members, func(a, b dto.MemberDTO) int {
+		return cmp.Compare(a.MemberId, b.MemberId)
+	})
+	return members
+}
+
+func (r *Registry) MemberCount(sessionId string) int {
+	count := 0
+	for _, member := range r.roster(sessionId).GetMembers() {
+		if member.State == dto.MemberConnected {
+			count++
+		}
 	}
+	return count
+}
+
+func (r *Registry) KickMember(sessionId string, memberId int64) {
+	slog.Info("Kicking member", logging.SessionIdKey, sessionId, logging.MemberIdKey, memberId)
+	r.publisher(sessionId).KickMember(memberId)
+}
+
+// UpdateSession pushes changed session to its members.
+func (r *Registry) UpdateSession(session dto.SessionDTO) {
+	slog.Info("Session updated", logging.SessionIdKey, session.Id, "version", session.Version)
+	r.publisher(session.Id).SessionUpdated(session)
+}
+
+// SetMemberRole changes role of member, demoted members stop being visible to others.
+func (r *Registry) SetMemberRole(sessionId string, memberId int64, role auth.Role) {
+	slog.Info("Member role changed", logging.SessionIdKey, sessionId, logging.MemberIdKey, memberId, "role", role)
+	q := r.publisher(sessionId)
+	q.SetMemberRole(memberId, role)
+	if !role.CanBroadcast() {
+		q.MemberLeft(memberId)
+	}
+}
+
+// Drain persists sessions and asks every member connected to this instance to
+// reconnect elsewhere with a fresh rejoin token. It returns once close messages
+// are written or ctx is done. Drained registry no longer counts towards metrics.
+func (r *Registry) Drain(ctx context.Context, rejoinToken func(sessionId string, memberId int64) string) {
+	defer forget(r)
+	sessions := r.sessionStates()
+	var pending []*Member
+	for _, sessionState := range sessions {
+		// persisted before members leave so positions survive the move
+		sessionState.PersistSnapshot()
+		sessionState.lockMe("drain")
+		for _, member := range sessionState.members {
+			pending = append(pending, member)
+			sessionState.disconnect(member, dto.CloseDTO{Reason: dto.CloseReconnect, RejoinToken: rejoinToken(sessionState.sessionId, member.Id)})
+		}
+		sessionState.unlockMe("drain")
+	}
+	slog.Info("Asked members to reconnect", "members", len(pending), "sessions", len(sessions))
 
-	return memberId, state[sessionId]
+	for _, member := range pending {
+		select {
+		case <-member.done:
+		case <-ctx.Done():
+			slog.Warn("Draining timed out")
+			return
+		}
+	}
+}
+
+// Ping checks queues of sessions with members on this instance are still subscribed
+// to updates from other instances, and that a new queue could be created.
+func (r *Registry) Ping(ctx context.Context) error {
+	if pinger, ok := r.pinger.(queue.Pinger); ok {
+		if err := pinger.Ping(ctx); err != nil {
+			return err
+		}
+	}
+	for _, sessionState := range r.sessionStates() {
+		if pinger, ok := sessionState.EventQueue.(queue.Pinger); ok {
+			if err := pinger.Ping(ctx); err != nil {
+				return fmt.Errorf("session %s: %w", sessionState.sessionId, err)
+			}
+		}
+	}
+	return nil
+}
 
+// publisher returns queue of the session if it has members on this instance,
+// otherwise the one kept for publishing to other instances until somebody joins.
+func (r *Registry) publisher(sessionId string) queue.EventQueue {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.sessions[sessionId] != nil {
+		return r.sessions[sessionId].EventQueue
+	}
+	if r.publishers[sessionId] == nil {
+		r.publishers[sessionId] = r.newQueue(sessionId)
+	}
+	return r.publishers[sessionId]
 }
 
-func CloseSession(sessionId string) {
-	log.Printf("Closing session %s\n", sessionId)
-	mu.Lock()
-	defer mu.Unlock()
-	if state[sessionId] != nil {
-		state[sessionId].CloseSession()
+// roster returns queue of the session kept by this instance to read its roster. When there
+// is none, a queue that isn't kept reads roster shared by instances, listing many sessions
+// doesn't leave a queue behind for each of them.
+func (r *Registry) roster(sessionId string) queue.EventQueue {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.sessions[sessionId] != nil {
+		return r.sessions[sessionId].EventQueue
+	}
+	if r.publishers[sessionId] != nil {
+		return r.publishers[sessionId]
 	}
+	return r.newQueue(sessionId)
+}
 
+// TickRate returns broadcasts per second for the session, falling back to configured default.
+func (r *Registry) TickRate(session db.Session) int {
+	if session.TickRate > 0 {
+		return session.TickRate
+	}
+	return r.broadcast.TickRate
 }
 
-func notifyClientsLoop(sessionState *SessionState, queue queue.EventQueue) {
-	ticker := time.NewTicker(1 * time.Millisecond)
+// notifyClientsLoop broadcasts at most tickRate times per second. Updates received
+// between ticks are coalesced by the queue, only the latest position of a member is sent.
+func notifyClientsLoop(sessionState *SessionState, queue queue.EventQueue, tickRate int, broadcast config.Broadcast) {
+	schedule := newTickSchedule(tickRate, broadcast)
 	done := queue.OnSessionClosed()
 	go func() {
+		timer := time.NewTimer(schedule.interval)
+		defer timer.Stop()
 		for {
 			select {
-			case <-ticker.C:
-				notifyClients(sessionState)
+			case <-timer.C:
+				timer.Reset(schedule.after(notifyClients(sessionState)))
 			case <-done:
-				ticker.Stop()
 				return
 			}
 		}
@@ -96,40 +487,225 @@ func notifyClientsLoop(sessionState *SessionState, queue queue.EventQueue) {
 
 }
 
-func notifyClients(sessionState *SessionState) {
-	if !sessionState.RefreshNeeded() {
-		return
+// tickSchedule spaces ticks of broadcast loop. In adaptive mode the interval doubles
+// on every tick without changes, up to idle interval of broadcast, and drops back
+// once somebody moves.
+type tickSchedule struct {
+	interval     time.Duration
+	idleInterval time.Duration
+	adaptive     bool
+	next         time.Duration
+}
+
+func newTickSchedule(tickRate int, broadcast config.Broadcast) *tickSchedule {
+	interval := time.Second / time.Duration(tickRate)
+	return &tickSchedule{
+		interval:     interval,
+		idleInterval: max(broadcast.IdleInterval, interval),
+		adaptive:     broadcast.Adaptive,
+		next:         interval,
+	}
+}
+
+// after returns how long to wait after a tick that broadcast something or not.
+func (s *tickSchedule) after(broadcast bool) time.Duration {
+	if broadcast || !s.adaptive {
+		s.next = s.interval
+	} else {
+		s.next = min(s.next*2, s.idleInterval)
 	}
+	return s.next
+}
+
+// notifyClients reports whether anything was broadcast.
+func notifyClients(sessionState *SessionState) bool {
 	sessionState.lockMe("notifyClients")
 	defer func() {
 		sessionState.unlockMe("notifyClients")
 	}()
-	var err error
-	var unresponsiveMemberId []int64
-	for memberId, conn := range sessionState.members {
-		toSend := []dto.PositionStateDTO{}
-		snapshot := sessionState.GetSnapshot()
-		for _, ps := range snapshot {
-			if ps.Selector != "" {
-				toSend = append(toSend, ps)
+	start := time.Now()
+
+	refreshNeeded := sessionState.RefreshNeeded()
+	keyframeDue := sessionState.changedSinceKeyframe && time.Since(sessionState.lastKeyframe) >= keyframeInterval
+	if !refreshNeeded && !keyframeDue && !sessionState.awaitsKeyframe() {
+		return false
+	}
+
+	_, span := tracing.Tracer.Start(context.Background(), "broadcast",
+		trace.WithLinks(sessionState.TraceLinks()...),
+		trace.WithAttributes(tracing.SessionIdKey.String(sessionState.sessionId)))
+	defer span.End()
+
+	var delta dto.PositionDeltaDTO
+	if refreshNeeded {
+		delta = sessionState.applyChanges(sessionState.GetChanges())
+	}
+	deltaEmpty := len(delta.Added)+len(delta.Moved)+len(delta.Removed) == 0
+	keyframe := sortedPositions(sessionState.visible)
+
+	var unresponsive []*Member
+	for _, member := range sessionState.members {
+		if !member.ready {
+			continue
+		}
+		sendKeyframe := keyframeDue || member.needsKeyframe || (!member.codec.SupportsDelta() && refreshNeeded)
+		if !sendKeyframe && deltaEmpty {
+			continue
+		}
+
+		var frame protocol.Frame
+		var err error
+		kind := dto.MessageDelta
+		if sendKeyframe {
+			frame, err = member.codec.EncodeSnapshot(keyframe)
+			member.needsKeyframe = false
+			kind = dto.MessageSnapshot
+		} else {
+			frame, err = member.codec.EncodeDelta(delta)
+		}
+		if err != nil {
+			member.logger.Error("Failed encoding frame", logging.Err(err))
+			continue
+		}
+		queued, responsive := member.enqueuePositions(frame)
+		if !responsive {
+			unresponsive = append(unresponsive, member)
+			continue
+		}
+		if queued {
+			metrics.FramesBroadcast.WithLabelValues(kind).Inc()
+		}
+	}
+	for _, member := range unresponsive {
+		sessionState.evict(member)
+	}
+	metrics.BroadcastDuration.Observe(time.Since(start).Seconds())
+	span.SetAttributes(
+		attribute.Int("browse_together.members", len(sessionState.members)),
+		attribute.Int("browse_together.unresponsive_members", len(unresponsive)),
+		attribute.Bool("browse_together.keyframe", keyframeDue),
+	)
+
+	if keyframeDue {
+		sessionState.lastKeyframe = time.Now()
+		sessionState.changedSinceKeyframe = false
+	}
+	return true
+}
+
+func (sessionState *SessionState) awaitsKeyframe() bool {
+	for _, member := range sessionState.members {
+		if member.ready && member.needsKeyframe {
+			return true
+		}
+	}
+	return false
+}
+
+// applyChanges updates positions visible to members and returns the difference.
+// Members without selector are out of tracking and not visible.
+func (sessionState *SessionState) applyChanges(updated []dto.PositionStateDTO, removed []int64) dto.PositionDeltaDTO {
+	var delta dto.PositionDeltaDTO
+	for _, ps := range updated {
+		_, wasVisible := sessionState.visible[ps.MemberId]
+		if ps.Selector == "" {
+			if wasVisible {
+				delete(sessionState.visible, ps.MemberId)
+				delta.Removed = append(delta.Removed, ps.MemberId)
 			}
+			continue
 		}
 
-		if err = conn.WriteJSON(toSend); err != nil {
-			log.Printf("Member[%d] is not responsive, session %s. %s\n", memberId, sessionState.sessionId, err)
-			unresponsiveMemberId = append(unresponsiveMemberId, memberId)
+		sessionState.visible[ps.MemberId] = ps
+		if wasVisible {
+			delta.Moved = append(delta.Moved, ps)
+		} else {
+			delta.Added = append(delta.Added, ps)
+		}
+	}
+	for _, memberId := range removed {
+		if _, wasVisible := sessionState.visible[memberId]; wasVisible {
+			delete(sessionState.visible, memberId)
+			delta.Removed = append(delta.Removed, memberId)
 		}
 	}
-	for _, memberId := range unresponsiveMemberId {
-		delete(sessionState.members, memberId)
+
+	sortPositions(delta.Added)
+	sortPositions(delta.Moved)
+	slices.Sort(delta.Removed)
+	if len(delta.Added)+len(delta.Moved)+len(delta.Removed) > 0 {
+		sessionState.changedSinceKeyframe = true
+	}
+	return delta
+}
+
+func sortedPositions(positions map[int64]dto.PositionStateDTO) []dto.PositionStateDTO {
+	sorted := make([]dto.PositionStateDTO, 0, len(positions))
+	for _, ps := range positions {
+		sorted = append(sorted, ps)
+	}
+	sortPositions(sorted)
+	return sorted
+}
+
+func sortPositions(positions []dto.PositionStateDTO) {
+	slices.SortFunc(positions, func(a, b dto.PositionStateDTO) int {
+		return cmp.Compare(a.MemberId, b.MemberId)
+	})
+}
+
+func listenForMemberEvents(sessionState *SessionState) {
+	done := sessionState.OnSessionClosed()
+	events := sessionState.OnMemberEvent()
+	for {
+		select {
+		case event := <-events:
+			sessionState.applyMemberEvent(event)
+		case <-done:
+			return
+		}
+	}
+}
+
+func (sessionState *SessionState) applyMemberEvent(event queue.MemberEvent) {
+	sessionState.lockMe("memberEvent")
+	defer sessionState.unlockMe("memberEvent")
+	if event.Kind == queue.MemberPresence {
+		for _, member := range sessionState.members {
+			if member.ready {
+				sessionState.sendPresence(member, event.Presence)
+			}
+		}
+		return
+	}
+	if event.Kind == queue.SessionUpdated {
+		for _, member := range sessionState.members {
+			if member.ready {
+				sessionState.send(member, func(codec protocol.Codec) (protocol.Frame, error) {
+					return codec.EncodeSessionUpdated(event.Session)
+				})
+			}
+		}
+		return
+	}
+
+	member, ok := sessionState.members[event.MemberId]
+	if !ok {
+		return
+	}
+	switch event.Kind {
+	case queue.MemberRoleChanged:
+		member.role.Store(event.Role)
+	case queue.MemberKicked:
+		sessionState.disconnect(member, dto.CloseDTO{Reason: dto.CloseKicked})
 	}
 }
 
-func listenForSessionClose(queue queue.EventQueue, sessionId string) {
+func (r *Registry) listenForSessionClose(queue queue.EventQueue, sessionId string) {
 	<-queue.OnSessionClosed()
 
-	mu.Lock()
-	defer mu.Unlock()
-	delete(state, sessionId)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.sessions, sessionId)
 
 }
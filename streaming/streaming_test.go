@@ -0,0 +1,679 @@
+package streaming
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/dwilkolek/browse-together-api/auth"
+	"github.com/dwilkolek/browse-together-api/config"
+	"github.com/dwilkolek/browse-together-api/db"
+	"github.com/dwilkolek/browse-together-api/dto"
+	"github.com/dwilkolek/browse-together-api/metrics"
+	"github.com/dwilkolek/browse-together-api/protocol"
+	"github.com/dwilkolek/browse-together-api/queue"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// testConn records frames written by member.
+type testConn struct {
+	written chan protocol.Frame
+	closed  chan struct{}
+}
+
+func newTestConn() *testConn {
+	return &testConn{written: make(chan protocol.Frame, 64), closed: make(chan struct{})}
+}
+
+func (c *testConn) ReadMessage() (int, []byte, error) {
+	<-c.closed
+	return 0, nil, context.Canceled
+}
+
+func (c *testConn) WriteMessage(messageType int, data []byte) error {
+	c.written <- protocol.Frame{MessageType: messageType, Data: data}
+	return nil
+}
+
+func (c *testConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+func (c *testConn) Close() error {
+	select {
+	case <-c.closed:
+	default:
+		close(c.closed)
+	}
+	return nil
+}
+
+// next returns the next frame written to c.
+func (c *testConn) next(t *testing.T) protocol.Frame {
+	t.Helper()
+	select {
+	case frame := <-c.written:
+		return frame
+	case <-time.After(time.Second):
+		t.Fatal("no frame written")
+		return protocol.Frame{}
+	}
+}
+
+// nextEnvelope returns the next frame written to member speaking JSON subprotocol.
+func (c *testConn) nextEnvelope(t *testing.T, payload any) string {
+	t.Helper()
+	var envelope dto.EnvelopeDTO
+	if err := json.Unmarshal(c.next(t).Data, &envelope); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(envelope.Payload, payload); err != nil {
+		t.Fatal(err)
+	}
+	return envelope.Type
+}
+
+// nextClose skips frames until close message of JSON subprotocol and returns it.
+func (c *testConn) nextClose(t *testing.T) dto.CloseDTO {
+	t.Helper()
+	var envelope dto.EnvelopeDTO
+	for envelope.Type != dto.MessageClose {
+		if err := json.Unmarshal(c.next(t).Data, &envelope); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var closeMsg dto.CloseDTO
+	if err := json.Unmarshal(envelope.Payload, &closeMsg); err != nil {
+		t.Fatal(err)
+	}
+	return closeMsg
+}
+
+func (c *testConn) expectNothing(t *testing.T) {
+	t.Helper()
+	select {
+	case frame := <-c.written:
+		t.Fatalf("unexpected frame %s", frame.Data)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func newTestSession(t *testing.T) *SessionState {
+	t.Helper()
+	queues, err := queue.NewFactory(config.Default(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &SessionState{
+		EventQueue:   queues("session"),
+		sessionId:    "session",
+		members:      map[int64]*Member{},
+		visible:      map[int64]dto.PositionStateDTO{},
+		lastKeyframe: time.Now(),
+		logger:       slog.Default(),
+	}
+}
+
+// join adds member that was already greeted.
+func join(state *SessionState, memberId int64, codec protocol.Codec) *testConn {
+	conn := newTestConn()
+	member := newMember(memberId, auth.RolePresenter, conn, codec, slog.Default())
+	member.ready = true
+	state.members[memberId] = member
+	return conn
+}
+
+func position(memberId int64, x float64, selector string) dto.PositionStateDTO {
+	return dto.PositionStateDTO{MemberId: memberId, X: x, Selector: selector, Location: "https://example.com", UpdatedAt: time.Now().UnixMilli()}
+}
+
+func TestNotifyClientsSendsKeyframeThenDeltas(t *testing.T) {
+	state := newTestSession(t)
+	conn := join(state, 1, &protocol.JSONCodec{})
+
+	state.SessionMemberPositionChange(context.Background(), position(1, 0.1, "#a"))
+	if !notifyClients(state) {
+		t.Fatal("nothing was broadcast")
+	}
+	var snapshot []dto.PositionStateDTO
+	if kind := conn.nextEnvelope(t, &snapshot); kind != dto.MessageSnapshot {
+		t.Fatalf("first broadcast is %s, expected keyframe", kind)
+	}
+	if len(snapshot) != 1 || snapshot[0].X != 0.1 {
+		t.Fatalf("snapshot %+v", snapshot)
+	}
+
+	state.SessionMemberPositionChange(context.Background(), position(2, 0.2, "#b"))
+	state.SessionMemberPositionChange(context.Background(), position(1, 0.3, "#a"))
+	notifyClients(state)
+	var delta dto.PositionDeltaDTO
+	if kind := conn.nextEnvelope(t, &delta); kind != dto.MessageDelta {
+		t.Fatalf("broadcast is %s, expected delta", kind)
+	}
+	if len(delta.Added) != 1 || delta.Added[0].MemberId != 2 || len(delta.Moved) != 1 || delta.Moved[0].X != 0.3 || len(delta.Removed) != 0 {
+		t.Fatalf("delta %+v", delta)
+	}
+
+	if notifyClients(state) {
+		t.Error("broadcast without changes")
+	}
+	conn.expectNothing(t)
+
+	state.MemberLeft(2)
+	notifyClients(state)
+	if kind := conn.nextEnvelope(t, &delta); kind != dto.MessageDelta || !reflect.DeepEqual(delta.Removed, []int64{2}) {
+		t.Fatalf("%s %+v, expected member 2 removed", kind, delta)
+	}
+}
+
+func TestNotifyClientsSendsKeyframeToNewMembers(t *testing.T) {
+	state := newTestSession(t)
+	first := join(state, 1, &protocol.JSONCodec{})
+	state.SessionMemberPositionChange(context.Background(), position(1, 0.1, "#a"))
+	notifyClients(state)
+	first.next(t)
+
+	second := join(state, 2, &protocol.JSONCodec{})
+	if !notifyClients(state) {
+		t.Fatal("new member didn't get a keyframe")
+	}
+	var snapshot []dto.PositionStateDTO
+	if kind := second.nextEnvelope(t, &snapshot); kind != dto.MessageSnapshot || len(snapshot) != 1 {
+		t.Fatalf("%s %+v, expected keyframe with member 1", kind, snapshot)
+	}
+	first.expectNothing(t)
+}
+
+func TestNotifyClientsSendsPeriodicKeyframe(t *testing.T) {
+	state := newTestSession(t)
+	conn := join(state, 1, &protocol.JSONCodec{})
+	state.SessionMemberPositionChange(context.Background(), position(1, 0.1, "#a"))
+	notifyClients(state)
+	conn.next(t)
+
+	state.SessionMemberPositionChange(context.Background(), position(1, 0.2, "#a"))
+	state.lastKeyframe = time.Now().Add(-keyframeInterval)
+	notifyClients(state)
+	var snapshot []dto.PositionStateDTO
+	if kind := conn.nextEnvelope(t, &snapshot); kind != dto.MessageSnapshot || snapshot[0].X != 0.2 {
+		t.Fatalf("%s %+v, expected keyframe once interval passed", kind, snapshot)
+	}
+	if state.changedSinceKeyframe {
+		t.Error("keyframe didn't clear changes")
+	}
+
+	// keyframe isn't repeated while nobody moves
+	state.lastKeyframe = time.Now().Add(-keyframeInterval)
+	if notifyClients(state) {
+		t.Error("keyframe sent without changes")
+	}
+}
+
+func TestNotifyClientsSendsSnapshotsToLegacyMembers(t *testing.T) {
+	state := newTestSession(t)
+	conn := join(state, 1, &protocol.LegacyCodec{})
+	for _, x := range []float64{0.1, 0.2} {
+		state.SessionMemberPositionChange(context.Background(), position(1, x, "#a"))
+		notifyClients(state)
+		var snapshot []dto.PositionStateDTO
+		if err := json.Unmarshal(conn.next(t).Data, &snapshot); err != nil {
+			t.Fatal(err)
+		}
+		if len(snapshot) != 1 || snapshot[0].X != x {
+			t.Fatalf("snapshot %+v, expected member 1 at %v", snapshot, x)
+		}
+	}
+}
+
+func TestTickRateOfSessionOverridesDefault(t *testing.T) {
+	cfg := config.Default()
+	cfg.Broadcast.TickRate = 20
+	queues, err := queue.NewFactory(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := NewRegistry(cfg, queues)
+	if rate := registry.TickRate(db.Session{}); rate != 20 {
+		t.Errorf("default tick rate %d", rate)
+	}
+	if rate := registry.TickRate(db.Session{TickRate: 5}); rate != 5 {
+		t.Errorf("tick rate %d, expected the one of session", rate)
+	}
+}
+
+func TestTickSchedule(t *testing.T) {
+	tests := []struct {
+		name      string
+		tickRate  int
+		broadcast config.Broadcast
+		// ticks tell whether tick broadcast anything, expected are waits after them
+		ticks    []bool
+		expected []time.Duration
+	}{
+		{
+			name:     "fixed",
+			tickRate: 4,
+			ticks:    []bool{false, false, true, false},
+			expected: []time.Duration{250 * time.Millisecond, 250 * time.Millisecond, 250 * time.Millisecond, 250 * time.Millisecond},
+		},
+		{
+			name:      "adaptive slows down while idle",
+			tickRate:  10,
+			broadcast: config.Broadcast{Adaptive: true, IdleInterval: time.Second},
+			ticks:     []bool{false, false, false, false, false},
+			expected:  []time.Duration{200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second},
+		},
+		{
+			name:      "adaptive recovers once somebody moves",
+			tickRate:  10,
+			broadcast: config.Broadcast{Adaptive: true, IdleInterval: time.Second},
+			ticks:     []bool{false, false, true, true, false},
+			expected:  []time.Duration{200 * time.Millisecond, 400 * time.Millisecond, 100 * time.Millisecond, 100 * time.Millisecond, 200 * time.Millisecond},
+		},
+		{
+			name:      "idle interval shorter than tick",
+			tickRate:  2,
+			broadcast: config.Broadcast{Adaptive: true, IdleInterval: 100 * time.Millisecond},
+			ticks:     []bool{false, false},
+			expected:  []time.Duration{500 * time.Millisecond, 500 * time.Millisecond},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			schedule := newTickSchedule(test.tickRate, test.broadcast)
+			var waits []time.Duration
+			for _, broadcast := range test.ticks {
+				waits = append(waits, schedule.after(broadcast))
+			}
+			if !reflect.DeepEqual(waits, test.expected) {
+				t.Errorf("waits %v, expected %v", waits, test.expected)
+			}
+		})
+	}
+}
+
+func TestNotifyClientsLoopBroadcastsAtTickRate(t *testing.T) {
+	state := newTestSession(t)
+	conn := join(state, 1, &protocol.JSONCodec{})
+	notifyClientsLoop(state, state.EventQueue, 20, config.Broadcast{Adaptive: true, IdleInterval: time.Second})
+	defer state.CloseSession()
+
+	// the first tick sends keyframe to the new member, then nobody moves and ticks
+	// come 100, 200, 400 and 800ms apart
+	conn.next(t)
+	time.Sleep(800 * time.Millisecond)
+	state.SessionMemberPositionChange(context.Background(), position(1, 0.1, "#a"))
+	moved := time.Now()
+	conn.next(t)
+	if waited := time.Since(moved); waited < 200*time.Millisecond || waited > 1100*time.Millisecond {
+		t.Errorf("idle loop broadcast after %s, expected it to slow down up to idle interval", waited)
+	}
+
+	// moving keeps the loop at tick rate
+	for x := 0.2; x < 0.6; x += 0.1 {
+		state.SessionMemberPositionChange(context.Background(), position(1, x, "#a"))
+		moved := time.Now()
+		conn.next(t)
+		if waited := time.Since(moved); waited > 200*time.Millisecond {
+			t.Errorf("broadcast after %s at tick rate 20", waited)
+		}
+	}
+}
+
+// stuckConn stands for a client that stopped reading, writes block until release is closed.
+type stuckConn struct {
+	*testConn
+	release chan struct{}
+}
+
+func (c *stuckConn) WriteMessage(messageType int, data []byte) error {
+	<-c.release
+	return c.testConn.WriteMessage(messageType, data)
+}
+
+// joinStuck adds greeted member whose writer is blocked on the first frame and whose queue is full.
+func joinStuck(t *testing.T, state *SessionState, memberId int64) (*Member, *stuckConn) {
+	t.Helper()
+	conn := &stuckConn{testConn: newTestConn(), release: make(chan struct{})}
+	member := newMember(memberId, auth.RolePresenter, conn, &protocol.JSONCodec{}, slog.Default())
+	member.ready = true
+	state.members[memberId] = member
+	state.SessionMemberPositionChange(context.Background(), position(memberId, 0.01, "#a"))
+	notifyClients(state)
+	for deadline := time.Now().Add(time.Second); len(member.out) > 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("writer didn't take the first frame")
+		}
+	}
+	for x := 0.02; len(member.out) < writeQueueSize; x += 0.01 {
+		state.SessionMemberPositionChange(context.Background(), position(memberId, x, "#a"))
+		notifyClients(state)
+	}
+	return member, conn
+}
+
+func TestNotifyClientsDropsPositionsForSlowMember(t *testing.T) {
+	state := newTestSession(t)
+	member, conn := joinStuck(t, state, 1)
+
+	broadcast := testutil.ToFloat64(metrics.FramesBroadcast.WithLabelValues(dto.MessageDelta))
+	dropped := testutil.ToFloat64(metrics.FramesDropped)
+	state.SessionMemberPositionChange(context.Background(), position(1, 0.9, "#a"))
+	notifyClients(state)
+	if count := testutil.ToFloat64(metrics.FramesBroadcast.WithLabelValues(dto.MessageDelta)) - broadcast; count != 0 {
+		t.Errorf("%v dropped deltas counted as broadcast", count)
+	}
+	if count := testutil.ToFloat64(metrics.FramesDropped) - dropped; count != writeQueueSize+1 {
+		t.Errorf("%v frames dropped, expected the queued ones and the new one", count)
+	}
+	state.sendPresence(member, dto.PresenceEventDTO{Type: dto.PresenceJoined, Member: dto.MemberDTO{MemberId: 2}})
+
+	close(conn.release)
+	var snapshot []dto.PositionStateDTO
+	if kind := conn.nextEnvelope(t, &snapshot); kind != dto.MessageSnapshot {
+		t.Fatalf("first frame is %s, expected keyframe written before member got stuck", kind)
+	}
+	var event dto.PresenceEventDTO
+	if kind := conn.nextEnvelope(t, &event); kind != dto.MessagePresence || event.Member.MemberId != 2 {
+		t.Fatalf("%s %+v, expected presence event to be kept", kind, event)
+	}
+	conn.expectNothing(t)
+
+	if !notifyClients(state) {
+		t.Fatal("member that missed frames didn't get a keyframe")
+	}
+	if kind := conn.nextEnvelope(t, &snapshot); kind != dto.MessageSnapshot || len(snapshot) != 1 || snapshot[0].X != 0.9 {
+		t.Fatalf("%s %+v, expected keyframe with the latest position", kind, snapshot)
+	}
+}
+
+func TestSlowConsumerIsEvicted(t *testing.T) {
+	tests := []struct {
+		name   string
+		stall  func(state *SessionState, member *Member)
+		reason string
+	}{
+		{
+			name: "positions",
+			stall: func(state *SessionState, member *Member) {
+				member.lastWrite.Store(time.Now().Add(-slowConsumerTimeout).UnixNano())
+				state.SessionMemberPositionChange(context.Background(), position(1, 0.9, "#a"))
+				notifyClients(state)
+			},
+		},
+		{
+			name: "events",
+			stall: func(state *SessionState, member *Member) {
+				// the first event replaces queued deltas, the last one doesn't fit
+				for memberId := int64(2); memberId < writeQueueSize+3; memberId++ {
+					state.sendPresence(member, dto.PresenceEventDTO{Type: dto.PresenceJoined, Member: dto.MemberDTO{MemberId: memberId}})
+				}
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			state := newTestSession(t)
+			member, conn := joinStuck(t, state, 1)
+			evicted := testutil.ToFloat64(metrics.UnresponsiveMembers)
+
+			test.stall(state, member)
+			if _, ok := state.members[1]; ok {
+				t.Fatal("slow member wasn't evicted")
+			}
+			if count := testutil.ToFloat64(metrics.UnresponsiveMembers) - evicted; count != 1 {
+				t.Errorf("%v evictions counted", count)
+			}
+
+			close(conn.release)
+			if closeMsg := conn.nextClose(t); closeMsg.Reason != dto.CloseSlowConsumer {
+				t.Errorf("closed with %q", closeMsg.Reason)
+			}
+			select {
+			case <-conn.closed:
+			case <-time.After(time.Second):
+				t.Error("connection wasn't closed")
+			}
+		})
+	}
+}
+
+func TestApplyChanges(t *testing.T) {
+	state := newTestSession(t)
+	state.visible[1] = position(1, 0.1, "#a")
+	state.visible[2] = position(2, 0.1, "#b")
+	state.visible[3] = position(3, 0.1, "#c")
+
+	delta := state.applyChanges([]dto.PositionStateDTO{
+		position(5, 0.5, "#e"),
+		position(4, 0.4, "#d"),
+		position(2, 0.2, "#b"),
+		// out of tracking
+		position(1, 0.1, ""),
+		position(6, 0.1, ""),
+	}, []int64{3, 7})
+
+	ids := func(states []dto.PositionStateDTO) []int64 {
+		var memberIds []int64
+		for _, state := range states {
+			memberIds = append(memberIds, state.MemberId)
+		}
+		return memberIds
+	}
+	if !reflect.DeepEqual(ids(delta.Added), []int64{4, 5}) {
+		t.Errorf("added %v", ids(delta.Added))
+	}
+	if !reflect.DeepEqual(ids(delta.Moved), []int64{2}) {
+		t.Errorf("moved %v", ids(delta.Moved))
+	}
+	if !reflect.DeepEqual(delta.Removed, []int64{1, 3}) {
+		t.Errorf("removed %v", delta.Removed)
+	}
+	if !reflect.DeepEqual(ids(sortedPositions(state.visible)), []int64{2, 4, 5}) {
+		t.Errorf("visible %v", ids(sortedPositions(state.visible)))
+	}
+	if !state.changedSinceKeyframe {
+		t.Error("changes weren't recorded for keyframe")
+	}
+}
+
+func TestDrainStopsObservingRegistry(t *testing.T) {
+	cfg := config.Default()
+	queues, err := queue.NewFactory(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := NewRegistry(cfg, queues)
+	if !slices.Contains(observed(), registry) {
+		t.Fatal("new registry isn't observed")
+	}
+	registry.Drain(context.Background(), func(string, int64) string { return "" })
+	if slices.Contains(observed(), registry) {
+		t.Error("drained registry is still observed")
+	}
+}
+
+func TestDrainAsksEveryMemberToReconnect(t *testing.T) {
+	cfg := config.Default()
+	queues, err := queue.NewFactory(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := db.Open(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := NewRegistry(cfg, queues)
+
+	type joined struct {
+		sessionId string
+		member    *Member
+		conn      *testConn
+	}
+	var members []joined
+	for _, sessionId := range []string{"first", "second"} {
+		for memberId := int64(1); memberId <= 2; memberId++ {
+			conn := newTestConn()
+			member, sessionState, err := registry.JoinSession(db.Session{Id: sessionId}, conn, &protocol.JSONCodec{}, memberId, auth.RolePresenter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := sessionState.Greet(member, dto.HelloDTO{MemberId: memberId}, ""); err != nil {
+				t.Fatal(err)
+			}
+			members = append(members, joined{sessionId, member, conn})
+		}
+	}
+
+	// member stuck on hello with a queue full of events still gets the close message
+	stuck := &stuckConn{testConn: newTestConn(), release: make(chan struct{})}
+	member, sessionState, err := registry.JoinSession(db.Session{Id: "first"}, stuck, &protocol.JSONCodec{}, 3, auth.RolePresenter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sessionState.Greet(member, dto.HelloDTO{MemberId: 3}, ""); err != nil {
+		t.Fatal(err)
+	}
+	sessionState.lockMe("test")
+	for len(member.out) < writeQueueSize {
+		sessionState.sendPresence(member, dto.PresenceEventDTO{Type: dto.PresenceJoined, Member: dto.MemberDTO{MemberId: 4}})
+	}
+	sessionState.unlockMe("test")
+	members = append(members, joined{"first", member, stuck.testConn})
+
+	drained := make(chan struct{})
+	go func() {
+		registry.Drain(context.Background(), store.StoreRejoinToken)
+		close(drained)
+	}()
+	close(stuck.release)
+	select {
+	case <-drained:
+	case <-time.After(time.Second):
+		t.Fatal("drain didn't wait for members")
+	}
+
+	for _, joined := range members {
+		closeMsg := joined.conn.nextClose(t)
+		if closeMsg.Reason != dto.CloseReconnect {
+			t.Errorf("member %d of %s closed with %q", joined.member.Id, joined.sessionId, closeMsg.Reason)
+			continue
+		}
+		memberId, err := store.GetMemberIdForRejoinToken(joined.sessionId, closeMsg.RejoinToken)
+		if err != nil || memberId != joined.member.Id {
+			t.Errorf("rejoin token of member %d of %s is for member %d, %v", joined.member.Id, joined.sessionId, memberId, err)
+		}
+	}
+}
+
+func TestRegistryKeepsStateOfSessionsWithoutMembers(t *testing.T) {
+	cfg := config.Default()
+	queues, err := queue.NewFactory(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := NewRegistry(cfg, queues)
+	if registry.publisher("session") != registry.publisher("session") {
+		t.Fatal("publisher isn't reused")
+	}
+
+	// role set before member connected to this instance
+	registry.SetMemberRole("session", 1, auth.RoleViewer)
+	member, sessionState, err := registry.JoinSession(db.Session{Id: "session"}, newTestConn(), &protocol.JSONCodec{}, 1, auth.RolePresenter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sessionState.Leave(member)
+	if member.Role() != auth.RoleViewer {
+		t.Errorf("member joined as %s, expected role set before", member.Role())
+	}
+	if registry.publisher("session") != sessionState.EventQueue {
+		t.Error("session doesn't publish with its own queue")
+	}
+
+	registry.publisher("other")
+	registry.CloseSession("other")
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	if _, ok := registry.publishers["other"]; ok {
+		t.Error("publisher of closed session is kept")
+	}
+}
+
+func TestReadingRosterDoesNotKeepPublisher(t *testing.T) {
+	cfg := config.Default()
+	queues, err := queue.NewFactory(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := NewRegistry(cfg, queues)
+	registry.SetMemberRole("session", 1, auth.RoleViewer)
+	registry.publisher("session").MemberJoined(dto.MemberDTO{MemberId: 1, State: dto.MemberConnected})
+
+	if count := registry.MemberCount("session"); count != 1 {
+		t.Errorf("%d members counted from kept publisher", count)
+	}
+	if count := registry.MemberCount("listed"); count != 0 {
+		t.Errorf("%d members counted in session nobody joined", count)
+	}
+	registry.GetMembers("listed")
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	if _, ok := registry.publishers["listed"]; ok {
+		t.Error("reading roster kept a publisher")
+	}
+}
+
+// slowRoster stands for roster kept in Redis, GetMembers waits for release.
+type slowRoster struct {
+	queue.EventQueue
+	reading chan struct{}
+	release chan struct{}
+}
+
+func (q *slowRoster) GetMembers() []dto.MemberDTO {
+	close(q.reading)
+	<-q.release
+	return q.EventQueue.GetMembers()
+}
+
+func TestAddMemberReadsRosterWithoutLock(t *testing.T) {
+	state := newTestSession(t)
+	roster := &slowRoster{EventQueue: state.EventQueue, reading: make(chan struct{}), release: make(chan struct{})}
+	state.EventQueue = roster
+	state.MemberJoined(dto.MemberDTO{MemberId: 5, State: dto.MemberConnected})
+
+	added := make(chan error)
+	go func() {
+		_, err := state.addMember(newTestConn(), &protocol.JSONCodec{}, 0, auth.RolePresenter, 2)
+		added <- err
+	}()
+	<-roster.reading
+	locked := make(chan struct{})
+	go func() {
+		state.lockMe("test")
+		state.unlockMe("test")
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatal("session is locked while roster is read")
+	}
+	close(roster.release)
+	if err := <-added; err != nil {
+		t.Fatal(err)
+	}
+
+	// member from roster and the one just added fill the session
+	roster.reading, roster.release = make(chan struct{}), make(chan struct{})
+	close(roster.release)
+	if _, err := state.addMember(newTestConn(), &protocol.JSONCodec{}, 0, auth.RolePresenter, 2); !errors.Is(err, ErrSessionFull) {
+		t.Errorf("err %v, expected ErrSessionFull", err)
+	}
+}
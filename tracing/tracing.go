@@ -0,0 +1,98 @@
+// Package tracing sets up OpenTelemetry tracing. Spans are dropped unless an exporter
+// is installed, either OTLP configured by OTEL_TRACES_EXPORTER or any other processor with Install.
+package tracing
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	instrumentationName = "github.com/dwilkolek/browse-together-api"
+	serviceName         = "browse-together"
+)
+
+const (
+	SessionIdKey = attribute.Key("browse_together.session_id")
+	MemberIdKey  = attribute.Key("browse_together.member_id")
+)
+
+// Tracer creates spans of the server, it follows provider installed later.
+var Tracer = otel.Tracer(instrumentationName)
+
+func init() {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+}
+
+// Setup installs exporter named by OTEL_TRACES_EXPORTER. OTLP exporter is configured
+// with standard OTEL_EXPORTER_OTLP_* variables. Returned function flushes pending spans.
+func Setup(ctx context.Context, exporterName string) (func(ctx context.Context) error, error) {
+	switch exporterName {
+	case "none":
+		return func(ctx context.Context) error { return nil }, nil
+	case "otlp":
+		exporter, err := otlptracehttp.New(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return Install(sdktrace.NewBatchSpanProcessor(exporter)).Shutdown, nil
+	}
+	return nil, fmt.Errorf("unknown OTEL_TRACES_EXPORTER %s", exporterName)
+}
+
+// Install makes processor receive all spans, e.g. tracetest.SpanRecorder in tests.
+// Sampling follows OTEL_TRACES_SAMPLER, all spans are sampled by default.
+func Install(processor sdktrace.SpanProcessor) *sdktrace.TracerProvider {
+	res, err := resource.Merge(
+		resource.Default(),
+		resource.NewSchemaless(semconv.ServiceName(serviceName)),
+	)
+	if err != nil {
+		res = resource.Default()
+	}
+	// environment, e.g. OTEL_SERVICE_NAME, takes precedence
+	if fromEnv, err := resource.New(context.Background(), resource.WithFromEnv()); err == nil {
+		if merged, err := resource.Merge(res, fromEnv); err == nil {
+			res = merged
+		}
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithSpanProcessor(processor),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	return provider
+}
+
+// Inject returns trace context of ctx to be sent along a message.
+func Inject(ctx context.Context) map[string]string {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return nil
+	}
+	return carrier
+}
+
+// Extract returns ctx continuing trace context received with a message.
+func Extract(ctx context.Context, carrier map[string]string) context.Context {
+	if len(carrier) == 0 {
+		return ctx
+	}
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(carrier))
+}
+
+// LinkFrom links span to the one active in ctx, if any.
+func LinkFrom(ctx context.Context) (trace.Link, bool) {
+	spanContext := trace.SpanContextFromContext(ctx)
+	return trace.Link{SpanContext: spanContext}, spanContext.IsValid()
+}